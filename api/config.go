@@ -0,0 +1,35 @@
+package api
+
+// Effective settings of the server, named as command line flags
+type Config struct {
+	Port                 string  `json:"port"`
+	GRPCPort             string  `json:"grpc-port"`
+	GRPCImportMaxBytes   uint64  `json:"grpc-import-max-bytes"`
+	DgConnsPool          uint    `json:"dg-conns-pool"`
+	DgHostAndPort        string  `json:"dg-host-and-port"`
+	Deadline             uint    `json:"deadline"`
+	TLSCert              string  `json:"tls-crt"`
+	TLSKey               string  `json:"tls-key"`
+	TLSClientCA          string  `json:"tls-client-ca"`
+	TLSMinVersion        string  `json:"tls-min-version"`
+	TLSCiphers           string  `json:"tls-ciphers"`
+	APIKeys              string  `json:"api-keys"`
+	AnonymousRole        string  `json:"anonymous-role"`
+	CacheSize            int     `json:"cache-size"`
+	CacheTTL             uint    `json:"cache-ttl"`
+	GraphQLMaxDepth      uint    `json:"graphql-max-depth"`
+	GraphQLMaxComplexity uint    `json:"graphql-max-complexity"`
+	Webhooks             string  `json:"webhooks"`
+	EventsBuffer         int     `json:"events-buffer"`
+	BatchGetMaxIds       uint    `json:"batch-get-max-ids"`
+	// Rate limits of each kind of routes, rates being in requests per minute
+	ImportRate           float64 `json:"import-rate"`
+	ImportBurst          uint    `json:"import-burst"`
+	ReadRate             float64 `json:"read-rate"`
+	ReadBurst            uint    `json:"read-burst"`
+	LargeDist            uint64  `json:"large-dist"`
+	LargeDistRate        float64 `json:"large-dist-rate"`
+	LargeDistBurst       uint    `json:"large-dist-burst"`
+	ExportRate           float64 `json:"export-rate"`
+	ExportBurst          uint    `json:"export-burst"`
+}
@@ -0,0 +1,292 @@
+// Package api holds the request and reply templates of the cancities API, shared by the server
+// and its clients without depending on either
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Policies for invalid features given by 'on_error' query string parameter
+const (
+	OnErrorFail = "fail"
+	OnErrorSkip = "skip"
+)
+
+// Import Request Template
+type ImportReq struct {
+	Features   []Feature    `json:"features"`
+}
+
+type Feature struct {
+	Type          string     `json:"type"`
+	Geometry      Geometry   `json:"geometry"`
+	Properties struct {
+		Name        string     `json:"name"`
+		Place_key   string     `json:"place_key"`
+		Capital     string     `json:"capital"`
+		Population  int64      `json:"population"`
+		Pclass      string     `json:"pclass"`
+		Cartodb_id  *int64     `json:"cartodb_id"`
+		Created_at  time.Time  `json:"created_at"`
+		Updated_at  time.Time  `json:"updated_at"`
+	}                        `json:"properties"`
+}
+
+// Only coordinates of Point geometries are decoded
+type Geometry struct {
+	Type          string     `json:"type"`
+	Coordinates   []float64  `json:"coordinates"`
+}
+
+// Coordinates of geometries other than Point are not decoded so that the feature
+// can be reported as rejected instead of failing the whole import
+func (g *Geometry) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type        string           `json:"type"`
+		Coordinates json.RawMessage  `json:"coordinates"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	g.Type = raw.Type
+	g.Coordinates = nil
+	if raw.Type != "Point" || len(raw.Coordinates) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw.Coordinates, &g.Coordinates)
+}
+
+
+// Error Reply Template
+type ErrorRep struct {
+	Error           string     `json:"error"`
+	Details         []string   `json:"details,omitempty"`
+}
+
+// Import Reply Template
+type ImportRep struct {
+	Error           string            `json:"error,omitempty"`
+	// Id given to the versions of cities stored by a committed import
+	ImportId        string            `json:"import_id,omitempty"`
+	Status          string            `json:"status,omitempty"`
+	DryRun          bool              `json:"dry_run,omitempty"`
+	// Always 0 for dry runs, which import nothing
+	Imported        int               `json:"imported"`
+	Changes         *ImportChanges    `json:"changes,omitempty"`
+	Mutations       *ImportMutations  `json:"mutations,omitempty"`
+	Rejected        []RejectedFeature `json:"rejected"`
+}
+
+type ImportChanges struct {
+	Inserted        int        `json:"inserted"`
+	Updated         int        `json:"updated"`
+	Unchanged       int        `json:"unchanged"`
+}
+
+// Mutation requests sent to DB by an import, failed ones are counted after retries
+type ImportMutations struct {
+	Total           int        `json:"total"`
+	Sent            int        `json:"sent"`
+	Retries         int        `json:"retries"`
+	Failed          int        `json:"failed"`
+}
+
+type RejectedFeature struct {
+	Index           int        `json:"index"`
+	CartodbId       *int64     `json:"cartodb_id"`
+	Reasons         []string   `json:"reasons"`
+}
+
+// Status Reply Template
+type StatusRep struct {
+	Message         string       `json:"message"`
+	Db              *PoolStatus  `json:"db"`
+}
+
+// Status of the pool of connections to DGraph
+type PoolStatus struct {
+	Host            string       `json:"host"`
+	Size            int          `json:"size"`
+	Healthy         int          `json:"healthy"`
+	Conns           []ConnStatus `json:"conns"`
+}
+
+// Status of a pool connection
+type ConnStatus struct {
+	State           string     `json:"state"`
+	Healthy         bool       `json:"healthy"`
+	LastCheck       time.Time  `json:"last_check"`
+	LastError       string     `json:"last_error,omitempty"`
+}
+
+// Find Reply Template
+type CityTempl struct {
+	CartodbId       int64      `json:"cartodb_id"`
+	Name            string     `json:"name"`
+	Population      int64      `json:"population"`
+	Coordinates     []float64  `json:"coordinates"`
+}
+
+type CitiesTempl struct {
+	Cities          []CityTempl `json:"cities"`
+}
+
+// Envelopes of v2 Replies
+type CityRepV2 struct {
+	Data            CityTempl       `json:"data"`
+	Meta            QueryMetaRep    `json:"meta"`
+}
+
+type CitiesRepV2 struct {
+	Data            []CityTempl     `json:"data"`
+	Pagination      PaginationRep   `json:"pagination"`
+	Meta            *QueryMetaRep   `json:"meta,omitempty"`
+}
+
+type ImportRepV2 struct {
+	Data            ImportRep       `json:"data"`
+}
+
+type PaginationRep struct {
+	Offset          uint64     `json:"offset"`
+	Limit           uint64     `json:"limit"`
+	Total           int        `json:"total"`
+}
+
+// Query of a search request
+type QueryMetaRep struct {
+	CartodbId       *int64     `json:"cartodb_id,omitempty"`
+	Center          []float64  `json:"center,omitempty"`
+	Distance        *uint64    `json:"distance,omitempty"`
+}
+
+// Batch lookup Request Template
+type BatchGetReq struct {
+	Ids             []int64    `json:"ids"`
+}
+
+// Batch lookup Reply Template, cities and missing ids being in the order of the request
+type BatchGetRep struct {
+	Cities          []CityTempl `json:"cities"`
+	Missing         []int64     `json:"missing"`
+}
+
+// History Reply Template, versions being ordered by validity, the current one last
+type CityHistoryRep struct {
+	CartodbId       int64              `json:"cartodb_id"`
+	Versions        []CityVersionTempl `json:"versions"`
+}
+
+type CityVersionTempl struct {
+	Name            string     `json:"name"`
+	PlaceKey        string     `json:"place_key"`
+	Capital         string     `json:"capital"`
+	Population      int64      `json:"population"`
+	Pclass          string     `json:"pclass"`
+	Coordinates     []float64  `json:"coordinates"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	// Unknown for the version stored before history was recorded
+	ValidFrom       *time.Time `json:"valid_from"`
+	// None for the current version
+	ValidTo         *time.Time `json:"valid_to"`
+	ImportId        string     `json:"import_id,omitempty"`
+}
+
+// Incremental sync Reply Template, changes being ordered by modified_at then id
+type ChangesRep struct {
+	Changes         []CityChangeTempl `json:"changes"`
+	// Token for getting the changes following this page, now or later
+	Next            string            `json:"next"`
+	// Set when further changes may already follow
+	More            bool              `json:"more"`
+}
+
+// Changed city, or tombstone without city when deleted. Changes are timed by the server when they
+// were stored, updated_at being the one of the imported feature
+type CityChangeTempl struct {
+	CartodbId       int64      `json:"cartodb_id"`
+	ModifiedAt      time.Time  `json:"modified_at"`
+	UpdatedAt       *time.Time `json:"updated_at,omitempty"`
+	Deleted         bool       `json:"deleted"`
+	City            *CityTempl `json:"city,omitempty"`
+}
+
+// Change Event Template, streamed on /events and posted to webhooks
+type ChangeEvent struct {
+	Id              uint64                 `json:"id"`
+	Type            string                 `json:"type"`
+	CartodbId       int64                  `json:"cartodb_id"`
+	Time            time.Time              `json:"time"`
+	// New values of the changed fields, named as feature properties, none for deletions
+	Changes         map[string]interface{} `json:"changes,omitempty"`
+}
+
+// Webhook Request Template
+type WebhookReq struct {
+	Events          []ChangeEvent   `json:"events"`
+}
+
+// GraphQL Request Template
+type GraphQLReq struct {
+	Query           string                 `json:"query"`
+	OperationName   string                 `json:"operationName,omitempty"`
+	Variables       map[string]interface{} `json:"variables,omitempty"`
+}
+
+// GraphQL Reply Templates, data being omitted when the request is invalid
+type GraphQLRep struct {
+	Data            interface{}     `json:"data,omitempty"`
+	Errors          []GraphQLError  `json:"errors,omitempty"`
+}
+
+type GraphQLError struct {
+	Message         string            `json:"message"`
+	Locations       []GraphQLLocation `json:"locations,omitempty"`
+	// Response keys and list indexes of the failed field
+	Path            []interface{}     `json:"path,omitempty"`
+}
+
+type GraphQLLocation struct {
+	Line            int        `json:"line"`
+	Column          int        `json:"column"`
+}
+
+type GraphQLSchemaRep struct {
+	Schema          string     `json:"schema"`
+}
+
+// Admin Reply Templates
+type CountRep struct {
+	Count           int64      `json:"count"`
+}
+
+type SchemaRep struct {
+	Predicates      []PredicateSchema `json:"predicates"`
+}
+
+// Schema of a predicate as reported by DGraph
+type PredicateSchema struct {
+	Predicate       string     `json:"predicate"`
+	Type            string     `json:"type"`
+	Index           bool       `json:"index"`
+	Tokenizer       []string   `json:"tokenizer,omitempty"`
+}
+
+type RebuildIndexesRep struct {
+	Rebuilt         []string   `json:"rebuilt"`
+}
+
+type LastImportRep struct {
+	ImportId        string            `json:"import_id,omitempty"`
+	Start           time.Time         `json:"start"`
+	Duration        string            `json:"duration"`
+	Status          string            `json:"status"`
+	// Always 0 for dry runs, which import nothing
+	Imported        int               `json:"imported"`
+	Rejected        int               `json:"rejected"`
+	Changes         *ImportChanges    `json:"changes,omitempty"`
+	Mutations       *ImportMutations  `json:"mutations,omitempty"`
+}
@@ -0,0 +1,428 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/AsT4re/cancities/api"
+)
+
+/*
+ * Public structures
+ */
+
+// Settings of a client
+type Options struct {
+	// Key sent in the X-API-Key header, requests are anonymous if empty
+	APIKey      string
+	// Timeout of each attempt of a request, none if 0
+	Timeout     time.Duration
+	// Number of retries of failed requests. Reads are retried on a 5xx status or a network error,
+	// requests modifying cities only when the failure shows that nothing was applied
+	MaxRetries  int
+	// TLS settings, e.g. CA of the server certificate or client certificate
+	TLSConfig   *tls.Config
+}
+
+// Error replied by the server
+type Error struct {
+	StatusCode  int
+	Message     string
+	Details     []string
+}
+
+func (e *Error) Error() string {
+	if len(e.Details) > 0 {
+		return fmt.Sprintf("%d: %s (%s)", e.StatusCode, e.Message, strings.Join(e.Details, ", "))
+	}
+	return fmt.Sprintf("%d: %s", e.StatusCode, e.Message)
+}
+
+// Check whether an error was replied with the given status code
+func HasStatus(err error, code int) bool {
+	e, ok := errors.Cause(err).(*Error)
+	return ok && e.StatusCode == code
+}
+
+// Options of an import
+type ImportOptions struct {
+	// api.OnErrorFail (default) or api.OnErrorSkip
+	OnError     string
+	DryRun      bool
+	// Called while the request body is sent, with the number of bytes sent and the total
+	Progress    func(sent, total int64)
+}
+
+// Client of the cancities HTTP API
+type Client struct {
+	baseURL     string
+	opts        Options
+	http        *http.Client
+}
+
+const (
+	retryBackoff = 100 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+)
+
+
+/*
+ * Public functions
+ */
+
+// Client constructor, baseURL being e.g. https://localhost:8443
+func NewClient(baseURL string, opts Options) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		opts: opts,
+		http: &http.Client{
+			Timeout: opts.Timeout,
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				TLSClientConfig: opts.TLSConfig,
+			},
+		},
+	}
+}
+
+// Method for getting the status of the server and its connections to DGraph
+func (c *Client) Status(ctx context.Context) (*api.StatusRep, error) {
+	var rep api.StatusRep
+	if err := c.do(ctx, &request{method: "GET", path: "/"}, &rep); err != nil {
+		// Status is still replied when no connection to DGraph is healthy
+		if HasStatus(err, http.StatusServiceUnavailable) && rep.Db != nil {
+			return &rep, err
+		}
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// Method for getting a city by id
+func (c *Client) GetCity(ctx context.Context, id int64) (*api.CityTempl, error) {
+	var rep api.CityTempl
+	if err := c.do(ctx, &request{method: "GET", path: cityPath(id)}, &rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// Method for getting the cities around a city, in a square of side dist (in kilometers)
+func (c *Client) GetCitiesAround(ctx context.Context, id int64, dist uint64) ([]api.CityTempl, error) {
+	query := url.Values{"dist": {strconv.FormatUint(dist, 10)}}
+	var rep api.CitiesTempl
+	if err := c.do(ctx, &request{method: "GET", path: cityPath(id), query: query}, &rep); err != nil {
+		return nil, err
+	}
+	return rep.Cities, nil
+}
+
+// Method for getting the cities around a location, in a square of side dist (in kilometers)
+func (c *Client) Near(ctx context.Context, lon, lat float64, dist uint64) ([]api.CityTempl, error) {
+	query := url.Values{
+		"lon": {strconv.FormatFloat(lon, 'f', -1, 64)},
+		"lat": {strconv.FormatFloat(lat, 'f', -1, 64)},
+		"dist": {strconv.FormatUint(dist, 10)},
+	}
+	var rep api.CitiesTempl
+	if err := c.do(ctx, &request{method: "GET", path: "/v1/near", query: query}, &rep); err != nil {
+		return nil, err
+	}
+	return rep.Cities, nil
+}
+
+// Method for getting every version of a city, the current one last
+func (c *Client) History(ctx context.Context, id int64) (*api.CityHistoryRep, error) {
+	var rep api.CityHistoryRep
+	if err := c.do(ctx, &request{method: "GET", path: "/id/" + strconv.FormatInt(id, 10) + "/history"}, &rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// Method for getting many cities by id at once, ids of cities not found being listed in Missing
+func (c *Client) BatchGet(ctx context.Context, ids []int64) (*api.BatchGetRep, error) {
+	body, err := json.Marshal(api.BatchGetReq{Ids: ids})
+	if err != nil {
+		return nil, errors.Wrap(err, "error serializing batch request")
+	}
+
+	var rep api.BatchGetRep
+	if err := c.do(ctx, &request{method: "POST", path: "/cities:batchGet", body: body, readOnly: true}, &rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// Method for getting every city, ordered by id
+func (c *Client) Cities(ctx context.Context) ([]api.CityTempl, error) {
+	var rep api.CitiesTempl
+	if err := c.do(ctx, &request{method: "GET", path: "/v1/cities"}, &rep); err != nil {
+		return nil, err
+	}
+	return rep.Cities, nil
+}
+
+// Method for getting at most limit cities modified after since, deleted ones as tombstones. The
+// following changes are got with the Next token of the reply
+func (c *Client) Changes(ctx context.Context, since time.Time, limit uint64) (*api.ChangesRep, error) {
+	return c.changes(ctx, url.Values{"since": {since.Format(time.RFC3339Nano)}}, limit)
+}
+
+// Method for getting at most limit changes following the page whose Next token is given
+func (c *Client) ChangesAfter(ctx context.Context, token string, limit uint64) (*api.ChangesRep, error) {
+	return c.changes(ctx, url.Values{"token": {token}}, limit)
+}
+
+func (c *Client) changes(ctx context.Context, query url.Values, limit uint64) (*api.ChangesRep, error) {
+	if limit > 0 {
+		query.Set("limit", strconv.FormatUint(limit, 10))
+	}
+
+	var rep api.ChangesRep
+	if err := c.do(ctx, &request{method: "GET", path: "/cities/changes", query: query}, &rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// Method for importing cities. The reply is also returned along with the error when the import
+// fails, as it holds rejected features and the status of the import
+func (c *Client) Import(ctx context.Context, req *api.ImportReq, opts ImportOptions) (*api.ImportRep, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error serializing import request")
+	}
+	return c.ImportRaw(ctx, body, opts)
+}
+
+// Method for importing cities from a GeoJSON document already serialized, e.g. read from a file
+func (c *Client) ImportRaw(ctx context.Context, body []byte, opts ImportOptions) (*api.ImportRep, error) {
+	query := url.Values{}
+	if opts.OnError != "" {
+		query.Set("on_error", opts.OnError)
+	}
+	if opts.DryRun {
+		query.Set("dry_run", "true")
+	}
+
+	var rep api.ImportRep
+	req := &request{method: "POST", path: "/v1/import", query: query, body: body, progress: opts.Progress}
+	if err := c.do(ctx, req, &rep); err != nil {
+		if rep.Status != "" || len(rep.Rejected) > 0 {
+			return &rep, err
+		}
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// Method for dropping every city
+func (c *Client) DropAll(ctx context.Context) error {
+	return c.do(ctx, &request{method: "DELETE", path: "/admin/cities"}, nil)
+}
+
+// Method for counting cities
+func (c *Client) CountCities(ctx context.Context) (int64, error) {
+	var rep api.CountRep
+	if err := c.do(ctx, &request{method: "GET", path: "/admin/cities/count"}, &rep); err != nil {
+		return 0, err
+	}
+	return rep.Count, nil
+}
+
+// Method for getting the DB schema
+func (c *Client) Schema(ctx context.Context) (*api.SchemaRep, error) {
+	var rep api.SchemaRep
+	if err := c.do(ctx, &request{method: "GET", path: "/admin/schema"}, &rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// Method for getting statistics about the last import
+func (c *Client) LastImport(ctx context.Context) (*api.LastImportRep, error) {
+	var rep api.LastImportRep
+	if err := c.do(ctx, &request{method: "GET", path: "/admin/imports/last"}, &rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// Method for rebuilding indexes, return the rebuilt predicates
+func (c *Client) RebuildIndexes(ctx context.Context) ([]string, error) {
+	var rep api.RebuildIndexesRep
+	if err := c.do(ctx, &request{method: "POST", path: "/admin/indexes/rebuild"}, &rep); err != nil {
+		return nil, err
+	}
+	return rep.Rebuilt, nil
+}
+
+// Method for getting the effective configuration of the server
+func (c *Client) Config(ctx context.Context) (*api.Config, error) {
+	var rep api.Config
+	if err := c.do(ctx, &request{method: "GET", path: "/admin/config"}, &rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// Method for getting the OpenAPI specification of the server
+func (c *Client) OpenAPI(ctx context.Context) (map[string]interface{}, error) {
+	var rep map[string]interface{}
+	if err := c.do(ctx, &request{method: "GET", path: "/openapi.json"}, &rep); err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+
+/*
+ * Private functions
+ */
+
+func cityPath(id int64) string {
+	return "/v1/id/" + strconv.FormatInt(id, 10)
+}
+
+type request struct {
+	method   string
+	path     string
+	query    url.Values
+	body     []byte
+	progress func(sent, total int64)
+	// Set for requests other than GET which modify nothing, so that they can be sent again
+	readOnly bool
+}
+
+// Reader of a request body reporting progress
+type progressReader struct {
+	reader   io.Reader
+	sent     int64
+	total    int64
+	progress func(sent, total int64)
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.reader.Read(p)
+	pr.sent += int64(n)
+	pr.progress(pr.sent, pr.total)
+	return n, err
+}
+
+// Send a request, retrying with exponential backoff when it may succeed if sent again.
+// Reply is decoded in rep, also for errors so that details of the failure are kept
+func (c *Client) do(ctx context.Context, req *request, rep interface{}) error {
+	backoff := retryBackoff
+	for retries := 0; ; retries++ {
+		err := c.send(ctx, req, rep)
+		if !retryable(req, err) || retries >= c.opts.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "request cancelled while retrying")
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, req *request, rep interface{}) error {
+	method := req.method
+	u := c.baseURL + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+
+	var reader io.Reader
+	if req.body != nil {
+		reader = bytes.NewReader(req.body)
+		if req.progress != nil {
+			reader = &progressReader{reader, 0, int64(len(req.body)), req.progress}
+		}
+	}
+	httpReq, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return errors.Wrap(err, "error creating request")
+	}
+	httpReq = httpReq.WithContext(ctx)
+	if req.body != nil {
+		// Length is unknown to net/http once the body is wrapped
+		httpReq.ContentLength = int64(len(req.body))
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if c.opts.APIKey != "" {
+		httpReq.Header.Set("X-API-Key", c.opts.APIKey)
+	}
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return errors.Wrapf(err, "error sending %s %s", method, u)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "error reading reply of %s %s", method, u)
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if rep == nil || len(data) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(data, rep); err != nil {
+			return errors.Wrapf(err, "error decoding reply of %s %s", method, u)
+		}
+		return nil
+	}
+
+	apiErr := &Error{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	var errRep api.ErrorRep
+	if json.Unmarshal(data, &errRep) == nil && errRep.Error != "" {
+		apiErr.Message = errRep.Error
+		apiErr.Details = errRep.Details
+	}
+	if rep != nil {
+		json.Unmarshal(data, rep)
+	}
+	return apiErr
+}
+
+// Check whether a failed request may succeed if sent again. Requests modifying cities are only
+// sent again when nothing was applied, as the server may otherwise have committed them before
+// the reply was lost, e.g. when the client timeout fires during an import
+func retryable(req *request, err error) bool {
+	if err == nil {
+		return false
+	}
+	idempotent := req.method == "GET" || req.method == "HEAD" || req.readOnly
+	switch e := errors.Cause(err).(type) {
+	case *Error:
+		if idempotent {
+			return e.StatusCode >= 500
+		}
+		return e.StatusCode == http.StatusServiceUnavailable || e.StatusCode == http.StatusTooManyRequests
+	case *url.Error:
+		// Network error, the request did not reach the server only when it could not connect
+		if op, ok := e.Err.(*net.OpError); ok && op.Op == "dial" {
+			return true
+		}
+		return idempotent
+	}
+	return false
+}
@@ -0,0 +1,341 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+	"github.com/AsT4re/cancities/api"
+	"github.com/AsT4re/cancities/server"
+)
+
+const testKeys = `
+keys:
+  - name: test-reader
+    key: reader-key
+    role: reader
+  - name: test-admin
+    key: admin-key
+    role: admin
+`
+
+var testKeysFile string
+
+func TestMain(m *testing.M) {
+	f, err := ioutil.TempFile("", "api_keys_")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %+v\n", err)
+		os.Exit(1)
+	}
+	f.WriteString(testKeys)
+	f.Close()
+	testKeysFile = f.Name()
+
+	code := m.Run()
+	os.Remove(testKeysFile)
+	os.Exit(code)
+}
+
+
+/*
+ *  Tests against the server
+ */
+
+// Test effective configuration got by admins, secrets being redacted
+func TestConfig(t *testing.T) {
+	ts, config := startServer(t)
+	defer ts.Close()
+
+	c := newTestClient(ts, "admin-key")
+	result, err := c.Config(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v\n", err)
+	}
+	if expected := api.Config(config.Redacted()); !reflect.DeepEqual(*result, expected) {
+		t.Errorf("Expected config %+v, got %+v\n", expected, *result)
+	}
+}
+
+// Test specification got without key
+func TestOpenAPI(t *testing.T) {
+	ts, _ := startServer(t)
+	defer ts.Close()
+
+	spec, err := newTestClient(ts, "").OpenAPI(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v\n", err)
+	}
+	if spec["openapi"] != "3.0.0" {
+		t.Errorf("Unexpected OpenAPI version %v\n", spec["openapi"])
+	}
+}
+
+// Test error replies returned as *Error with their status, message and details
+func TestErrorMapping(t *testing.T) {
+	ts, _ := startServer(t)
+	defer ts.Close()
+
+	_, err := newTestClient(ts, "").GetCitiesAround(context.Background(), 42, server.MaxDist + 1)
+	if !HasStatus(err, http.StatusBadRequest) {
+		t.Fatalf("Expected error with status 400, got %v\n", err)
+	}
+	e := err.(*Error)
+	if e.Message != server.ErrInvalidQsParams || len(e.Details) != 1 {
+		t.Errorf("Unexpected error details: %+v\n", e)
+	}
+
+	if _, err := newTestClient(ts, "reader-key").CountCities(context.Background()); !HasStatus(err, http.StatusForbidden) {
+		t.Errorf("Expected error with status 403, got %v\n", err)
+	}
+
+	if _, err := newTestClient(ts, "unknown-key").GetCity(context.Background(), 42); !HasStatus(err, http.StatusUnauthorized) {
+		t.Errorf("Expected error with status 401, got %v\n", err)
+	}
+}
+
+
+/*
+ *  Tests of retries and timeouts
+ */
+
+// Test requests retried on 5xx replies until retries are exhausted
+func TestRetryOn5xx(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", server.JsonContentType)
+		fmt.Fprint(w, `{"count": 12}`)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, Options{MaxRetries: 2, TLSConfig: tlsConfig(ts)})
+	count, err := c.CountCities(context.Background())
+	if err != nil || count != 12 {
+		t.Errorf("Expected count 12 after retries, got %v and %v\n", count, err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %v\n", attempts)
+	}
+
+	atomic.StoreInt32(&attempts, 0)
+	c = NewClient(ts.URL, Options{MaxRetries: 1, TLSConfig: tlsConfig(ts)})
+	if _, err := c.CountCities(context.Background()); !HasStatus(err, http.StatusBadGateway) {
+		t.Errorf("Expected error with status 502 once retries exhausted, got %v\n", err)
+	}
+}
+
+// Test requests not retried on 4xx replies
+func TestNoRetryOn4xx(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error": "City not found"}`)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, Options{MaxRetries: 3, TLSConfig: tlsConfig(ts)})
+	if _, err := c.GetCity(context.Background(), 1); !HasStatus(err, http.StatusNotFound) {
+		t.Errorf("Expected error with status 404, got %v\n", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected 1 attempt, got %v\n", attempts)
+	}
+}
+
+// Test imports not sent again after a timeout or a 5xx reply, as they may have been committed,
+// but sent again when refused before anything was applied
+func TestNoRetryOfImports(t *testing.T) {
+	var attempts, status int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		code := int(atomic.LoadInt32(&status))
+		if atomic.AddInt32(&attempts, 1) == 1 && code == 0 {
+			// Committing for longer than the client timeout
+			time.Sleep(200 * time.Millisecond)
+		}
+		if code != 0 {
+			w.WriteHeader(code)
+		}
+		fmt.Fprint(w, `{"imported": 0, "rejected": []}`)
+	}))
+	defer ts.Close()
+
+	body := []byte(`{"features": []}`)
+	cases := []struct {
+		status   int32
+		attempts int32
+	}{
+		{0, 1},
+		{http.StatusInternalServerError, 1},
+		{http.StatusServiceUnavailable, 4},
+		{http.StatusTooManyRequests, 4},
+	}
+	for _, c := range cases {
+		atomic.StoreInt32(&attempts, 0)
+		atomic.StoreInt32(&status, c.status)
+		cl := NewClient(ts.URL, Options{Timeout: 100 * time.Millisecond, MaxRetries: 3, TLSConfig: tlsConfig(ts)})
+		if _, err := cl.ImportRaw(context.Background(), body, ImportOptions{}); err == nil {
+			t.Errorf("Expected error for import failing with status %v\n", c.status)
+		}
+		if n := atomic.LoadInt32(&attempts); n != c.attempts {
+			t.Errorf("Expected %v attempts of import failing with status %v, got %v\n", c.attempts, c.status, n)
+		}
+	}
+}
+
+// Test getting the next page of changes with the token of the previous one
+func TestChangesToken(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/cities/changes" || query.Get("limit") != "2" {
+			t.Errorf("Unexpected request %v\n", r.URL)
+		}
+		w.Header().Set("Content-Type", server.JsonContentType)
+		if query.Get("since") == "2017-01-02T03:04:05Z" {
+			fmt.Fprint(w, `{"changes": [{"cartodb_id": 7, "modified_at": "2017-01-02T03:04:06Z", "deleted": true}], "next": "page-2", "more": true}`)
+			return
+		}
+		if query.Get("token") != "page-2" {
+			t.Errorf("Expected token of previous page, got %v\n", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `{"changes": [], "next": "page-2", "more": false}`)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, Options{TLSConfig: tlsConfig(ts)})
+	rep, err := c.Changes(context.Background(), time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC), 2)
+	if err != nil || len(rep.Changes) != 1 || !rep.Changes[0].Deleted || !rep.More {
+		t.Fatalf("Unexpected first page %+v, error %v\n", rep, err)
+	}
+	if rep, err = c.ChangesAfter(context.Background(), rep.Next, 2); err != nil || rep.More {
+		t.Errorf("Unexpected last page %+v, error %v\n", rep, err)
+	}
+}
+
+// Test getting cities by ids in a single request
+func TestBatchGet(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "POST" || r.URL.Path != "/cities:batchGet" || string(body) != `{"ids":[42,7]}` {
+			t.Errorf("Unexpected request %v %v %s\n", r.Method, r.URL, body)
+		}
+		w.Header().Set("Content-Type", server.JsonContentType)
+		fmt.Fprint(w, `{"cities": [{"cartodb_id": 42, "name": "Montreal"}], "missing": [7]}`)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, Options{TLSConfig: tlsConfig(ts)})
+	rep, err := c.BatchGet(context.Background(), []int64{42, 7})
+	if err != nil || len(rep.Cities) != 1 || rep.Cities[0].CartodbId != 42 || !reflect.DeepEqual(rep.Missing, []int64{7}) {
+		t.Errorf("Unexpected batch reply %+v, error %v\n", rep, err)
+	}
+}
+
+// Test progress of the upload of an import
+func TestImportProgress(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if r.URL.Query().Get("dry_run") != "true" {
+			t.Errorf("Expected dry_run in query string, got %v\n", r.URL.RawQuery)
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"dry_run": true, "imported": 0, "changes": {"inserted": 2}}`)
+	}))
+	defer ts.Close()
+
+	body := []byte(`{"features": []}`)
+	var sent, total int64
+	opts := ImportOptions{
+		DryRun: true,
+		Progress: func(s, t int64) {
+			sent, total = s, t
+		},
+	}
+	rep, err := newTestClient(ts, "").ImportRaw(context.Background(), body, opts)
+	if err != nil || !rep.DryRun || rep.Changes == nil || rep.Changes.Inserted != 2 {
+		t.Errorf("Unexpected reply %+v and error %v\n", rep, err)
+	}
+	if sent != int64(len(body)) || total != int64(len(body)) {
+		t.Errorf("Expected progress %v/%v, got %v/%v\n", len(body), len(body), sent, total)
+	}
+}
+
+// Test requests cancelled by their context and by the client timeout
+func TestTimeout(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, Options{TLSConfig: tlsConfig(ts)})
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	if _, err := c.Status(ctx); err == nil {
+		t.Errorf("Expected error when context deadline is exceeded\n")
+	}
+
+	c = NewClient(ts.URL, Options{Timeout: 50 * time.Millisecond, TLSConfig: tlsConfig(ts)})
+	if _, err := c.Status(context.Background()); err == nil {
+		t.Errorf("Expected error when timeout is exceeded\n")
+	}
+}
+
+
+/*
+ *  Helpers
+ */
+
+// Serve the routes of a server not connected to DGraph, so only routes not using it work
+func startServer(t *testing.T) (*httptest.Server, server.Config) {
+	config := server.Config{
+		Port: "8443",
+		GRPCImportMaxBytes: 1 << 20,
+		DgConnsPool: 1,
+		DgHostAndPort: "127.0.0.1:9080",
+		TLSCert: "../certificates/server.crt",
+		TLSKey: "../certificates/server.key",
+		APIKeys: testKeysFile,
+		AnonymousRole: "reader",
+		GraphQLMaxDepth: 5,
+		GraphQLMaxComplexity: 10000,
+		EventsBuffer: 100,
+		BatchGetMaxIds: 1000,
+		ImportRate: 1,
+		ImportBurst: 3,
+		ReadRate: 1200,
+		ReadBurst: 40,
+		LargeDist: 100,
+		LargeDistRate: 12,
+		LargeDistBurst: 3,
+		ExportRate: 12,
+		ExportBurst: 10,
+	}
+	s := new(server.Server)
+	if err := s.Init(config); err != nil {
+		t.Fatalf("Fail to init server: %+v\n", err)
+	}
+	return httptest.NewTLSServer(s.Handler()), config
+}
+
+func newTestClient(ts *httptest.Server, key string) *Client {
+	return NewClient(ts.URL, Options{APIKey: key, TLSConfig: tlsConfig(ts)})
+}
+
+// TLS config trusting the certificate of a test server
+func tlsConfig(ts *httptest.Server) *tls.Config {
+	return ts.Client().Transport.(*http.Transport).TLSClientConfig
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/AsT4re/cancities/client"
+	"github.com/AsT4re/cancities/api"
+)
+
+var (
+	baseURL = flag.String("url", envOr("CANCITIES_URL", "https://localhost:8443"), "URL of the server (or CANCITIES_URL)")
+	apiKey = flag.String("api-key", os.Getenv("CANCITIES_API_KEY"), "API key (or CANCITIES_API_KEY)")
+	caCert = flag.String("ca-cert", "", "CA certificate of the server, system CAs if empty")
+	insecure = flag.Bool("insecure", false, "Do not verify the certificate of the server")
+	timeout = flag.Uint("timeout", 30, "Timeout of requests (in seconds), imports not being timed out")
+	retries = flag.Int("retries", 3, "Number of retries of requests failing with a 5xx status, imports not being retried")
+	output = flag.String("output", outputTable, "Output format: table, json or geojson")
+)
+
+// Handler of a command, given the arguments following its name
+type command func(ctx context.Context, c *client.Client, out *printer, args []string) error
+
+var commands = map[string]command{
+	"get": getCommand,
+	"around": aroundCommand,
+	"near": nearCommand,
+	"import": importCommand,
+	"export": exportCommand,
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [flags] <command> [arguments]
+
+Commands:
+  get <id>                           Get a city
+  around <id> --dist N               Get the cities around a city, in a square of side N km
+  near --lon X --lat Y [--dist N]    Get the cities around a location
+  import <file> [--on-error skip] [--dry-run]
+                                     Import cities from a GeoJSON file
+  export                             Get every city
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func run() error {
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		flag.Usage()
+		if flag.Arg(0) == "" {
+			return errors.New("missing command")
+		}
+		return errors.Errorf("unknown command '%v'", flag.Arg(0))
+	}
+
+	out, err := newPrinter(*output, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: *insecure}
+	if *caCert != "" {
+		pem, err := ioutil.ReadFile(*caCert)
+		if err != nil {
+			return errors.Wrap(err, "error reading CA certificate")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return errors.Errorf("no certificate found in %v", *caCert)
+		}
+	}
+
+	opts := client.Options{
+		APIKey: *apiKey,
+		Timeout: time.Duration(*timeout) * time.Second,
+		MaxRetries: *retries,
+		TLSConfig: tlsConfig,
+	}
+	// Uploading a large file takes longer than other requests, and an import given up by the client
+	// may still be committed by the server, so it is neither timed out nor sent again
+	if flag.Arg(0) == "import" {
+		opts.Timeout = 0
+		opts.MaxRetries = 0
+	}
+	c := client.NewClient(*baseURL, opts)
+	return cmd(context.Background(), c, out, flag.Args()[1:])
+}
+
+
+/*
+ *  Commands
+ */
+
+func getCommand(ctx context.Context, c *client.Client, out *printer, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := parseId(pos[0])
+	if err != nil {
+		return err
+	}
+
+	city, err := c.GetCity(ctx, id)
+	if err != nil {
+		return err
+	}
+	return out.city(city)
+}
+
+func aroundCommand(ctx context.Context, c *client.Client, out *printer, args []string) error {
+	fs := flag.NewFlagSet("around", flag.ExitOnError)
+	dist := fs.Uint64("dist", 10, "Side of the square around the city (in kilometers)")
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := parseId(pos[0])
+	if err != nil {
+		return err
+	}
+
+	cities, err := c.GetCitiesAround(ctx, id, *dist)
+	if err != nil {
+		return err
+	}
+	return out.cities(cities)
+}
+
+func nearCommand(ctx context.Context, c *client.Client, out *printer, args []string) error {
+	fs := flag.NewFlagSet("near", flag.ExitOnError)
+	lon := fs.Float64("lon", 0, "Longitude of the location")
+	lat := fs.Float64("lat", 0, "Latitude of the location")
+	dist := fs.Uint64("dist", 10, "Side of the square around the location (in kilometers)")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if !set["lon"] || !set["lat"] {
+		return errors.New("usage: near --lon X --lat Y [--dist N]")
+	}
+
+	cities, err := c.Near(ctx, *lon, *lat, *dist)
+	if err != nil {
+		return err
+	}
+	return out.cities(cities)
+}
+
+func importCommand(ctx context.Context, c *client.Client, out *printer, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	onError := fs.String("on-error", api.OnErrorFail, "Policy for invalid features: fail or skip")
+	dryRun := fs.Bool("dry-run", false, "Only validate the file and count changes")
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadFile(pos[0])
+	if err != nil {
+		return errors.Wrap(err, "error reading file")
+	}
+
+	bar := newProgressBar(os.Stderr)
+	rep, err := c.ImportRaw(ctx, body, client.ImportOptions{
+		OnError: *onError,
+		DryRun: *dryRun,
+		Progress: bar.update,
+	})
+	bar.done()
+	if rep != nil {
+		if printErr := out.importRep(rep); printErr != nil && err == nil {
+			err = printErr
+		}
+	}
+	return err
+}
+
+func exportCommand(ctx context.Context, c *client.Client, out *printer, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	cities, err := c.Cities(ctx)
+	if err != nil {
+		return err
+	}
+	return out.cities(cities)
+}
+
+
+/*
+ *  Helpers
+ */
+
+// Parse flags of a command, which may be given before or after its positional arguments
+func parseArgs(fs *flag.FlagSet, args []string, nbPositional int) ([]string, error) {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if len(pos) != nbPositional {
+		return nil, errors.Errorf("%v: expected %v argument(s), got %v", fs.Name(), nbPositional, len(pos))
+	}
+	return pos, nil
+}
+
+func parseId(s string) (int64, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 0 {
+		return 0, errors.Errorf("invalid id '%v'", s)
+	}
+	return id, nil
+}
+
+func envOr(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
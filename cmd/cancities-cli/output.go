@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"github.com/pkg/errors"
+	"github.com/AsT4re/cancities/api"
+)
+
+const (
+	outputTable = "table"
+	outputJson = "json"
+	outputGeoJson = "geojson"
+)
+
+// Print replies in the chosen format
+type printer struct {
+	format string
+	w      io.Writer
+}
+
+func newPrinter(format string, w io.Writer) (*printer, error) {
+	switch format {
+	case outputTable, outputJson, outputGeoJson:
+		return &printer{format, w}, nil
+	}
+	return nil, errors.Errorf("unknown output format '%v'", format)
+}
+
+func (p *printer) city(city *api.CityTempl) error {
+	switch p.format {
+	case outputJson:
+		return p.json(city)
+	case outputGeoJson:
+		return p.json(feature(city))
+	}
+	return p.table([]api.CityTempl{*city})
+}
+
+func (p *printer) cities(cities []api.CityTempl) error {
+	switch p.format {
+	case outputJson:
+		return p.json(cities)
+	case outputGeoJson:
+		features := make([]geoJsonFeature, len(cities))
+		for i := range cities {
+			features[i] = feature(&cities[i])
+		}
+		return p.json(geoJsonCollection{"FeatureCollection", features})
+	}
+	return p.table(cities)
+}
+
+// Import replies are printed as JSON, except for table format where a summary is printed
+func (p *printer) importRep(rep *api.ImportRep) error {
+	if p.format != outputTable {
+		return p.json(rep)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	if rep.Status != "" {
+		fmt.Fprintf(tw, "Status:\t%v\n", rep.Status)
+	}
+	if rep.DryRun {
+		fmt.Fprintf(tw, "Dry run:\ttrue\n")
+	}
+	if !rep.DryRun {
+		fmt.Fprintf(tw, "Imported:\t%v\n", rep.Imported)
+	}
+	if rep.Changes != nil {
+		fmt.Fprintf(tw, "Inserted / updated / unchanged:\t%v / %v / %v\n",
+			rep.Changes.Inserted, rep.Changes.Updated, rep.Changes.Unchanged)
+	}
+	if rep.Mutations != nil {
+		fmt.Fprintf(tw, "Mutations sent / retried / failed:\t%v / %v / %v\n",
+			rep.Mutations.Sent, rep.Mutations.Retries, rep.Mutations.Failed)
+	}
+	fmt.Fprintf(tw, "Rejected:\t%v\n", len(rep.Rejected))
+	for _, r := range rep.Rejected {
+		id := "-"
+		if r.CartodbId != nil {
+			id = fmt.Sprint(*r.CartodbId)
+		}
+		fmt.Fprintf(tw, "  feature %v (cartodb_id %v):\t%v\n", r.Index, id, strings.Join(r.Reasons, ", "))
+	}
+	return tw.Flush()
+}
+
+func (p *printer) table(cities []api.CityTempl) error {
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "CARTODB_ID\tNAME\tPOPULATION\tLONGITUDE\tLATITUDE\n")
+	for _, c := range cities {
+		lon, lat := "", ""
+		if len(c.Coordinates) == 2 {
+			lon, lat = fmt.Sprint(c.Coordinates[0]), fmt.Sprint(c.Coordinates[1])
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", c.CartodbId, c.Name, c.Population, lon, lat)
+	}
+	return tw.Flush()
+}
+
+func (p *printer) json(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error serializing output")
+	}
+	_, err = fmt.Fprintf(p.w, "%s\n", data)
+	return err
+}
+
+
+/*
+ *  GeoJSON
+ */
+
+type geoJsonCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJsonFeature `json:"features"`
+}
+
+type geoJsonFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   api.Geometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+func feature(city *api.CityTempl) geoJsonFeature {
+	return geoJsonFeature{
+		Type: "Feature",
+		Geometry: api.Geometry{Type: "Point", Coordinates: city.Coordinates},
+		Properties: map[string]interface{}{
+			"cartodb_id": city.CartodbId,
+			"name": city.Name,
+			"population": city.Population,
+		},
+	}
+}
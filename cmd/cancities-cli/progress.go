@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const progressBarWidth = 40
+
+// Progress bar of an upload, redrawn on a single line
+type progressBar struct {
+	w       io.Writer
+	percent int
+	drawn   bool
+}
+
+func newProgressBar(w io.Writer) *progressBar {
+	return &progressBar{w: w, percent: -1}
+}
+
+func (pb *progressBar) update(sent, total int64) {
+	percent := 100
+	if total > 0 {
+		percent = int(sent * 100 / total)
+	}
+	if percent == pb.percent {
+		return
+	}
+	pb.percent = percent
+	pb.drawn = true
+
+	filled := percent * progressBarWidth / 100
+	fmt.Fprintf(pb.w, "\rUploading [%s%s] %3d%% %v/%v KB",
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth - filled),
+		percent, sent / 1024, total / 1024)
+}
+
+// End the line of the bar once upload is done, server processing being not reported
+func (pb *progressBar) done() {
+	if pb.drawn {
+		fmt.Fprintf(pb.w, "\n")
+	}
+}
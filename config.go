@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"github.com/pkg/errors"
+	"github.com/AsT4re/cancities/server"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Prefix of environment variables overriding settings
+const envPrefix = "CANCITIES_"
+
+// Complete flags with the config file and environment variables, flags given on command line
+// taking precedence over environment variables, themselves taking precedence over the file
+func loadConfig() (server.Config, error) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	file := *configFile
+	if !set["config"] {
+		if env, ok := os.LookupEnv(envName("config")); ok {
+			file = env
+		}
+	}
+	if file != "" {
+		if err := loadConfigFile(file, set); err != nil {
+			return server.Config{}, err
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		env, ok := os.LookupEnv(envName(f.Name))
+		if err != nil || !ok || set[f.Name] || f.Name == "config" {
+			return
+		}
+		if e := flag.Set(f.Name, env); e != nil {
+			err = errors.Wrapf(e, "invalid value '%v' for %v", env, envName(f.Name))
+		}
+	})
+	if err != nil {
+		return server.Config{}, err
+	}
+
+	config := server.Config{
+		Port: *port,
+		GRPCPort: *grpcPort,
+		GRPCImportMaxBytes: *grpcImportMaxBytes,
+		DgConnsPool: *nbConns,
+		DgHostAndPort: *dgraph,
+		Deadline: *deadline,
+		TLSCert: *cert,
+		TLSKey: *key,
+		TLSClientCA: *clientCA,
+		TLSMinVersion: *tlsMinVersion,
+		TLSCiphers: *tlsCiphers,
+		APIKeys: *apiKeys,
+		AnonymousRole: *anonymousRole,
+		CacheSize: *cacheSize,
+		CacheTTL: *cacheTTL,
+		GraphQLMaxDepth: *graphqlMaxDepth,
+		GraphQLMaxComplexity: *graphqlMaxComplexity,
+		Webhooks: *webhooks,
+		EventsBuffer: *eventsBuffer,
+		BatchGetMaxIds: *batchGetMaxIds,
+		ImportRate: *importRate,
+		ImportBurst: *importBurst,
+		ReadRate: *readRate,
+		ReadBurst: *readBurst,
+		LargeDist: *largeDist,
+		LargeDistRate: *largeDistRate,
+		LargeDistBurst: *largeDistBurst,
+		ExportRate: *exportRate,
+		ExportBurst: *exportBurst,
+	}
+	if err := config.Validate(); err != nil {
+		return config, errors.Wrap(err, "invalid configuration")
+	}
+	return config, nil
+}
+
+// Set flags not given on command line from a YAML file, whose keys are flag names
+func loadConfigFile(file string, set map[string]bool) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "error reading config file")
+	}
+
+	var content map[string]interface{}
+	if err := yaml.Unmarshal(data, &content); err != nil {
+		return errors.Wrap(err, "error parsing config file")
+	}
+
+	names := make([]string, 0, len(content))
+	for name := range content {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "config" || flag.Lookup(name) == nil {
+			return errors.Errorf("unknown setting '%v' in config file", name)
+		}
+		if set[name] {
+			continue
+		}
+		value := fmt.Sprint(content[name])
+		if err := flag.Set(name, value); err != nil {
+			return errors.Wrapf(err, "invalid value '%v' for '%v' in config file", value, name)
+		}
+	}
+	return nil
+}
+
+// Name of the environment variable of a flag, e.g. CANCITIES_DG_CONNS_POOL for dg-conns-pool
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
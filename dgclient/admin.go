@@ -0,0 +1,186 @@
+package dgclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/dgraph-io/dgraph/client"
+	"github.com/AsT4re/cancities/api"
+)
+
+type countRep struct {
+	Root        *struct {
+		Count   int64      `json:"count"`
+	}                      `json:"total"`
+}
+
+// Method for deleting every city. Their history and tombstones are kept, the last version of each
+// city being stored as a past version, so cities are deleted one by one rather than dropping every
+// data. A failed drop can be run again to delete the remaining cities. Returns the cartodb ids of
+// the deleted cities, which on error are the ones dropped before it
+func (dgCl *DGClient) DropAll(ctx context.Context) ([]int64, error) {
+	getAllCityPropsTempl := `{
+    cities(func: has(cartodb_id)) {
+      _uid_
+      name
+      place_key
+      capital
+      population
+      pclass
+      geo
+      cartodb_id
+      created_at
+      updated_at
+      valid_from
+      import_id
+    }
+  }`
+
+	var cities CitiesRep
+	if err := sendRequest(dgCl, &getAllCityPropsTempl, &map[string]string{}, &cities); err != nil {
+		return nil, errors.Wrap(err, "error listing cities to drop")
+	}
+	deletedAt := time.Now().UTC()
+	deleted := make([]int64, 0, len(cities.Root))
+
+	for start := 0; start < len(cities.Root); start += citiesPerMutation {
+		end := start + citiesPerMutation
+		if end > len(cities.Root) {
+			end = len(cities.Root)
+		}
+
+		req := client.Req{}
+		for _, city := range cities.Root[start:end] {
+			mnode := dgCl.dg.NodeUid(city.Uid)
+			if err := req.Delete(mnode.Delete()); err != nil {
+				return deleted, errors.Wrap(err, "error adding city deletion to drop mutation")
+			}
+
+			vnode, err := dgCl.dg.NodeBlank("")
+			if err != nil {
+				return deleted, errors.Wrap(err, "error creating blank node")
+			}
+			edges, err := versionEdges(&vnode, city, deletedAt)
+			if err != nil {
+				return deleted, err
+			}
+
+			tnode, err := dgCl.dg.NodeBlank("")
+			if err != nil {
+				return deleted, errors.Wrap(err, "error creating blank node")
+			}
+			tedges, err := tombstoneEdges(&tnode, city.Cartodb_id, deletedAt)
+			if err != nil {
+				return deleted, err
+			}
+
+			for _, e := range append(edges, tedges...) {
+				if err := req.Set(e); err != nil {
+					return deleted, errors.Wrap(err, "error adding edge to drop mutation")
+				}
+			}
+		}
+
+		if _, err := runWithRetry(dgCl, ctx, &req); err != nil {
+			return deleted, errors.Wrapf(err, "error dropping cities, %v of %v dropped", start, len(cities.Root))
+		}
+		for _, city := range cities.Root[start:end] {
+			deleted = append(deleted, city.Cartodb_id)
+		}
+	}
+
+	return deleted, nil
+}
+
+// Method for counting cities in DB
+func (dgCl *DGClient) CountCities() (int64, error) {
+	countTempl := `{
+    total(func: has(cartodb_id)) {
+      count(_uid_)
+    }
+  }`
+
+	return count(dgCl, countTempl, map[string]string{})
+}
+
+// Number of nodes matched by the total block of a query
+func count(dgCl *DGClient, templ string, reqMap map[string]string) (int64, error) {
+	var rep countRep
+	if err := sendRequest(dgCl, &templ, &reqMap, &rep); err != nil {
+		return 0, err
+	}
+	if rep.Root == nil {
+		return 0, nil
+	}
+	return rep.Root.Count, nil
+}
+
+// Method for getting the schema of every predicate in DB
+func (dgCl *DGClient) GetSchema(ctx context.Context) ([]api.PredicateSchema, error) {
+	req := client.Req{}
+	req.SetQuery(`schema {}`)
+
+	resp, err := dgCl.dg.Run(ctx, &req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error when executing schema request")
+	}
+
+	schema := make([]api.PredicateSchema, len(resp.Schema))
+	for i, s := range resp.Schema {
+		schema[i] = api.PredicateSchema{
+			Predicate: s.Predicate,
+			Type: s.Type,
+			Index: s.Index,
+			Tokenizer: s.Tokenizer,
+		}
+	}
+	return schema, nil
+}
+
+// Method for rebuilding indexes: each indexed predicate is set without index and then
+// with its index again, so that DGraph computes it from scratch, as it keeps indexes whose
+// tokenizers are unchanged. Queries using an index fail while it is rebuilt, and a failed
+// rebuild restores the index. Return rebuilt predicates
+func (dgCl *DGClient) RebuildIndexes(ctx context.Context) ([]string, error) {
+	schema, err := dgCl.GetSchema(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rebuilt []string
+	for _, s := range schema {
+		if !s.Index {
+			continue
+		}
+		indexed := fmt.Sprintf("%s: %s @index(%s) .", s.Predicate, s.Type, strings.Join(s.Tokenizer, ", "))
+
+		dropReq := client.Req{}
+		dropReq.SetSchema(fmt.Sprintf("%s: %s .", s.Predicate, s.Type))
+		if _, err := runWithRetry(dgCl, ctx, &dropReq); err != nil {
+			// The drop may have been applied before failing
+			return rebuilt, restoreIndex(dgCl, indexed, errors.Wrapf(err, "error dropping index of %v", s.Predicate))
+		}
+
+		indexReq := client.Req{}
+		indexReq.SetSchema(indexed)
+		if _, err := runWithRetry(dgCl, ctx, &indexReq); err != nil {
+			return rebuilt, restoreIndex(dgCl, indexed, errors.Wrapf(err, "error building index of %v", s.Predicate))
+		}
+
+		rebuilt = append(rebuilt, s.Predicate)
+	}
+
+	return rebuilt, nil
+}
+
+// Set an index again after a failed rebuild, even when the context of the rebuild is done
+func restoreIndex(dgCl *DGClient, indexed string, cause error) error {
+	req := client.Req{}
+	req.SetSchema(indexed)
+	if _, err := runWithRetry(dgCl, context.Background(), &req); err != nil {
+		return errors.Wrapf(cause, "restoring index failed (%v)", err)
+	}
+	return cause
+}
@@ -57,3 +57,12 @@ func getBoundingBox(lon, lat, dist float64) (float64, float64, float64, float64)
 
 	return min_lat_deg, min_lon_deg, max_lat_deg, max_lon_deg
 }
+
+// Great-circle distance in kilometers between two locations, by the haversine formula
+func Distance(lon1, lat1, lon2, lat2 float64) float64 {
+	dlat := radians(lat2 - lat1)
+	dlon := radians(lon2 - lon1)
+	a := math.Sin(dlat / 2) * math.Sin(dlat / 2) +
+		math.Cos(radians(lat1)) * math.Cos(radians(lat2)) * math.Sin(dlon / 2) * math.Sin(dlon / 2)
+	return 2 * EARTH_RADIUS * math.Asin(math.Min(1, math.Sqrt(a)))
+}
@@ -0,0 +1,199 @@
+package dgclient
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/dgraph-io/dgraph/client"
+)
+
+// City as listed by GetChanges, or tombstone of a deleted city when Tombstone_id is set. Modified_at
+// is set by the server on every change, to the time of the deletion for tombstones
+type CityChange struct {
+	Uid          uint64       `json:"_uid_"`
+	Name         string       `json:"name"`
+	Population   int64        `json:"population"`
+	Cartodb_id   int64        `json:"cartodb_id"`
+	Tombstone_id int64        `json:"tombstone_id"`
+	Geo          []byte       `json:"geo"`
+	Updated_at   time.Time    `json:"updated_at"`
+	Modified_at  time.Time    `json:"modified_at"`
+}
+
+// Id of the changed city, whether deleted or not
+func (c *CityChange) Id() int64 {
+	if c.Tombstone_id != 0 {
+		return c.Tombstone_id
+	}
+	return c.Cartodb_id
+}
+
+func (c *CityChange) Deleted() bool {
+	return c.Tombstone_id != 0
+}
+
+type changesRep struct {
+	Root         []*CityChange `json:"changes"`
+}
+
+// Position in the list of changes ordered by modified_at then id: changes listed are the ones after
+// Time, or at Time with an id greater than Id
+type ChangesCursor struct {
+	Time         time.Time
+	Id           int64
+}
+
+// Cursor of the changes made after a time
+func ChangesSince(since time.Time) ChangesCursor {
+	return ChangesCursor{since, math.MaxInt64}
+}
+
+// Method for getting at most first changes after a cursor, ordered by modified_at then id. More is
+// set when further changes may follow, the page being possibly shorter than first
+func (dgCl *DGClient) GetChanges(after ChangesCursor, first int) (changes []*CityChange, more bool, err error) {
+	// Changes left at the time of the cursor
+	if after.Id != math.MaxInt64 {
+		group, err := changesAt(dgCl, after.Time, after.Id)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(group) >= first {
+			return group[:first], true, nil
+		}
+		changes = group
+	}
+
+	getChangesAfterTempl := `{
+    changes(func: gt(modified_at, $time), orderasc: modified_at, first: $first) {
+      _uid_
+      name
+      geo
+      cartodb_id
+      population
+      tombstone_id
+      updated_at
+      modified_at
+    }
+  }`
+
+	remaining := first - len(changes)
+	reqMap := make(map[string]string)
+	reqMap["$time"] = after.Time.Format(time.RFC3339Nano)
+	reqMap["$first"] = strconv.Itoa(remaining)
+
+	var rep changesRep
+	if err := sendRequest(dgCl, &getChangesAfterTempl, &reqMap, &rep); err != nil {
+		return nil, false, err
+	}
+	sortChanges(rep.Root)
+	if len(rep.Root) < remaining {
+		return append(changes, rep.Root...), false, nil
+	}
+
+	// Changes at the last time may have been cut, so they are left for the next page unless
+	// every change has that time, in which case they are all got and ordered by id
+	last := rep.Root[len(rep.Root) - 1].Modified_at
+	complete := sort.Search(len(rep.Root), func(i int) bool {
+		return !rep.Root[i].Modified_at.Before(last)
+	})
+	if complete > 0 {
+		return append(changes, rep.Root[:complete]...), true, nil
+	}
+
+	group, err := changesAt(dgCl, last, math.MinInt64)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(group) > remaining {
+		group = group[:remaining]
+	}
+	return append(changes, group...), true, nil
+}
+
+// Every change made at a time with an id greater than the given one, ordered by id
+func changesAt(dgCl *DGClient, at time.Time, afterId int64) ([]*CityChange, error) {
+	getChangesAtTempl := `{
+    changes(func: eq(modified_at, $time)) @filter(gt(cartodb_id, $id) OR gt(tombstone_id, $id)) {
+      _uid_
+      name
+      geo
+      cartodb_id
+      population
+      tombstone_id
+      updated_at
+      modified_at
+    }
+  }`
+
+	reqMap := make(map[string]string)
+	reqMap["$time"] = at.Format(time.RFC3339Nano)
+	reqMap["$id"] = strconv.FormatInt(afterId, 10)
+
+	var rep changesRep
+	if err := sendRequest(dgCl, &getChangesAtTempl, &reqMap, &rep); err != nil {
+		return nil, err
+	}
+	sortChanges(rep.Root)
+	return rep.Root, nil
+}
+
+func sortChanges(changes []*CityChange) {
+	sort.SliceStable(changes, func(i, j int) bool {
+		if !changes[i].Modified_at.Equal(changes[j].Modified_at) {
+			return changes[i].Modified_at.Before(changes[j].Modified_at)
+		}
+		return changes[i].Id() < changes[j].Id()
+	})
+}
+
+// Build the edges of the tombstone of a city deleted at the given time
+func tombstoneEdges(mnode *client.Node, id int64, deletedAt time.Time) ([]client.Edge, error) {
+	return nodeEdges(mnode, []predicateValue{
+		{"tombstone_id", id},
+		{"modified_at", deletedAt},
+	})
+}
+
+// Data of migration 6: cities and tombstones stored before are given their updated_at as
+// modification time, changes having been ordered by it until then
+func setModifiedAt(dgCl *DGClient, ctx context.Context) error {
+	getUnmodifiedTempl := `{
+    changes(func: has(updated_at)) @filter(NOT has(modified_at)) {
+      _uid_
+      updated_at
+    }
+  }`
+
+	var rep changesRep
+	if err := sendRequest(dgCl, &getUnmodifiedTempl, &map[string]string{}, &rep); err != nil {
+		return errors.Wrap(err, "error listing cities without modification time")
+	}
+
+	for start := 0; start < len(rep.Root); start += citiesPerMutation {
+		end := start + citiesPerMutation
+		if end > len(rep.Root) {
+			end = len(rep.Root)
+		}
+
+		req := client.Req{}
+		for _, c := range rep.Root[start:end] {
+			mnode := dgCl.dg.NodeUid(c.Uid)
+			e, err := newEdge(&mnode, "modified_at", c.Updated_at)
+			if err != nil {
+				return err
+			}
+			if err := req.Set(e); err != nil {
+				return errors.Wrap(err, "error adding edge to migration mutation")
+			}
+		}
+
+		if _, err := runWithRetry(dgCl, ctx, &req); err != nil {
+			return errors.Wrapf(err, "error setting modification times, %v of %v set", start, len(rep.Root))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package dgclient
+
+import (
+	"context"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/dgraph-io/dgraph/client"
+)
+
+// Version of the whole set of cities, bumped each time cities are modified
+type DatasetVersion struct {
+	Uid         uint64      `json:"_uid_"`
+	Version     int64       `json:"dataset_version"`
+	ModifiedAt  time.Time   `json:"dataset_modified_at"`
+}
+
+type datasetRep struct {
+	Root        *DatasetVersion `json:"dataset"`
+}
+
+// Method for getting the current dataset version, zero value if cities were never modified
+func (dgCl *DGClient) DatasetVersion() (DatasetVersion, error) {
+	getDatasetTempl := `{
+    dataset(func: has(dataset_version)) {
+      _uid_
+      dataset_version
+      dataset_modified_at
+    }
+  }`
+
+	var rep datasetRep
+	if err := sendRequest(dgCl, &getDatasetTempl, &map[string]string{}, &rep); err != nil {
+		return DatasetVersion{}, errors.Wrap(err, "error getting dataset version")
+	}
+	if rep.Root == nil {
+		return DatasetVersion{}, nil
+	}
+	return *rep.Root, nil
+}
+
+// Method for bumping the dataset version after cities have been modified. Callers must
+// serialize modifications, as version is read then written
+func (dgCl *DGClient) BumpDatasetVersion(ctx context.Context) (DatasetVersion, error) {
+	current, err := dgCl.DatasetVersion()
+	if err != nil {
+		return current, err
+	}
+
+	var mnode client.Node
+	if current.Uid != 0 {
+		mnode = dgCl.dg.NodeUid(current.Uid)
+	} else if mnode, err = dgCl.dg.NodeBlank(""); err != nil {
+		return current, errors.Wrap(err, "error creating blank node")
+	}
+
+	next := DatasetVersion{
+		Uid: current.Uid,
+		Version: current.Version + 1,
+		// Truncated as stored by DGraph, so that it can be compared with HTTP dates
+		ModifiedAt: time.Now().UTC().Truncate(time.Second),
+	}
+
+	values := []struct {
+		name  string
+		value interface{}
+	}{
+		{"dataset_version", next.Version},
+		{"dataset_modified_at", next.ModifiedAt},
+	}
+
+	req := client.Req{}
+	for _, v := range values {
+		e, err := newEdge(&mnode, v.name, v.value)
+		if err != nil {
+			return current, err
+		}
+		if err := req.Set(e); err != nil {
+			return current, errors.Wrap(err, "error setting dataset version edge")
+		}
+	}
+
+	if _, err := runWithRetry(dgCl, ctx, &req); err != nil {
+		return current, errors.Wrap(err, "error storing dataset version")
+	}
+
+	return next, nil
+}
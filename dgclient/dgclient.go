@@ -7,12 +7,15 @@ import (
 	"io/ioutil"
 	"os"
 	"bytes"
+	"encoding/binary"
 	"strconv"
   "time"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"github.com/dgraph-io/dgraph/client"
 	"github.com/twpayne/go-geom/encoding/wkb"
 	geom "github.com/twpayne/go-geom"
+	"github.com/AsT4re/cancities/api"
 )
 
 
@@ -22,10 +25,22 @@ import (
  */
 
 type CityProps struct {
+	Uid         uint64       `json:"_uid_"`
 	Name        string       `json:"name"`
+	Place_key   string       `json:"place_key"`
+	Capital     string       `json:"capital"`
 	Population  int64        `json:"population"`
+	Pclass      string       `json:"pclass"`
 	Cartodb_id  int64        `json:"cartodb_id"`
 	Geo         []byte       `json:"geo"`
+	Created_at  time.Time    `json:"created_at"`
+	Updated_at  time.Time    `json:"updated_at"`
+	// Start of the validity of the current version and import which produced it, unknown for
+	// cities stored before history was recorded
+	Valid_from  time.Time    `json:"valid_from"`
+	Import_id   string       `json:"import_id"`
+	// Time of the last change of the city in DB, set by the server unlike updated_at
+	Modified_at time.Time    `json:"modified_at"`
 }
 
 // Reply structure from GetCity request
@@ -40,11 +55,20 @@ type CitiesRep struct {
 
 // Main class for handling dgraph database requests
 type DGClient struct {
-	conns     []*grpc.ClientConn
+	pool      *connPool
 	clientDir string
+	// Client directory is removed on Close unless it holds state to keep, like load checkpoints
+	keepDir   bool
 	dg        *client.Dgraph
 }
 
+// Retry policy for requests failing with a transient gRPC error
+const (
+	MaxRetries = 5
+	retryBackoff = 100 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+)
+
 
 /*
  * DGClient object with constructor and public methods
@@ -52,116 +76,69 @@ type DGClient struct {
 
 // DGClient constructor: initialize grpc connection and dgraph client
 func NewDGClient(host string, nbConns uint) (*DGClient, error) {
-	// Init connection to DGraph
-	dgCl := new(DGClient)
-
-	var err error
-	if dgCl.clientDir, err = ioutil.TempDir("", "client_"); err != nil {
+	clientDir, err := ioutil.TempDir("", "client_")
+	if err != nil {
 		return nil, errors.Wrap(err, "error creating temporary directory")
 	}
+	return newDGClient(host, nbConns, clientDir, false)
+}
 
-	grpcConns := make([]*grpc.ClientConn, nbConns)
-	for i := 0; uint(i) < nbConns; i++ {
-		if conn, err := grpc.Dial(host, grpc.WithInsecure()); err != nil {
-			return nil, errors.Wrap(err, "error dialing grpc connection")
-		} else {
-			grpcConns[i] = conn
-		}
-	}
-
-	dgCl.dg = client.NewDgraphClient(grpcConns, client.DefaultOptions, dgCl.clientDir)
-
-	return dgCl, nil
+// DGClient constructor keeping its client directory, so that checkpoints of a load stored in it
+// survive the program and allow resuming the load
+func NewLoadClient(host string, nbConns uint, stateDir string) (*DGClient, error) {
+	return newDGClient(host, nbConns, stateDir, true)
 }
 
-// Initialize DB with schema
-func (dgCl *DGClient) Init() error {
-	req := client.Req{}
-	req.SetQuery(`
-    mutation {
-      schema {
-        cartodb_id: int @index(int) .
-        geo: geo @index(geo) .
-        name: string .
-        place_key: string .
-        capital: string .
-        population: int .
-        pclass: string .
-        created_at: dateTime .
-        updated_at: dateTime .
-      }
-    }
-`)
+func newDGClient(host string, nbConns uint, clientDir string, keepDir bool) (*DGClient, error) {
+	// Init connection to DGraph
+	dgCl := &DGClient{clientDir: clientDir, keepDir: keepDir}
 
-	if _, err := dgCl.dg.Run(context.Background(), &req); err != nil {
-		return errors.Wrap(err, "error running request for schema")
+	var err error
+	if dgCl.pool, err = newConnPool(host, nbConns); err != nil {
+		dgCl.Close()
+		return nil, err
 	}
 
-	return nil
+	// Batch mutations are retried by dgraph client, but not forever so that BatchFlush can fail
+	opts := client.DefaultOptions
+	opts.MaxRetries = MaxRetries
+	dgCl.dg = client.NewClient(dgCl.pool.clients(), opts, dgCl.clientDir)
+
+	return dgCl, nil
 }
 
 // Close to cleanly exit at the end of the program
 func (dgc *DGClient) Close() {
-	if len(dgc.conns) > 0 {
-		connsLen := len(dgc.conns)
-		for i := 0; i < connsLen; i++ {
-			if err := dgc.conns[i].Close(); err != nil {
-				fmt.Fprintf(os.Stderr, "WARNING: %+v\n", errors.Wrap(err, "closing connection failed:"))
-			}
+	if dgc.dg != nil {
+		if err := dgc.dg.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %+v\n", errors.Wrap(err, "closing dgraph client failed:"))
 		}
 	}
 
-	if dgc.clientDir != "" {
+	if dgc.pool != nil {
+		dgc.pool.Close()
+	}
+
+	if dgc.clientDir != "" && !dgc.keepDir {
 		if err := os.RemoveAll(dgc.clientDir); err != nil {
 			fmt.Fprintf(os.Stderr, "WARNING: %+v\n", errors.Wrap(err, "removing temp dir failed:"))
 		}
 	}
 }
 
-// Method for importing GeoJson
-func (dgCl *DGClient) AddNewNodeToBatch(name, place_key, capital, pclass, geo string,
-       	                                population, cartodb_id int64,
-	                                      created_at, updated_at time.Time) error {
-	mnode, err := dgCl.dg.NodeBlank("")
-	if err != nil {
-		return errors.Wrap(err, "error creating blank node")
-	}
+// Status of the connections to DGraph
+func (dgCl *DGClient) PoolStatus() api.PoolStatus {
+	return dgCl.pool.Status()
+}
 
-	if err = addEdge(dgCl, &mnode, "cartodb_id", cartodb_id); err != nil {
-		return errors.Wrap(err, "error adding edge")
-	}
-	if err = addEdge(dgCl, &mnode, "name", name); err != nil {
-		return errors.Wrap(err, "error adding edge")
-	}
-	if err = addEdge(dgCl, &mnode, "place_key", place_key); err != nil {
-		return errors.Wrap(err, "error adding edge")
-	}
-	if err = addEdge(dgCl, &mnode, "capital", capital); err != nil {
-		return errors.Wrap(err, "error adding edge")
-	}
-	if err = addEdge(dgCl, &mnode, "population", population); err != nil {
-		return errors.Wrap(err, "error adding edge")
+// Wait for every batched mutation to be sent. The batch can not be used anymore after
+func (dgCl *DGClient) BatchFlush() error {
+	if err := dgCl.dg.BatchFlush(); err != nil {
+		return errors.Wrap(err, "error flushing batch mutations")
 	}
-	if err = addEdge(dgCl, &mnode, "pclass", pclass); err != nil {
-		return errors.Wrap(err, "error adding edge")
-	}
-	if err = addEdge(dgCl, &mnode, "created_at", created_at); err != nil {
-		return errors.Wrap(err, "error adding edge")
-	}
-	if err = addEdge(dgCl, &mnode, "updated_at", updated_at); err != nil {
-		return errors.Wrap(err, "error adding edge")
-	}
-	if err = addEdge(dgCl, &mnode, "geo", geo); err != nil {
-		return errors.Wrap(err, "error adding edge")
-	}
-
 	return nil
 }
 
-func (dgCl *DGClient) BatchFlush() {
-	dgCl.dg.BatchFlush()
-}
-
 // Method for getting informations about a specific city given his id
 func (dgCl *DGClient) GetCity(id string) (CityRep, error){
 	getCityTempl := `{
@@ -183,6 +160,25 @@ func (dgCl *DGClient) GetCity(id string) (CityRep, error){
 
 // Method for getting informations about cities within a bounding box given his center coordinates and distance in kilometers
 func (dgCl *DGClient) GetCitiesAround(pos []float64, dist uint64) (CitiesRep, error){
+	getCitiesAroundTempl := `{
+    cities(func: within(geo, $bndBox)) {
+      name
+      geo
+      cartodb_id
+      population
+    }
+  }`
+
+	reqMap := make(map[string]string)
+	reqMap["$bndBox"] = boundingBoxPolygon(pos, dist)
+
+	var cities CitiesRep
+	err := sendRequest(dgCl, &getCitiesAroundTempl, &reqMap, &cities)
+	return cities, err
+}
+
+// Polygon of the bounding box of side dist (in kilometers) around a position, as given to within
+func boundingBoxPolygon(pos []float64, dist uint64) string {
 	minLat, minLong, maxLat, maxLong := getBoundingBox(pos[0], pos[1], float64(dist))
 
 	bndBox := [5][2]float64{
@@ -209,9 +205,43 @@ func (dgCl *DGClient) GetCitiesAround(pos []float64, dist uint64) (CitiesRep, er
 		buffer.WriteString("]")
 	}
 	buffer.WriteString("]]")
+	return buffer.String()
+}
 
-	getCitiesAroundTempl := `{
-    cities(func: within(geo, $bndBox)) {
+
+// Method for getting all the informations about the cities with the given ids, with a single query.
+// Callers bound the number of ids, splitting them when needed
+func (dgCl *DGClient) GetCitiesByIds(ids []int64) (CitiesRep, error) {
+	getCitiesByIdsTempl := `{
+    cities(func: eq(cartodb_id, $ids)) {
+      _uid_
+      name
+      place_key
+      capital
+      population
+      pclass
+      geo
+      cartodb_id
+      created_at
+      updated_at
+      valid_from
+      import_id
+    }
+  }`
+
+	reqMap := make(map[string]string)
+	reqMap["$ids"] = idList(ids)
+
+	var cities CitiesRep
+	err := sendRequest(dgCl, &getCitiesByIdsTempl, &reqMap, &cities)
+	return cities, err
+}
+
+// Method for getting informations about the cities whose name holds every term of the given
+// name, case insensitive, ordered by id
+func (dgCl *DGClient) SearchCitiesByName(name string, first uint64) (CitiesRep, error) {
+	searchCitiesByNameTempl := `{
+    cities(func: allofterms(name, $name), orderasc: cartodb_id, first: $first) {
       name
       geo
       cartodb_id
@@ -220,13 +250,57 @@ func (dgCl *DGClient) GetCitiesAround(pos []float64, dist uint64) (CitiesRep, er
   }`
 
 	reqMap := make(map[string]string)
-	reqMap["$bndBox"] = buffer.String()
+	reqMap["$name"] = name
+	reqMap["$first"] = strconv.FormatUint(first, 10)
 
 	var cities CitiesRep
-	err := sendRequest(dgCl, &getCitiesAroundTempl, &reqMap, &cities)
+	err := sendRequest(dgCl, &searchCitiesByNameTempl, &reqMap, &cities)
 	return cities, err
 }
 
+// Method for getting informations about every city, ordered by id
+func (dgCl *DGClient) GetAllCities() (CitiesRep, error) {
+	getAllCitiesTempl := `{
+    cities(func: has(cartodb_id), orderasc: cartodb_id) {
+      name
+      geo
+      cartodb_id
+      population
+    }
+  }`
+
+	var cities CitiesRep
+	if err := sendRequest(dgCl, &getAllCitiesTempl, &map[string]string{}, &cities); err != nil {
+		return cities, err
+	}
+
+	return cities, nil
+}
+
+// Method for getting at most first cities ordered by id, after the offset first ones, along with
+// the number of cities
+func (dgCl *DGClient) GetCitiesPage(first, offset uint64) (CitiesRep, int64, error) {
+	getCitiesPageTempl := `{
+    cities(func: has(cartodb_id), orderasc: cartodb_id, first: $first, offset: $offset) {
+      name
+      geo
+      cartodb_id
+      population
+    }
+  }`
+
+	reqMap := make(map[string]string)
+	reqMap["$first"] = strconv.FormatUint(first, 10)
+	reqMap["$offset"] = strconv.FormatUint(offset, 10)
+
+	var cities CitiesRep
+	if err := sendRequest(dgCl, &getCitiesPageTempl, &reqMap, &cities); err != nil {
+		return cities, 0, err
+	}
+
+	total, err := dgCl.CountCities()
+	return cities, total, err
+}
 
 
 /*
@@ -243,12 +317,41 @@ func DecodeGeoDatas(geo []byte) (geom.T, error) {
 }
 
 
+// Helper for encoding coordinates of a point in binary format
+func EncodePoint(coords []float64) ([]byte, error) {
+	p, err := geom.NewPoint(geom.XY).SetCoords(coords)
+	if err != nil {
+		return nil, errors.Wrap(err, "error setting point coordinates")
+	}
+
+	geo, err := wkb.Marshal(p, binary.LittleEndian)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshalling for encode geo datas")
+	}
+	return geo, nil
+}
+
+
 
 /*
  *  Private functions
  */
 
-func addEdge(dgCl *DGClient, mnode *client.Node, name string, value interface{}) error {
+// List of ids as given to eq, e.g. [1, 2, 3]
+func idList(ids []int64) string {
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for i, id := range ids {
+		if i != 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(strconv.FormatInt(id, 10))
+	}
+	buffer.WriteString("]")
+	return buffer.String()
+}
+
+func newEdge(mnode *client.Node, name string, value interface{}) (client.Edge, error) {
 	e := mnode.Edge(name)
 	var err error
 	switch v := value.(type) {
@@ -264,19 +367,47 @@ func addEdge(dgCl *DGClient, mnode *client.Node, name string, value interface{})
 		err = e.SetValueDatetime(v)
 	case float64:
 		err = e.SetValueFloat(v)
+	case geom.T:
+		err = e.SetValueGeoGeometry(v)
 	default:
-		return errors.New("Type for value not handled yet")
+		return e, errors.New("Type for value not handled yet")
 	}
 
 	if err != nil {
-		return errors.Wrapf(err, "error while setting value for %v edge with value %v", name, value)
+		return e, errors.Wrapf(err, "error while setting value for %v edge with value %v", name, value)
 	}
 
-	if err = dgCl.dg.BatchSet(e); err != nil {
-		return errors.Wrapf(err, "error when setting batch for %v edge with value %v", name, value)
+	return e, nil
+}
+
+// Run a request, retrying with exponential backoff while it fails with a transient error.
+// Return the number of retries done
+func runWithRetry(dgCl *DGClient, ctx context.Context, req *client.Req) (int, error) {
+	backoff := retryBackoff
+	for retries := 0; ; retries++ {
+		_, err := dgCl.dg.Run(ctx, req)
+		if err == nil || !isTransient(err) || retries >= MaxRetries || ctx.Err() != nil {
+			return retries, err
+		}
+
+		fmt.Fprintf(os.Stderr, "WARNING: retrying request in %v: %v\n", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return retries, err
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
 	}
+}
 
-	return nil
+func isTransient(err error) bool {
+	switch grpc.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded:
+		return true
+	}
+	return false
 }
 
 func sendRequest(dgCl *DGClient, reqStr *string, reqMap *map[string]string, rep interface{}) error {
@@ -0,0 +1,320 @@
+package dgclient
+
+import (
+	"sort"
+	"strconv"
+	"time"
+	"github.com/dgraph-io/dgraph/client"
+)
+
+// Past version of a city, valid from Valid_from (unknown for the version stored before history was
+// recorded) until Valid_to. Versions hold the predicates of cities, except the ones searched by
+// city queries which are prefixed with version_, so that versions are not found by them
+type CityVersion struct {
+	Uid         uint64       `json:"_uid_"`
+	Version_of  int64        `json:"version_of"`
+	Name        string       `json:"version_name"`
+	Place_key   string       `json:"place_key"`
+	Capital     string       `json:"capital"`
+	Population  int64        `json:"population"`
+	Pclass      string       `json:"pclass"`
+	Geo         []byte       `json:"version_geo"`
+	Created_at  time.Time    `json:"created_at"`
+	Updated_at  time.Time    `json:"version_updated_at"`
+	Valid_from  time.Time    `json:"valid_from"`
+	Valid_to    time.Time    `json:"valid_to"`
+	Import_id   string       `json:"import_id"`
+}
+
+// City as it was during the validity of the version
+func (v *CityVersion) City() *CityProps {
+	return &CityProps{
+		Name: v.Name,
+		Place_key: v.Place_key,
+		Capital: v.Capital,
+		Population: v.Population,
+		Pclass: v.Pclass,
+		Cartodb_id: v.Version_of,
+		Geo: v.Geo,
+		Created_at: v.Created_at,
+		Updated_at: v.Updated_at,
+		Valid_from: v.Valid_from,
+		Import_id: v.Import_id,
+	}
+}
+
+type versionsRep struct {
+	Root        []*CityVersion `json:"versions"`
+}
+
+// Filters of the cities and versions valid at the time $at
+const (
+	cityValidAt = `le(valid_from, $at) OR NOT has(valid_from)`
+	versionValidAt = `(le(valid_from, $at) OR NOT has(valid_from)) AND gt(valid_to, $at)`
+)
+
+// Method for getting the current version of a city and its past versions, ordered by validity
+func (dgCl *DGClient) GetCityHistory(id int64) (*CityProps, []*CityVersion, error) {
+	getHistoryTempl := `{
+    versions(func: eq(version_of, $id)) {
+      version_of
+      version_name
+      place_key
+      capital
+      population
+      pclass
+      version_geo
+      created_at
+      version_updated_at
+      valid_from
+      valid_to
+      import_id
+    }
+  }`
+
+	reqMap := make(map[string]string)
+	reqMap["$id"] = strconv.FormatInt(id, 10)
+
+	var versions versionsRep
+	if err := sendRequest(dgCl, &getHistoryTempl, &reqMap, &versions); err != nil {
+		return nil, nil, err
+	}
+	sort.SliceStable(versions.Root, func(i, j int) bool {
+		return versions.Root[i].Valid_to.Before(versions.Root[j].Valid_to)
+	})
+
+	cities, err := dgCl.GetCitiesByIds([]int64{id})
+	if err != nil {
+		return nil, nil, err
+	}
+	var current *CityProps
+	if len(cities.Root) > 0 {
+		current = cities.Root[0]
+	}
+	return current, versions.Root, nil
+}
+
+// Method for getting informations about a specific city as it was at a given time
+func (dgCl *DGClient) GetCityAt(id string, at time.Time) (CityRep, error) {
+	getCityAtTempl := `{
+    city(func: eq(cartodb_id, $id)) @filter(` + cityValidAt + `) {
+      name
+      geo
+      cartodb_id
+      population
+    }
+  }`
+	getVersionAtTempl := `{
+    versions(func: eq(version_of, $id)) @filter(` + versionValidAt + `) {
+      version_name
+      version_geo
+      version_of
+      population
+    }
+  }`
+
+	reqMap := make(map[string]string)
+	reqMap["$id"] = id
+	reqMap["$at"] = at.Format(time.RFC3339Nano)
+
+	var city CityRep
+	if err := sendRequest(dgCl, &getCityAtTempl, &reqMap, &city); err != nil || city.Root != nil {
+		return city, err
+	}
+
+	var versions versionsRep
+	if err := sendRequest(dgCl, &getVersionAtTempl, &reqMap, &versions); err != nil {
+		return city, err
+	}
+	if len(versions.Root) > 0 {
+		city.Root = versions.Root[0].City()
+	}
+	return city, nil
+}
+
+// Method for getting informations about the cities within a bounding box as they were at a given time
+func (dgCl *DGClient) GetCitiesAroundAt(pos []float64, dist uint64, at time.Time) (CitiesRep, error) {
+	getCitiesAroundAtTempl := `{
+    cities(func: within(geo, $bndBox)) @filter(` + cityValidAt + `) {
+      name
+      geo
+      cartodb_id
+      population
+    }
+  }`
+	getVersionsAroundAtTempl := `{
+    versions(func: within(version_geo, $bndBox)) @filter(` + versionValidAt + `) {
+      version_name
+      version_geo
+      version_of
+      population
+    }
+  }`
+
+	reqMap := make(map[string]string)
+	reqMap["$bndBox"] = boundingBoxPolygon(pos, dist)
+	reqMap["$at"] = at.Format(time.RFC3339Nano)
+	return citiesAt(dgCl, getCitiesAroundAtTempl, getVersionsAroundAtTempl, reqMap)
+}
+
+// Method for getting informations about the cities with the given ids as they were at a given time
+func (dgCl *DGClient) GetCitiesByIdsAt(ids []int64, at time.Time) (CitiesRep, error) {
+	getCitiesByIdsAtTempl := `{
+    cities(func: eq(cartodb_id, $ids)) @filter(` + cityValidAt + `) {
+      name
+      geo
+      cartodb_id
+      population
+    }
+  }`
+	getVersionsByIdsAtTempl := `{
+    versions(func: eq(version_of, $ids)) @filter(` + versionValidAt + `) {
+      version_name
+      version_geo
+      version_of
+      population
+    }
+  }`
+
+	reqMap := make(map[string]string)
+	reqMap["$ids"] = idList(ids)
+	reqMap["$at"] = at.Format(time.RFC3339Nano)
+	return citiesAt(dgCl, getCitiesByIdsAtTempl, getVersionsByIdsAtTempl, reqMap)
+}
+
+// Method for getting informations about every city as it was at a given time, ordered by id
+func (dgCl *DGClient) GetAllCitiesAt(at time.Time) (CitiesRep, error) {
+	getAllCitiesAtTempl := `{
+    cities(func: has(cartodb_id)) @filter(` + cityValidAt + `) {
+      name
+      geo
+      cartodb_id
+      population
+    }
+  }`
+	getAllVersionsAtTempl := `{
+    versions(func: has(version_of)) @filter(` + versionValidAt + `) {
+      version_name
+      version_geo
+      version_of
+      population
+    }
+  }`
+
+	reqMap := make(map[string]string)
+	reqMap["$at"] = at.Format(time.RFC3339Nano)
+	cities, err := citiesAt(dgCl, getAllCitiesAtTempl, getAllVersionsAtTempl, reqMap)
+	if err != nil {
+		return cities, err
+	}
+
+	sort.Slice(cities.Root, func(i, j int) bool {
+		return cities.Root[i].Cartodb_id < cities.Root[j].Cartodb_id
+	})
+	return cities, nil
+}
+
+// Method for getting a page of the cities as they were at a given time, ordered by id, along with
+// the number of cities then. Current cities and past versions are each got up to the end of the
+// page, as a city has a single version valid at a time
+func (dgCl *DGClient) GetCitiesPageAt(first, offset uint64, at time.Time) (CitiesRep, int64, error) {
+	getCitiesPageAtTempl := `{
+    cities(func: has(cartodb_id), orderasc: cartodb_id, first: $first) @filter(` + cityValidAt + `) {
+      name
+      geo
+      cartodb_id
+      population
+    }
+  }`
+	getVersionsPageAtTempl := `{
+    versions(func: has(version_of), orderasc: version_of, first: $first) @filter(` + versionValidAt + `) {
+      version_name
+      version_geo
+      version_of
+      population
+    }
+  }`
+	countCitiesAtTempl := `{
+    total(func: has(cartodb_id)) @filter(` + cityValidAt + `) {
+      count(_uid_)
+    }
+  }`
+	countVersionsAtTempl := `{
+    total(func: has(version_of)) @filter(` + versionValidAt + `) {
+      count(_uid_)
+    }
+  }`
+
+	reqMap := make(map[string]string)
+	reqMap["$first"] = strconv.FormatUint(offset + first, 10)
+	reqMap["$at"] = at.Format(time.RFC3339Nano)
+	cities, err := citiesAt(dgCl, getCitiesPageAtTempl, getVersionsPageAtTempl, reqMap)
+	if err != nil {
+		return cities, 0, err
+	}
+
+	sort.Slice(cities.Root, func(i, j int) bool {
+		return cities.Root[i].Cartodb_id < cities.Root[j].Cartodb_id
+	})
+	if offset > uint64(len(cities.Root)) {
+		offset = uint64(len(cities.Root))
+	}
+	cities.Root = cities.Root[offset:]
+	if first < uint64(len(cities.Root)) {
+		cities.Root = cities.Root[:first]
+	}
+
+	var total int64
+	for _, templ := range []string{countCitiesAtTempl, countVersionsAtTempl} {
+		n, err := count(dgCl, templ, reqMap)
+		if err != nil {
+			return cities, 0, err
+		}
+		total += n
+	}
+	return cities, total, nil
+}
+
+// Cities valid at a time, current ones and past versions being got by separate queries
+func citiesAt(dgCl *DGClient, citiesTempl, versionsTempl string, reqMap map[string]string) (CitiesRep, error) {
+	var cities CitiesRep
+	if err := sendRequest(dgCl, &citiesTempl, &reqMap, &cities); err != nil {
+		return cities, err
+	}
+
+	var versions versionsRep
+	if err := sendRequest(dgCl, &versionsTempl, &reqMap, &versions); err != nil {
+		return cities, err
+	}
+	for _, v := range versions.Root {
+		cities.Root = append(cities.Root, v.City())
+	}
+	return cities, nil
+}
+
+// Build every edge of a past version of a city, valid until validTo
+func versionEdges(mnode *client.Node, city *CityProps, validTo time.Time) ([]client.Edge, error) {
+	geo, err := DecodeGeoDatas(city.Geo)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []predicateValue{
+		{"version_of", city.Cartodb_id},
+		{"version_name", city.Name},
+		{"place_key", city.Place_key},
+		{"capital", city.Capital},
+		{"population", city.Population},
+		{"pclass", city.Pclass},
+		{"created_at", city.Created_at},
+		{"version_updated_at", city.Updated_at},
+		{"version_geo", geo},
+		{"valid_to", validTo},
+	}
+	if !city.Valid_from.IsZero() {
+		values = append(values, predicateValue{"valid_from", city.Valid_from},
+		                        predicateValue{"import_id", city.Import_id})
+	}
+
+	return nodeEdges(mnode, values)
+}
@@ -0,0 +1,251 @@
+package dgclient
+
+import (
+	"context"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/dgraph-io/dgraph/client"
+)
+
+// Import status
+const (
+	ImportPending = "pending"
+	ImportAborted = "aborted"
+	ImportCommitted = "committed"
+	ImportRolledBack = "rolled_back"
+	ImportRollbackFailed = "rollback_failed"
+)
+
+// Number of cities sent in the same mutation request when committing an import
+const citiesPerMutation = 100
+
+// Counters about the mutation requests sent by an import
+type ImportStats struct {
+	Mutations int
+	Sent      int
+	Retries   int
+	Failed    int
+}
+
+// Gather the mutations of a whole import. Nothing is sent to DGraph before Commit,
+// and if one of the mutations fails the ones already applied are reverted
+type Import struct {
+	dgCl      *DGClient
+	// Id and time given to the versions of cities produced by the import
+	id        string
+	at        time.Time
+	cities    [][]client.Edge
+	created   []client.Node
+	previous  []*CityProps
+	status    string
+	stats     ImportStats
+}
+
+// Import constructor, cities added being valid from the given time
+func (dgCl *DGClient) NewImport(id string, at time.Time) *Import {
+	return &Import{
+		dgCl: dgCl,
+		id: id,
+		at: at,
+		status: ImportPending,
+	}
+}
+
+// Add a city to the import. If previous is not nil the city replaces it and previous is kept
+// as a past version, else a new node is created
+func (imp *Import) AddCity(city *CityProps, previous *CityProps) error {
+	city.Valid_from = imp.at
+	city.Import_id = imp.id
+	city.Modified_at = imp.at
+
+	var mnode client.Node
+	if previous != nil {
+		mnode = imp.dgCl.dg.NodeUid(previous.Uid)
+	} else {
+		var err error
+		if mnode, err = imp.dgCl.dg.NodeBlank(""); err != nil {
+			return errors.Wrap(err, "error creating blank node")
+		}
+	}
+
+	edges, err := cityEdges(&mnode, city)
+	if err != nil {
+		return err
+	}
+
+	if previous != nil {
+		vnode, err := imp.dgCl.dg.NodeBlank("")
+		if err != nil {
+			return errors.Wrap(err, "error creating blank node")
+		}
+		vedges, err := versionEdges(&vnode, previous, imp.at)
+		if err != nil {
+			return err
+		}
+		edges = append(edges, vedges...)
+		imp.created = append(imp.created, vnode)
+	}
+
+	imp.cities = append(imp.cities, edges)
+	if previous != nil {
+		imp.previous = append(imp.previous, previous)
+	} else {
+		imp.created = append(imp.created, mnode)
+	}
+
+	return nil
+}
+
+// Send every mutation of the import. On failure the import is rolled back and the error returned
+func (imp *Import) Commit(ctx context.Context) error {
+	if imp.status != ImportPending {
+		return errors.Errorf("import already %v", imp.status)
+	}
+
+	imp.stats.Mutations = (len(imp.cities) + citiesPerMutation - 1) / citiesPerMutation
+	for start := 0; start < len(imp.cities); start += citiesPerMutation {
+		end := start + citiesPerMutation
+		if end > len(imp.cities) {
+			end = len(imp.cities)
+		}
+
+		req := client.Req{}
+		for _, edges := range imp.cities[start:end] {
+			for _, e := range edges {
+				if err := req.Set(e); err != nil {
+					return imp.rollback(errors.Wrap(err, "error adding edge to import mutation"))
+				}
+			}
+		}
+
+		retries, err := runWithRetry(imp.dgCl, ctx, &req)
+		imp.stats.Sent++
+		imp.stats.Retries += retries
+		if err != nil {
+			imp.stats.Failed++
+			return imp.rollback(errors.Wrapf(err, "error running import mutation after %v retries", retries))
+		}
+	}
+
+	imp.status = ImportCommitted
+	return nil
+}
+
+// Give up a pending import, nothing has been sent to DGraph yet
+func (imp *Import) Abort() {
+	if imp.status == ImportPending {
+		imp.status = ImportAborted
+	}
+}
+
+func (imp *Import) Id() string {
+	return imp.id
+}
+
+func (imp *Import) Status() string {
+	return imp.status
+}
+
+func (imp *Import) Stats() ImportStats {
+	return imp.stats
+}
+
+// Delete created cities and versions and restore updated cities. Mutations of the failed request
+// may have been partially applied, so every city of the import is reverted. Restored cities are
+// modified again, for changes already listed to be reverted as well
+func (imp *Import) rollback(cause error) error {
+	restoredAt := time.Now().UTC()
+	req := client.Req{}
+	for i := range imp.created {
+		if err := req.Delete(imp.created[i].Delete()); err != nil {
+			imp.status = ImportRollbackFailed
+			return errors.Wrapf(cause, "rollback failed (%v)", err)
+		}
+	}
+
+	for _, previous := range imp.previous {
+		city := *previous
+		city.Modified_at = restoredAt
+		mnode := imp.dgCl.dg.NodeUid(city.Uid)
+		edges, err := cityEdges(&mnode, &city)
+		if err != nil {
+			imp.status = ImportRollbackFailed
+			return errors.Wrapf(cause, "rollback failed (%v)", err)
+		}
+		for _, e := range edges {
+			if err := req.Set(e); err != nil {
+				imp.status = ImportRollbackFailed
+				return errors.Wrapf(cause, "rollback failed (%v)", err)
+			}
+		}
+
+		// Cities stored before history was recorded have no validity to restore
+		if city.Valid_from.IsZero() {
+			for _, pred := range []string{"valid_from", "import_id"} {
+				e := mnode.Edge(pred)
+				err := e.Delete()
+				if err == nil {
+					err = req.Delete(e)
+				}
+				if err != nil {
+					imp.status = ImportRollbackFailed
+					return errors.Wrapf(cause, "rollback failed (%v)", err)
+				}
+			}
+		}
+	}
+
+	if req.Size() > 0 {
+		if _, err := runWithRetry(imp.dgCl, context.Background(), &req); err != nil {
+			imp.status = ImportRollbackFailed
+			return errors.Wrapf(cause, "rollback failed (%v)", err)
+		}
+	}
+
+	imp.status = ImportRolledBack
+	return cause
+}
+
+// Build every edge holding the properties of a city
+func cityEdges(mnode *client.Node, city *CityProps) ([]client.Edge, error) {
+	geo, err := DecodeGeoDatas(city.Geo)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []predicateValue{
+		{"cartodb_id", city.Cartodb_id},
+		{"name", city.Name},
+		{"place_key", city.Place_key},
+		{"capital", city.Capital},
+		{"population", city.Population},
+		{"pclass", city.Pclass},
+		{"created_at", city.Created_at},
+		{"updated_at", city.Updated_at},
+		{"modified_at", city.Modified_at},
+		{"geo", geo},
+	}
+	if !city.Valid_from.IsZero() {
+		values = append(values, predicateValue{"valid_from", city.Valid_from},
+		                        predicateValue{"import_id", city.Import_id})
+	}
+
+	return nodeEdges(mnode, values)
+}
+
+type predicateValue struct {
+	name  string
+	value interface{}
+}
+
+func nodeEdges(mnode *client.Node, values []predicateValue) ([]client.Edge, error) {
+	edges := make([]client.Edge, len(values))
+	for i, v := range values {
+		var err error
+		if edges[i], err = newEdge(mnode, v.name, v.value); err != nil {
+			return nil, errors.Wrap(err, "error adding edge")
+		}
+	}
+
+	return edges, nil
+}
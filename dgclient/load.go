@@ -0,0 +1,114 @@
+package dgclient
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/dgraph-io/dgraph/client"
+)
+
+// Load of cities read from local files, sent through batch mutations of the dgraph client.
+// The last committed line of each file is checkpointed in the client directory, so that an
+// interrupted load can be resumed from it
+type Loader struct {
+	dgCl      *DGClient
+	// Checkpoints are keyed by absolute path of files
+	paths     map[string]string
+	// Id and time given to the versions of cities produced by the load, the id being kept when
+	// the load is resumed
+	id        string
+	at        time.Time
+}
+
+// Loader constructor, every file of the load must be given at once
+func (dgCl *DGClient) NewLoader(files []string, id string, at time.Time) (*Loader, error) {
+	l := &Loader{dgCl: dgCl, paths: make(map[string]string), id: id, at: at}
+	abs := make([]string, len(files))
+	for i, file := range files {
+		var err error
+		if abs[i], err = filepath.Abs(file); err != nil {
+			return nil, errors.Wrapf(err, "error getting absolute path of %v", file)
+		}
+		l.paths[file] = abs[i]
+	}
+
+	if err := dgCl.dg.NewSyncMarks(abs); err != nil {
+		return nil, errors.Wrap(err, "error creating checkpoints of files")
+	}
+	return l, nil
+}
+
+// Last line of a file committed by a previous load, 0 if none. Lines are numbered from 1
+func (l *Loader) Checkpoint(file string) (uint64, error) {
+	line, err := l.dgCl.dg.Checkpoint(l.paths[file])
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading checkpoint of %v", file)
+	}
+	return line, nil
+}
+
+// Queue the cities read from a file up to the given line. Existing cities are replaced and kept as
+// past versions, unless they were stored by this load before being resumed. New ones get a node
+// named after their id so that lines sent again on resume do not duplicate them
+func (l *Loader) AddCities(file string, line uint64, cities []*CityProps) error {
+	ids := make([]int64, len(cities))
+	for i, city := range cities {
+		ids[i] = city.Cartodb_id
+	}
+	found, err := l.dgCl.GetCitiesByIds(ids)
+	if err != nil {
+		return err
+	}
+	existing := make(map[int64]*CityProps)
+	for _, city := range found.Root {
+		existing[city.Cartodb_id] = city
+	}
+
+	req := client.Req{}
+	for _, city := range cities {
+		city.Valid_from = l.at
+		city.Import_id = l.id
+		city.Modified_at = l.at
+
+		var mnode client.Node
+		previous, ok := existing[city.Cartodb_id]
+		if ok {
+			mnode = l.dgCl.dg.NodeUid(previous.Uid)
+		} else if mnode, err = l.dgCl.dg.NodeBlank(fmt.Sprintf("city-%d", city.Cartodb_id)); err != nil {
+			return errors.Wrap(err, "error creating blank node")
+		}
+
+		edges, err := cityEdges(&mnode, city)
+		if err != nil {
+			return err
+		}
+		if ok && previous.Import_id != l.id {
+			vnode, err := l.dgCl.dg.NodeBlank("")
+			if err != nil {
+				return errors.Wrap(err, "error creating blank node")
+			}
+			vedges, err := versionEdges(&vnode, previous, l.at)
+			if err != nil {
+				return err
+			}
+			edges = append(edges, vedges...)
+		}
+		for _, e := range edges {
+			if err := req.Set(e); err != nil {
+				return errors.Wrap(err, "error adding edge to load mutation")
+			}
+		}
+	}
+
+	if err := l.dgCl.dg.BatchSetWithMark(&req, l.paths[file], line); err != nil {
+		return errors.Wrapf(err, "error queuing mutation of %v up to line %v", file, line)
+	}
+	return nil
+}
+
+// Wait for every queued mutation to be sent and write the final checkpoints. The loader and
+// batch mutations of its client can not be used anymore after
+func (l *Loader) Flush() error {
+	return l.dgCl.BatchFlush()
+}
@@ -0,0 +1,186 @@
+package dgclient
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/dgraph-io/dgraph/client"
+)
+
+// Versioned change of the DGraph schema, with data to update once it is applied. Data updates must
+// be able to run again, when a failed migration is resumed
+type Migration struct {
+	Version     uint64
+	Description string
+	Schema      string
+	Data        func(dgCl *DGClient, ctx context.Context) error
+}
+
+// Migrations ordered by version. New ones must be appended with the next version,
+// already released ones must never be modified
+var migrations = []Migration{
+	{
+		1,
+		"Initial schema",
+		`
+        schema_version: int .
+        cartodb_id: int @index(int) .
+        geo: geo @index(geo) .
+        name: string .
+        place_key: string .
+        capital: string .
+        population: int .
+        pclass: string .
+        created_at: dateTime .
+        updated_at: dateTime .
+`,
+		nil,
+	},
+	{
+		2,
+		"Dataset version",
+		`
+        dataset_version: int .
+        dataset_modified_at: dateTime .
+`,
+		nil,
+	},
+	{
+		3,
+		"Name search index",
+		`
+        name: string @index(term) .
+`,
+		nil,
+	},
+	{
+		4,
+		"Incremental sync",
+		`
+        updated_at: dateTime @index(hour) .
+        tombstone_id: int @index(int) .
+`,
+		nil,
+	},
+	{
+		5,
+		"City history",
+		`
+        valid_from: dateTime @index(hour) .
+        valid_to: dateTime @index(hour) .
+        import_id: string .
+        version_of: int @index(int) .
+        version_name: string .
+        version_geo: geo @index(geo) .
+        version_updated_at: dateTime .
+`,
+		nil,
+	},
+	{
+		6,
+		"Modification time",
+		`
+        modified_at: dateTime @index(hour) .
+`,
+		setModifiedAt,
+	},
+}
+
+// Schema version expected by this binary
+var SchemaVersion = migrations[len(migrations) - 1].Version
+
+type versionNode struct {
+	Uid         uint64       `json:"_uid_"`
+	Version     uint64       `json:"schema_version"`
+}
+
+type versionRep struct {
+	Root        *versionNode `json:"version"`
+}
+
+// Method for getting the version of the schema applied in DB, 0 if none
+func (dgCl *DGClient) AppliedSchemaVersion() (uint64, error) {
+	node, err := getVersionNode(dgCl)
+	if err != nil || node == nil {
+		return 0, err
+	}
+	return node.Version, nil
+}
+
+// Method for getting the migrations not applied in DB yet
+func (dgCl *DGClient) PendingMigrations() ([]Migration, error) {
+	version, err := dgCl.AppliedSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	return pendingMigrations(version), nil
+}
+
+// Method for applying every pending migration in order. The version stored in DB is updated
+// after each migration so that a failure can be resumed later. Return the applied migrations
+func (dgCl *DGClient) MigrateUp(ctx context.Context) ([]Migration, error) {
+	node, err := getVersionNode(dgCl)
+	if err != nil {
+		return nil, err
+	}
+
+	var mnode client.Node
+	var version uint64
+	if node != nil {
+		mnode = dgCl.dg.NodeUid(node.Uid)
+		version = node.Version
+	} else if mnode, err = dgCl.dg.NodeBlank(""); err != nil {
+		return nil, errors.Wrap(err, "error creating blank node")
+	}
+
+	pending := pendingMigrations(version)
+	for i, m := range pending {
+		schemaReq := client.Req{}
+		schemaReq.SetSchema(m.Schema)
+		if _, err := runWithRetry(dgCl, ctx, &schemaReq); err != nil {
+			return pending[:i], errors.Wrapf(err, "error applying schema of migration %v", m.Version)
+		}
+		if m.Data != nil {
+			if err := m.Data(dgCl, ctx); err != nil {
+				return pending[:i], errors.Wrapf(err, "error updating data of migration %v", m.Version)
+			}
+		}
+
+		e, err := newEdge(&mnode, "schema_version", int64(m.Version))
+		if err != nil {
+			return pending[:i], err
+		}
+		versionReq := client.Req{}
+		if err := versionReq.Set(e); err != nil {
+			return pending[:i], errors.Wrap(err, "error setting schema version edge")
+		}
+		if _, err := runWithRetry(dgCl, ctx, &versionReq); err != nil {
+			return pending[:i], errors.Wrapf(err, "error storing schema version %v", m.Version)
+		}
+	}
+
+	return pending, nil
+}
+
+func pendingMigrations(version uint64) []Migration {
+	for i, m := range migrations {
+		if m.Version > version {
+			return migrations[i:]
+		}
+	}
+	return nil
+}
+
+func getVersionNode(dgCl *DGClient) (*versionNode, error) {
+	getVersionTempl := `{
+    version(func: has(schema_version)) {
+      _uid_
+      schema_version
+    }
+  }`
+
+	var rep versionRep
+	if err := sendRequest(dgCl, &getVersionTempl, &map[string]string{}, &rep); err != nil {
+		return nil, errors.Wrap(err, "error getting schema version")
+	}
+	return rep.Root, nil
+}
@@ -0,0 +1,185 @@
+package dgclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"github.com/dgraph-io/dgraph/protos"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Health checks of the pool connections
+const (
+	healthCheckInterval = 10 * time.Second
+	healthCheckTimeout = 2 * time.Second
+)
+
+// Pool of grpc connections to DGraph. Each connection is periodically health checked, and
+// requests of a connection failing its check are sent by the next healthy one until it recovers.
+// Grpc reconnects them on its own, for instance after a restart of DGraph
+type connPool struct {
+	host   string
+	conns  []*poolConn
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Connection of the pool, usable as a DGraph client even while unhealthy
+type poolConn struct {
+	sync.RWMutex
+	pool      *connPool
+	index     int
+	conn      *grpc.ClientConn
+	dc        protos.DgraphClient
+	status    api.ConnStatus
+}
+
+// Dial every connection of the pool. Connections already opened are closed on failure
+func newConnPool(host string, size uint) (*connPool, error) {
+	if size == 0 {
+		return nil, errors.New("pool of connections needs at least one connection")
+	}
+
+	p := &connPool{
+		host: host,
+		conns: make([]*poolConn, 0, size),
+		stop: make(chan struct{}),
+	}
+
+	for i := 0; uint(i) < size; i++ {
+		conn, err := grpc.Dial(host, grpc.WithInsecure())
+		if err != nil {
+			p.closeConns()
+			return nil, errors.Wrap(err, "error dialing grpc connection")
+		}
+		p.conns = append(p.conns, &poolConn{
+			pool: p,
+			index: i,
+			conn: conn,
+			dc: protos.NewDgraphClient(conn),
+			status: api.ConnStatus{Healthy: true},
+		})
+	}
+
+	p.wg.Add(1)
+	go p.watch()
+
+	return p, nil
+}
+
+func (p *connPool) clients() []protos.DgraphClient {
+	clients := make([]protos.DgraphClient, len(p.conns))
+	for i, pc := range p.conns {
+		clients[i] = pc
+	}
+	return clients
+}
+
+// Stop health checks and close every connection
+func (p *connPool) Close() {
+	close(p.stop)
+	p.wg.Wait()
+	p.closeConns()
+}
+
+func (p *connPool) Status() api.PoolStatus {
+	status := api.PoolStatus{
+		Host: p.host,
+		Size: len(p.conns),
+		Conns: make([]api.ConnStatus, len(p.conns)),
+	}
+
+	for i, pc := range p.conns {
+		pc.RLock()
+		status.Conns[i] = pc.status
+		status.Conns[i].State = pc.conn.GetState().String()
+		pc.RUnlock()
+		if status.Conns[i].Healthy {
+			status.Healthy++
+		}
+	}
+
+	return status
+}
+
+func (p *connPool) closeConns() {
+	for _, pc := range p.conns {
+		if err := pc.conn.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %+v\n", errors.Wrap(err, "closing connection failed:"))
+		}
+	}
+}
+
+func (p *connPool) watch() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, pc := range p.conns {
+			p.check(pc)
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check health of a connection. Unhealthy ones are left open, not to cancel their requests
+func (p *connPool) check(pc *poolConn) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	_, err := pc.dc.CheckVersion(ctx, &protos.Check{})
+	cancel()
+
+	pc.Lock()
+	defer pc.Unlock()
+	pc.status.LastCheck = time.Now()
+	if err == nil {
+		pc.status.Healthy = true
+		pc.status.LastError = ""
+		return
+	}
+
+	pc.status.Healthy = false
+	pc.status.LastError = err.Error()
+}
+
+func (pc *poolConn) healthy() bool {
+	pc.RLock()
+	defer pc.RUnlock()
+	return pc.status.Healthy
+}
+
+// Client sending the requests of the connection: itself when healthy, otherwise the next healthy
+// connection of the pool, or itself again when none is
+func (pc *poolConn) client() protos.DgraphClient {
+	if pc.healthy() {
+		return pc.dc
+	}
+	conns := pc.pool.conns
+	for i := 1; i < len(conns); i++ {
+		if other := conns[(pc.index + i) % len(conns)]; other.healthy() {
+			return other.dc
+		}
+	}
+	return pc.dc
+}
+
+func (pc *poolConn) Run(ctx context.Context, in *protos.Request, opts ...grpc.CallOption) (*protos.Response, error) {
+	return pc.client().Run(ctx, in, opts...)
+}
+
+func (pc *poolConn) CheckVersion(ctx context.Context, in *protos.Check, opts ...grpc.CallOption) (*protos.Version, error) {
+	return pc.client().CheckVersion(ctx, in, opts...)
+}
+
+func (pc *poolConn) AssignUids(ctx context.Context, in *protos.Num, opts ...grpc.CallOption) (*protos.AssignedIds, error) {
+	return pc.client().AssignUids(ctx, in, opts...)
+}
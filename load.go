@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/AsT4re/cancities/dgclient"
+	"github.com/AsT4re/cancities/api"
+	"github.com/AsT4re/cancities/server"
+)
+
+// Number of lines sent in the same mutation request, committed and checkpointed together
+const linesPerBatch = 100
+
+// Maximum length of a line, i.e. of a feature
+const maxLineSize = 1024 * 1024
+
+// Handle 'load' command: load cities from local files holding one GeoJSON feature per line
+func load(config server.Config, args []string) error {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	stateDir := fs.String("state-dir", "load-state", "Directory keeping checkpoints of the load, for resuming it")
+	onError := fs.String("on-error", api.OnErrorFail, "Policy for invalid features: fail or skip")
+	fs.Parse(args)
+	files := fs.Args()
+	if len(files) == 0 || (*onError != api.OnErrorFail && *onError != api.OnErrorSkip) {
+		return errors.New("usage: load [--state-dir DIR] [--on-error fail|skip] <file>...")
+	}
+
+	// Checkpoints would skip the files if they were loaded again, so they are removed once the
+	// load is done, after the client is closed
+	done := false
+	defer func() {
+		if !done {
+			return
+		}
+		if err := os.RemoveAll(*stateDir); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %+v\n", errors.Wrap(err, "removing state dir failed:"))
+		}
+	}()
+
+	db, err := dgclient.NewLoadClient(config.DgHostAndPort, config.DgConnsPool, *stateDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	version, err := db.AppliedSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version < dgclient.SchemaVersion {
+		return errors.Errorf("DB schema version %v is behind expected version %v, run 'cancities migrate up'",
+			version, dgclient.SchemaVersion)
+	}
+
+	start := time.Now().UTC()
+	id, err := loadId(*stateDir, start)
+	if err != nil {
+		return err
+	}
+	loader, err := db.NewLoader(files, id, start)
+	if err != nil {
+		return err
+	}
+
+	// On interrupt, stop reading and wait for queued lines so that checkpoints are up to date
+	cSig := make(chan os.Signal, 1)
+	signal.Notify(cSig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(cSig)
+
+	loaded := 0
+	for _, file := range files {
+		var n int
+		n, err = loadFile(loader, file, *onError == api.OnErrorSkip, cSig)
+		loaded += n
+		if err != nil {
+			break
+		}
+	}
+
+	if flushErr := loader.Flush(); err == nil {
+		err = flushErr
+	}
+	if loaded > 0 {
+		if _, bumpErr := db.BumpDatasetVersion(context.Background()); bumpErr != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %+v\n", bumpErr)
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "load interrupted, run it again with state directory %v to resume", *stateDir)
+	}
+
+	done = true
+	fmt.Printf("INFO: Loaded %v cities\n", loaded)
+	return nil
+}
+
+// Id of the load, given to the versions of the cities it stores. It is kept in the state directory
+// so that a resumed load keeps the id of the interrupted one
+func loadId(stateDir string, start time.Time) (string, error) {
+	file := filepath.Join(stateDir, "load-id")
+	if data, err := ioutil.ReadFile(file); err == nil {
+		return strings.TrimSpace(string(data)), nil
+	} else if !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "error reading load id")
+	}
+
+	id := fmt.Sprintf("load-%d", start.UnixNano())
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return "", errors.Wrap(err, "error creating state dir")
+	}
+	if err := ioutil.WriteFile(file, []byte(id + "\n"), 0600); err != nil {
+		return "", errors.Wrap(err, "error writing load id")
+	}
+	return id, nil
+}
+
+// Queue the cities of a file from its checkpoint, return the number of cities queued
+func loadFile(loader *dgclient.Loader, file string, skipInvalid bool, cSig chan os.Signal) (int, error) {
+	checkpoint, err := loader.Checkpoint(file)
+	if err != nil {
+		return 0, err
+	}
+	if checkpoint > 0 {
+		fmt.Printf("INFO: Resuming load of %v after line %v\n", file, checkpoint)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, errors.Wrap(err, "error opening file")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64 * 1024), maxLineSize)
+
+	loaded := 0
+	var line uint64
+	var batch []*dgclient.CityProps
+	for scanner.Scan() {
+		select {
+		case <-cSig:
+			return loaded, errors.New("load interrupted by signal")
+		default:
+		}
+
+		if line++; line <= checkpoint || len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var feat api.Feature
+		err := json.Unmarshal(scanner.Bytes(), &feat)
+		var city *dgclient.CityProps
+		if err == nil {
+			city, err = server.CityFromFeature(&feat)
+		}
+		if err != nil {
+			if !skipInvalid {
+				return loaded, errors.Wrapf(err, "invalid feature at line %v of %v", line, file)
+			}
+			fmt.Fprintf(os.Stderr, "WARNING: skipping invalid feature at line %v of %v: %v\n", line, file, err)
+			continue
+		}
+
+		if batch = append(batch, city); len(batch) == linesPerBatch {
+			if err := loader.AddCities(file, line, batch); err != nil {
+				return loaded, err
+			}
+			loaded += len(batch)
+			batch = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return loaded, errors.Wrapf(err, "error reading %v", file)
+	}
+
+	if len(batch) > 0 {
+		if err := loader.AddCities(file, line, batch); err != nil {
+			return loaded, err
+		}
+		loaded += len(batch)
+	}
+	fmt.Printf("INFO: Read %v lines of %v\n", line, file)
+	return loaded, nil
+}
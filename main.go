@@ -13,35 +13,94 @@ import (
 )
 
 var (
+	configFile = flag.String("config", "", "YAML configuration file, with flag names as keys")
 	port = flag.String("port", "8443", "Server port")
+	grpcPort = flag.String("grpc-port", "", "gRPC server port, e.g. 8444 (gRPC API disabled if empty)")
+	grpcImportMaxBytes = flag.Uint64("grpc-import-max-bytes", 100 << 20, "Maximum size of the features streamed by a gRPC import (in bytes)")
 	nbConns = flag.Uint("dg-conns-pool", 10, "Number of connections to DGraph")
 	dgraph = flag.String("dg-host-and-port", "127.0.0.1:9080", "Dgraph database hostname and port")
 	deadline = flag.Uint("deadline", 30, "Deadline for server to gracefully shutdown (in seconds)")
 	cert = flag.String("tls-crt", "certificates/server.crt", "Server TLS certificate")
 	key = flag.String("tls-key", "certificates/server.key", "Server TLS private key")
+	clientCA = flag.String("tls-client-ca", "", "CA bundle for verifying client certificates (client certificates not required if empty)")
+	tlsMinVersion = flag.String("tls-min-version", "1.2", "Minimum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	tlsCiphers = flag.String("tls-ciphers", "", "Comma separated list of allowed TLS cipher suites (Go defaults if empty)")
+	apiKeys = flag.String("api-keys", "", "YAML file with API keys and their roles")
+	anonymousRole = flag.String("anonymous-role", "reader", "Role of requests without API key (none, reader, importer or admin)")
+	cacheSize = flag.Int("cache-size", 10000, "Maximum number of cached responses (cache disabled if 0)")
+	cacheTTL = flag.Uint("cache-ttl", 300, "Time to live of cached responses (in seconds)")
+	graphqlMaxDepth = flag.Uint("graphql-max-depth", 5, "Maximum depth of GraphQL queries")
+	graphqlMaxComplexity = flag.Uint("graphql-max-complexity", 10000, "Maximum complexity of GraphQL queries, i.e. number of fields they may resolve")
+	webhooks = flag.String("webhooks", "", "YAML file with webhooks to post change events to")
+	eventsBuffer = flag.Int("events-buffer", 10000, "Number of recent change events kept for resuming event streams")
+	batchGetMaxIds = flag.Uint("batch-get-max-ids", 1000, "Maximum number of ids of a batch lookup of cities")
+	importRate = flag.Float64("import-rate", 1, "Imports per minute allowed to a client, after the burst")
+	importBurst = flag.Uint("import-burst", 3, "Imports a client may send at once")
+	readRate = flag.Float64("read-rate", 1200, "Read requests per minute allowed to a client, after the burst")
+	readBurst = flag.Uint("read-burst", 40, "Read requests a client may send at once")
+	largeDist = flag.Uint64("large-dist", 100, "Distance (in kilometers) above which searches around a city are rate limited more strictly")
+	largeDistRate = flag.Float64("large-dist-rate", 12, "Searches above large-dist per minute allowed to a client, after the burst")
+	largeDistBurst = flag.Uint("large-dist-burst", 3, "Searches above large-dist a client may send at once")
+	exportRate = flag.Float64("export-rate", 12, "Export requests per minute allowed to a client, after the burst")
+	exportBurst = flag.Uint("export-burst", 10, "Export requests a client may send at once")
 )
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
-	if err := run(); err != nil {
+
+	config, err := loadConfig()
+	if err == nil {
+		switch flag.Arg(0) {
+		case "":
+			err = run(config)
+		case "migrate":
+			err = migrate(config, flag.Args()[1:])
+		case "load":
+			err = load(config, flag.Args()[1:])
+		default:
+			err = fmt.Errorf("unknown command '%v'", flag.Arg(0))
+		}
+	}
+
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: %+v\n", err)
 		os.Exit(1)
 	}
 }
 
-func run() error {
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [flags] [command]
+
+Without command, start the server.
+
+Commands:
+  migrate up       Apply pending migrations of DB schema
+  migrate status   Show applied and pending migrations of DB schema
+  load [--state-dir DIR] [--on-error fail|skip] <file>...
+                   Load cities from files with one GeoJSON feature per line,
+                   resuming an interrupted load from its checkpoints
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func run(config server.Config) error {
 	// The main goroutine has to handle signals in order to supervise goroutine managing server
 	cSig := make(chan os.Signal, 2)
 	signal.Notify(cSig, os.Interrupt, syscall.SIGTERM)
+	cHup := make(chan os.Signal, 1)
+	signal.Notify(cHup, syscall.SIGHUP)
 	cErr := make(chan error)
 	s := new(server.Server)
 
 	go func() {
-		if err := s.Init(*port, *dgraph, *nbConns); err != nil {
+		if err := s.Init(config); err != nil {
 			cErr <- err
 			return
 		}
-		if err := s.Start(*cert, *key); err != nil {
+		if err := s.Start(); err != nil {
 			if err == http.ErrServerClosed {
 				fmt.Printf("INFO: Wait for graceful shutdown of server...\n")
 			} else {
@@ -52,18 +111,30 @@ func run() error {
 
 	defer s.Close()
 
-	select {
-	case <-cSig:
-		d := time.Now().Add(time.Duration(*deadline) * time.Second)
-		ctx, _ := context.WithDeadline(context.Background(), d)
-		if err := s.Stop(&ctx); err != nil {
+	for {
+		select {
+		case <-cHup:
+			if err := s.ReloadCertificate(); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: %+v\n", err)
+			} else {
+				fmt.Printf("INFO: TLS certificate reloaded\n")
+			}
+		case <-cSig:
+			return stop(s, config.Deadline)
+		case err := <-cErr:
 			return err
-		} else {
-			fmt.Printf("INFO: Server shutdown done\n")
 		}
-	case err := <-cErr:
+	}
+}
+
+func stop(s *server.Server, deadline uint) error {
+	d := time.Now().Add(time.Duration(deadline) * time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), d)
+	defer cancel()
+	if err := s.Stop(&ctx); err != nil {
 		return err
 	}
 
+	fmt.Printf("INFO: Server shutdown done\n")
 	return nil
 }
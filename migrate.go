@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/AsT4re/cancities/dgclient"
+	"github.com/AsT4re/cancities/server"
+)
+
+// Handle 'migrate' command for DB schema
+func migrate(config server.Config, args []string) error {
+	if len(args) != 1 || (args[0] != "up" && args[0] != "status") {
+		return errors.New("usage: migrate up|status")
+	}
+
+	db, err := dgclient.NewDGClient(config.DgHostAndPort, config.DgConnsPool)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	version, err := db.AppliedSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "status" {
+		pending, err := db.PendingMigrations()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied schema version: %v\n", version)
+		fmt.Printf("Expected schema version: %v\n", dgclient.SchemaVersion)
+		for _, m := range pending {
+			fmt.Printf("Pending migration %v: %v\n", m.Version, m.Description)
+		}
+		return nil
+	}
+
+	applied, err := db.MigrateUp(context.Background())
+	for _, m := range applied {
+		fmt.Printf("INFO: Applied migration %v: %v\n", m.Version, m.Description)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Printf("INFO: Schema already at version %v\n", version)
+	}
+	return nil
+}
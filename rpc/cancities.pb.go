@@ -0,0 +1,726 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: rpc/cancities.proto
+
+/*
+Package rpc is a generated protocol buffer package.
+
+It is generated from these files:
+
+	rpc/cancities.proto
+
+It has these top-level messages:
+
+	City
+	Cities
+	GetCityRequest
+	GetCitiesAroundRequest
+	SearchByNameRequest
+	Feature
+	ImportOptions
+	ImportCitiesRequest
+	ImportChanges
+	RejectedFeature
+	ImportCitiesReply
+*/
+package rpc
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+import google_protobuf "github.com/golang/protobuf/ptypes/timestamp"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+type City struct {
+	CartodbId  int64   `protobuf:"varint,1,opt,name=cartodb_id,json=cartodbId" json:"cartodb_id,omitempty"`
+	Name       string  `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	Population int64   `protobuf:"varint,3,opt,name=population" json:"population,omitempty"`
+	Longitude  float64 `protobuf:"fixed64,4,opt,name=longitude" json:"longitude,omitempty"`
+	Latitude   float64 `protobuf:"fixed64,5,opt,name=latitude" json:"latitude,omitempty"`
+}
+
+func (m *City) Reset()                    { *m = City{} }
+func (m *City) String() string            { return proto.CompactTextString(m) }
+func (*City) ProtoMessage()               {}
+func (*City) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
+func (m *City) GetCartodbId() int64 {
+	if m != nil {
+		return m.CartodbId
+	}
+	return 0
+}
+
+func (m *City) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *City) GetPopulation() int64 {
+	if m != nil {
+		return m.Population
+	}
+	return 0
+}
+
+func (m *City) GetLongitude() float64 {
+	if m != nil {
+		return m.Longitude
+	}
+	return 0
+}
+
+func (m *City) GetLatitude() float64 {
+	if m != nil {
+		return m.Latitude
+	}
+	return 0
+}
+
+type Cities struct {
+	Cities []*City `protobuf:"bytes,1,rep,name=cities" json:"cities,omitempty"`
+}
+
+func (m *Cities) Reset()                    { *m = Cities{} }
+func (m *Cities) String() string            { return proto.CompactTextString(m) }
+func (*Cities) ProtoMessage()               {}
+func (*Cities) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
+func (m *Cities) GetCities() []*City {
+	if m != nil {
+		return m.Cities
+	}
+	return nil
+}
+
+type GetCityRequest struct {
+	CartodbId int64 `protobuf:"varint,1,opt,name=cartodb_id,json=cartodbId" json:"cartodb_id,omitempty"`
+	// City as it was at this time, the current one if not set
+	AsOf *google_protobuf.Timestamp `protobuf:"bytes,2,opt,name=as_of,json=asOf" json:"as_of,omitempty"`
+}
+
+func (m *GetCityRequest) Reset()                    { *m = GetCityRequest{} }
+func (m *GetCityRequest) String() string            { return proto.CompactTextString(m) }
+func (*GetCityRequest) ProtoMessage()               {}
+func (*GetCityRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+func (m *GetCityRequest) GetCartodbId() int64 {
+	if m != nil {
+		return m.CartodbId
+	}
+	return 0
+}
+
+func (m *GetCityRequest) GetAsOf() *google_protobuf.Timestamp {
+	if m != nil {
+		return m.AsOf
+	}
+	return nil
+}
+
+type GetCitiesAroundRequest struct {
+	CartodbId int64  `protobuf:"varint,1,opt,name=cartodb_id,json=cartodbId" json:"cartodb_id,omitempty"`
+	Dist      uint64 `protobuf:"varint,2,opt,name=dist" json:"dist,omitempty"`
+	// Cities as they were at this time, the current ones if not set
+	AsOf *google_protobuf.Timestamp `protobuf:"bytes,3,opt,name=as_of,json=asOf" json:"as_of,omitempty"`
+}
+
+func (m *GetCitiesAroundRequest) Reset()                    { *m = GetCitiesAroundRequest{} }
+func (m *GetCitiesAroundRequest) String() string            { return proto.CompactTextString(m) }
+func (*GetCitiesAroundRequest) ProtoMessage()               {}
+func (*GetCitiesAroundRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *GetCitiesAroundRequest) GetCartodbId() int64 {
+	if m != nil {
+		return m.CartodbId
+	}
+	return 0
+}
+
+func (m *GetCitiesAroundRequest) GetDist() uint64 {
+	if m != nil {
+		return m.Dist
+	}
+	return 0
+}
+
+func (m *GetCitiesAroundRequest) GetAsOf() *google_protobuf.Timestamp {
+	if m != nil {
+		return m.AsOf
+	}
+	return nil
+}
+
+// Names are only searched among current cities, past names not being indexed
+type SearchByNameRequest struct {
+	Name string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	// Maximum number of cities, 100 if 0
+	Limit uint32 `protobuf:"varint,2,opt,name=limit" json:"limit,omitempty"`
+}
+
+func (m *SearchByNameRequest) Reset()                    { *m = SearchByNameRequest{} }
+func (m *SearchByNameRequest) String() string            { return proto.CompactTextString(m) }
+func (*SearchByNameRequest) ProtoMessage()               {}
+func (*SearchByNameRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *SearchByNameRequest) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *SearchByNameRequest) GetLimit() uint32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
+// Every property of an imported city
+type Feature struct {
+	CartodbId  int64                      `protobuf:"varint,1,opt,name=cartodb_id,json=cartodbId" json:"cartodb_id,omitempty"`
+	Name       string                     `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	PlaceKey   string                     `protobuf:"bytes,3,opt,name=place_key,json=placeKey" json:"place_key,omitempty"`
+	Capital    string                     `protobuf:"bytes,4,opt,name=capital" json:"capital,omitempty"`
+	Population int64                      `protobuf:"varint,5,opt,name=population" json:"population,omitempty"`
+	Pclass     string                     `protobuf:"bytes,6,opt,name=pclass" json:"pclass,omitempty"`
+	Longitude  float64                    `protobuf:"fixed64,7,opt,name=longitude" json:"longitude,omitempty"`
+	Latitude   float64                    `protobuf:"fixed64,8,opt,name=latitude" json:"latitude,omitempty"`
+	CreatedAt  *google_protobuf.Timestamp `protobuf:"bytes,9,opt,name=created_at,json=createdAt" json:"created_at,omitempty"`
+	UpdatedAt  *google_protobuf.Timestamp `protobuf:"bytes,10,opt,name=updated_at,json=updatedAt" json:"updated_at,omitempty"`
+}
+
+func (m *Feature) Reset()                    { *m = Feature{} }
+func (m *Feature) String() string            { return proto.CompactTextString(m) }
+func (*Feature) ProtoMessage()               {}
+func (*Feature) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *Feature) GetCartodbId() int64 {
+	if m != nil {
+		return m.CartodbId
+	}
+	return 0
+}
+
+func (m *Feature) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Feature) GetPlaceKey() string {
+	if m != nil {
+		return m.PlaceKey
+	}
+	return ""
+}
+
+func (m *Feature) GetCapital() string {
+	if m != nil {
+		return m.Capital
+	}
+	return ""
+}
+
+func (m *Feature) GetPopulation() int64 {
+	if m != nil {
+		return m.Population
+	}
+	return 0
+}
+
+func (m *Feature) GetPclass() string {
+	if m != nil {
+		return m.Pclass
+	}
+	return ""
+}
+
+func (m *Feature) GetLongitude() float64 {
+	if m != nil {
+		return m.Longitude
+	}
+	return 0
+}
+
+func (m *Feature) GetLatitude() float64 {
+	if m != nil {
+		return m.Latitude
+	}
+	return 0
+}
+
+func (m *Feature) GetCreatedAt() *google_protobuf.Timestamp {
+	if m != nil {
+		return m.CreatedAt
+	}
+	return nil
+}
+
+func (m *Feature) GetUpdatedAt() *google_protobuf.Timestamp {
+	if m != nil {
+		return m.UpdatedAt
+	}
+	return nil
+}
+
+type ImportOptions struct {
+	// "fail" (default) or "skip", policy for invalid features
+	OnError string `protobuf:"bytes,1,opt,name=on_error,json=onError" json:"on_error,omitempty"`
+	DryRun  bool   `protobuf:"varint,2,opt,name=dry_run,json=dryRun" json:"dry_run,omitempty"`
+}
+
+func (m *ImportOptions) Reset()                    { *m = ImportOptions{} }
+func (m *ImportOptions) String() string            { return proto.CompactTextString(m) }
+func (*ImportOptions) ProtoMessage()               {}
+func (*ImportOptions) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *ImportOptions) GetOnError() string {
+	if m != nil {
+		return m.OnError
+	}
+	return ""
+}
+
+func (m *ImportOptions) GetDryRun() bool {
+	if m != nil {
+		return m.DryRun
+	}
+	return false
+}
+
+type ImportCitiesRequest struct {
+	// Only read from the first message of the stream
+	Options *ImportOptions `protobuf:"bytes,1,opt,name=options" json:"options,omitempty"`
+	Feature *Feature       `protobuf:"bytes,2,opt,name=feature" json:"feature,omitempty"`
+}
+
+func (m *ImportCitiesRequest) Reset()                    { *m = ImportCitiesRequest{} }
+func (m *ImportCitiesRequest) String() string            { return proto.CompactTextString(m) }
+func (*ImportCitiesRequest) ProtoMessage()               {}
+func (*ImportCitiesRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *ImportCitiesRequest) GetOptions() *ImportOptions {
+	if m != nil {
+		return m.Options
+	}
+	return nil
+}
+
+func (m *ImportCitiesRequest) GetFeature() *Feature {
+	if m != nil {
+		return m.Feature
+	}
+	return nil
+}
+
+type ImportChanges struct {
+	Inserted  int32 `protobuf:"varint,1,opt,name=inserted" json:"inserted,omitempty"`
+	Updated   int32 `protobuf:"varint,2,opt,name=updated" json:"updated,omitempty"`
+	Unchanged int32 `protobuf:"varint,3,opt,name=unchanged" json:"unchanged,omitempty"`
+}
+
+func (m *ImportChanges) Reset()                    { *m = ImportChanges{} }
+func (m *ImportChanges) String() string            { return proto.CompactTextString(m) }
+func (*ImportChanges) ProtoMessage()               {}
+func (*ImportChanges) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+func (m *ImportChanges) GetInserted() int32 {
+	if m != nil {
+		return m.Inserted
+	}
+	return 0
+}
+
+func (m *ImportChanges) GetUpdated() int32 {
+	if m != nil {
+		return m.Updated
+	}
+	return 0
+}
+
+func (m *ImportChanges) GetUnchanged() int32 {
+	if m != nil {
+		return m.Unchanged
+	}
+	return 0
+}
+
+type RejectedFeature struct {
+	// Position of the feature in the stream
+	Index     int32    `protobuf:"varint,1,opt,name=index" json:"index,omitempty"`
+	CartodbId int64    `protobuf:"varint,2,opt,name=cartodb_id,json=cartodbId" json:"cartodb_id,omitempty"`
+	Reasons   []string `protobuf:"bytes,3,rep,name=reasons" json:"reasons,omitempty"`
+}
+
+func (m *RejectedFeature) Reset()                    { *m = RejectedFeature{} }
+func (m *RejectedFeature) String() string            { return proto.CompactTextString(m) }
+func (*RejectedFeature) ProtoMessage()               {}
+func (*RejectedFeature) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *RejectedFeature) GetIndex() int32 {
+	if m != nil {
+		return m.Index
+	}
+	return 0
+}
+
+func (m *RejectedFeature) GetCartodbId() int64 {
+	if m != nil {
+		return m.CartodbId
+	}
+	return 0
+}
+
+func (m *RejectedFeature) GetReasons() []string {
+	if m != nil {
+		return m.Reasons
+	}
+	return nil
+}
+
+type ImportCitiesReply struct {
+	Status   string             `protobuf:"bytes,1,opt,name=status" json:"status,omitempty"`
+	DryRun   bool               `protobuf:"varint,2,opt,name=dry_run,json=dryRun" json:"dry_run,omitempty"`
+	Imported int32              `protobuf:"varint,3,opt,name=imported" json:"imported,omitempty"`
+	Changes  *ImportChanges     `protobuf:"bytes,4,opt,name=changes" json:"changes,omitempty"`
+	Rejected []*RejectedFeature `protobuf:"bytes,5,rep,name=rejected" json:"rejected,omitempty"`
+}
+
+func (m *ImportCitiesReply) Reset()                    { *m = ImportCitiesReply{} }
+func (m *ImportCitiesReply) String() string            { return proto.CompactTextString(m) }
+func (*ImportCitiesReply) ProtoMessage()               {}
+func (*ImportCitiesReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+
+func (m *ImportCitiesReply) GetStatus() string {
+	if m != nil {
+		return m.Status
+	}
+	return ""
+}
+
+func (m *ImportCitiesReply) GetDryRun() bool {
+	if m != nil {
+		return m.DryRun
+	}
+	return false
+}
+
+func (m *ImportCitiesReply) GetImported() int32 {
+	if m != nil {
+		return m.Imported
+	}
+	return 0
+}
+
+func (m *ImportCitiesReply) GetChanges() *ImportChanges {
+	if m != nil {
+		return m.Changes
+	}
+	return nil
+}
+
+func (m *ImportCitiesReply) GetRejected() []*RejectedFeature {
+	if m != nil {
+		return m.Rejected
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*City)(nil), "cancities.City")
+	proto.RegisterType((*Cities)(nil), "cancities.Cities")
+	proto.RegisterType((*GetCityRequest)(nil), "cancities.GetCityRequest")
+	proto.RegisterType((*GetCitiesAroundRequest)(nil), "cancities.GetCitiesAroundRequest")
+	proto.RegisterType((*SearchByNameRequest)(nil), "cancities.SearchByNameRequest")
+	proto.RegisterType((*Feature)(nil), "cancities.Feature")
+	proto.RegisterType((*ImportOptions)(nil), "cancities.ImportOptions")
+	proto.RegisterType((*ImportCitiesRequest)(nil), "cancities.ImportCitiesRequest")
+	proto.RegisterType((*ImportChanges)(nil), "cancities.ImportChanges")
+	proto.RegisterType((*RejectedFeature)(nil), "cancities.RejectedFeature")
+	proto.RegisterType((*ImportCitiesReply)(nil), "cancities.ImportCitiesReply")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for Cancities service
+
+type CancitiesClient interface {
+	// Get a city by id
+	GetCity(ctx context.Context, in *GetCityRequest, opts ...grpc.CallOption) (*City, error)
+	// Get the cities around a city, in a square of side dist (in kilometers)
+	GetCitiesAround(ctx context.Context, in *GetCitiesAroundRequest, opts ...grpc.CallOption) (*Cities, error)
+	// Get the cities whose name holds every term of the given name, case insensitive
+	SearchByName(ctx context.Context, in *SearchByNameRequest, opts ...grpc.CallOption) (*Cities, error)
+	// Import a stream of cities, committed once the stream is closed by the client
+	ImportCities(ctx context.Context, opts ...grpc.CallOption) (Cancities_ImportCitiesClient, error)
+}
+
+type cancitiesClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewCancitiesClient(cc *grpc.ClientConn) CancitiesClient {
+	return &cancitiesClient{cc}
+}
+
+func (c *cancitiesClient) GetCity(ctx context.Context, in *GetCityRequest, opts ...grpc.CallOption) (*City, error) {
+	out := new(City)
+	err := grpc.Invoke(ctx, "/cancities.Cancities/GetCity", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cancitiesClient) GetCitiesAround(ctx context.Context, in *GetCitiesAroundRequest, opts ...grpc.CallOption) (*Cities, error) {
+	out := new(Cities)
+	err := grpc.Invoke(ctx, "/cancities.Cancities/GetCitiesAround", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cancitiesClient) SearchByName(ctx context.Context, in *SearchByNameRequest, opts ...grpc.CallOption) (*Cities, error) {
+	out := new(Cities)
+	err := grpc.Invoke(ctx, "/cancities.Cancities/SearchByName", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cancitiesClient) ImportCities(ctx context.Context, opts ...grpc.CallOption) (Cancities_ImportCitiesClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Cancities_serviceDesc.Streams[0], c.cc, "/cancities.Cancities/ImportCities", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &cancitiesImportCitiesClient{stream}
+	return x, nil
+}
+
+type Cancities_ImportCitiesClient interface {
+	Send(*ImportCitiesRequest) error
+	CloseAndRecv() (*ImportCitiesReply, error)
+	grpc.ClientStream
+}
+
+type cancitiesImportCitiesClient struct {
+	grpc.ClientStream
+}
+
+func (x *cancitiesImportCitiesClient) Send(m *ImportCitiesRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *cancitiesImportCitiesClient) CloseAndRecv() (*ImportCitiesReply, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ImportCitiesReply)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for Cancities service
+
+type CancitiesServer interface {
+	// Get a city by id
+	GetCity(context.Context, *GetCityRequest) (*City, error)
+	// Get the cities around a city, in a square of side dist (in kilometers)
+	GetCitiesAround(context.Context, *GetCitiesAroundRequest) (*Cities, error)
+	// Get the cities whose name holds every term of the given name, case insensitive
+	SearchByName(context.Context, *SearchByNameRequest) (*Cities, error)
+	// Import a stream of cities, committed once the stream is closed by the client
+	ImportCities(Cancities_ImportCitiesServer) error
+}
+
+func RegisterCancitiesServer(s *grpc.Server, srv CancitiesServer) {
+	s.RegisterService(&_Cancities_serviceDesc, srv)
+}
+
+func _Cancities_GetCity_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CancitiesServer).GetCity(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cancities.Cancities/GetCity",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CancitiesServer).GetCity(ctx, req.(*GetCityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cancities_GetCitiesAround_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCitiesAroundRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CancitiesServer).GetCitiesAround(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cancities.Cancities/GetCitiesAround",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CancitiesServer).GetCitiesAround(ctx, req.(*GetCitiesAroundRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cancities_SearchByName_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchByNameRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CancitiesServer).SearchByName(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cancities.Cancities/SearchByName",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CancitiesServer).SearchByName(ctx, req.(*SearchByNameRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cancities_ImportCities_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CancitiesServer).ImportCities(&cancitiesImportCitiesServer{stream})
+}
+
+type Cancities_ImportCitiesServer interface {
+	SendAndClose(*ImportCitiesReply) error
+	Recv() (*ImportCitiesRequest, error)
+	grpc.ServerStream
+}
+
+type cancitiesImportCitiesServer struct {
+	grpc.ServerStream
+}
+
+func (x *cancitiesImportCitiesServer) SendAndClose(m *ImportCitiesReply) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *cancitiesImportCitiesServer) Recv() (*ImportCitiesRequest, error) {
+	m := new(ImportCitiesRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Cancities_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "cancities.Cancities",
+	HandlerType: (*CancitiesServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetCity",
+			Handler:    _Cancities_GetCity_Handler,
+		},
+		{
+			MethodName: "GetCitiesAround",
+			Handler:    _Cancities_GetCitiesAround_Handler,
+		},
+		{
+			MethodName: "SearchByName",
+			Handler:    _Cancities_SearchByName_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ImportCities",
+			Handler:       _Cancities_ImportCities_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "rpc/cancities.proto",
+}
+
+func init() { proto.RegisterFile("rpc/cancities.proto", fileDescriptor0) }
+
+var fileDescriptor0 = []byte{
+	// 732 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x54, 0xcd, 0x6e, 0xd3, 0x4c,
+	0x14, 0x95, 0x93, 0x38, 0x8e, 0x6f, 0xdb, 0xaf, 0xea, 0xb4, 0xea, 0xe7, 0x86, 0x52, 0x82, 0x37,
+	0x64, 0x81, 0x12, 0x11, 0x04, 0x12, 0x2b, 0x94, 0x46, 0x50, 0x55, 0x48, 0xad, 0x34, 0xb0, 0x62,
+	0x93, 0x4e, 0xed, 0x49, 0x6a, 0x70, 0x3c, 0x66, 0x66, 0x2c, 0xb0, 0xc4, 0x5b, 0xb0, 0xe7, 0x89,
+	0x78, 0x03, 0x5e, 0x06, 0x79, 0x3c, 0x93, 0x38, 0x6e, 0x4b, 0x2b, 0x76, 0xbe, 0xff, 0x73, 0xcf,
+	0x39, 0xbe, 0xb0, 0xcb, 0xd3, 0x60, 0x18, 0x90, 0x24, 0x88, 0x64, 0x44, 0xc5, 0x20, 0xe5, 0x4c,
+	0x32, 0xe4, 0x2e, 0x1d, 0xdd, 0x47, 0x73, 0xc6, 0xe6, 0x31, 0x1d, 0xaa, 0xc0, 0x65, 0x36, 0x1b,
+	0xca, 0x68, 0x41, 0x85, 0x24, 0x8b, 0xb4, 0xcc, 0xf5, 0x7f, 0x58, 0xd0, 0x9a, 0x44, 0x32, 0x47,
+	0x0f, 0x01, 0x02, 0xc2, 0x25, 0x0b, 0x2f, 0xa7, 0x51, 0xe8, 0x59, 0x3d, 0xab, 0xdf, 0xc4, 0xae,
+	0xf6, 0x9c, 0x86, 0x08, 0x41, 0x2b, 0x21, 0x0b, 0xea, 0x35, 0x7a, 0x56, 0xdf, 0xc5, 0xea, 0x1b,
+	0x1d, 0x01, 0xa4, 0x2c, 0xcd, 0x62, 0x22, 0x23, 0x96, 0x78, 0x4d, 0x55, 0x52, 0xf1, 0xa0, 0x43,
+	0x70, 0x63, 0x96, 0xcc, 0x23, 0x99, 0x85, 0xd4, 0x6b, 0xf5, 0xac, 0xbe, 0x85, 0x57, 0x0e, 0xd4,
+	0x85, 0x4e, 0x91, 0xa7, 0x82, 0xb6, 0x0a, 0x2e, 0x6d, 0xff, 0x19, 0xb4, 0x27, 0x6a, 0x01, 0xf4,
+	0x04, 0xda, 0xe5, 0x2a, 0x9e, 0xd5, 0x6b, 0xf6, 0x37, 0x46, 0xdb, 0x83, 0xd5, 0xb6, 0xc5, 0xbb,
+	0xb1, 0x0e, 0xfb, 0x17, 0xf0, 0xdf, 0x09, 0x95, 0xca, 0x45, 0xbf, 0x64, 0x54, 0xc8, 0xbb, 0x36,
+	0x1a, 0x82, 0x4d, 0xc4, 0x94, 0xcd, 0xd4, 0x4a, 0x1b, 0xa3, 0xee, 0xa0, 0x84, 0x6a, 0x60, 0xa0,
+	0x1a, 0x7c, 0x30, 0x50, 0xe1, 0x16, 0x11, 0xe7, 0x33, 0xff, 0x3b, 0xec, 0x97, 0x13, 0x22, 0x2a,
+	0xc6, 0x9c, 0x65, 0x49, 0x78, 0xcf, 0x49, 0x08, 0x5a, 0x61, 0x24, 0xa4, 0x1a, 0xd4, 0xc2, 0xea,
+	0x7b, 0x35, 0xbd, 0x79, 0xcf, 0xe9, 0xaf, 0x61, 0xf7, 0x3d, 0x25, 0x3c, 0xb8, 0x3a, 0xce, 0xcf,
+	0xc8, 0x82, 0x9a, 0xd1, 0x86, 0x17, 0xab, 0xc2, 0xcb, 0x1e, 0xd8, 0x71, 0xb4, 0x88, 0xca, 0x81,
+	0x5b, 0xb8, 0x34, 0xfc, 0xdf, 0x0d, 0x70, 0xde, 0x52, 0x22, 0x33, 0x4e, 0xff, 0x85, 0xec, 0x07,
+	0xe0, 0xa6, 0x31, 0x09, 0xe8, 0xf4, 0x33, 0xcd, 0xd5, 0xa3, 0x5d, 0xdc, 0x51, 0x8e, 0x77, 0x34,
+	0x47, 0x1e, 0x38, 0x01, 0x49, 0x23, 0x49, 0x62, 0xc5, 0xb3, 0x8b, 0x8d, 0x59, 0xd3, 0x88, 0x7d,
+	0x4d, 0x23, 0xfb, 0xd0, 0x4e, 0x83, 0x98, 0x08, 0xe1, 0xb5, 0x55, 0xa1, 0xb6, 0xd6, 0xb5, 0xe3,
+	0xfc, 0x4d, 0x3b, 0x9d, 0x75, 0xed, 0xa0, 0x57, 0x00, 0x01, 0xa7, 0x44, 0xd2, 0x70, 0x4a, 0xa4,
+	0xe7, 0xde, 0x09, 0xaf, 0xab, 0xb3, 0xc7, 0xb2, 0x28, 0xcd, 0xd2, 0xd0, 0x94, 0xc2, 0xdd, 0xa5,
+	0x3a, 0x7b, 0x2c, 0xfd, 0x09, 0x6c, 0x9d, 0x2e, 0x52, 0xc6, 0xe5, 0x79, 0x5a, 0xec, 0x25, 0xd0,
+	0x01, 0x74, 0x58, 0x32, 0xa5, 0x9c, 0x33, 0xae, 0xc9, 0x71, 0x58, 0xf2, 0xa6, 0x30, 0xd1, 0xff,
+	0xe0, 0x84, 0x3c, 0x9f, 0xf2, 0x2c, 0x51, 0x08, 0x77, 0x70, 0x3b, 0xe4, 0x39, 0xce, 0x12, 0xff,
+	0x2b, 0xec, 0x96, 0x4d, 0x4a, 0x91, 0x19, 0x8e, 0x47, 0xe0, 0xb0, 0xb2, 0xab, 0xea, 0xb4, 0x31,
+	0xf2, 0x2a, 0x3f, 0xc1, 0xda, 0x54, 0x6c, 0x12, 0xd1, 0x53, 0x70, 0x66, 0x25, 0xd9, 0x5a, 0xdf,
+	0xa8, 0x52, 0xa3, 0x65, 0x80, 0x4d, 0x8a, 0x1f, 0x98, 0xd7, 0x4f, 0xae, 0x48, 0x32, 0xa7, 0xa2,
+	0x00, 0x38, 0x4a, 0x04, 0xe5, 0x92, 0x96, 0xf2, 0xb0, 0xf1, 0xd2, 0x2e, 0xc8, 0xd6, 0x7b, 0xab,
+	0xd6, 0x36, 0x36, 0x66, 0x41, 0x5a, 0x96, 0x04, 0xaa, 0x45, 0xa8, 0x34, 0x62, 0xe3, 0x95, 0xc3,
+	0xbf, 0x80, 0x6d, 0x4c, 0x3f, 0xd1, 0x40, 0xd2, 0xd0, 0xe8, 0x70, 0x0f, 0xec, 0x28, 0x09, 0xe9,
+	0x37, 0x3d, 0xa3, 0x34, 0x6a, 0xea, 0x6c, 0xd4, 0xd5, 0xe9, 0x81, 0xc3, 0x29, 0x11, 0x05, 0x1c,
+	0xcd, 0x5e, 0xb3, 0x00, 0x56, 0x9b, 0xfe, 0x2f, 0x0b, 0x76, 0xd6, 0x01, 0x4c, 0xe3, 0xbc, 0x90,
+	0x98, 0x90, 0x44, 0x66, 0x42, 0xf3, 0xa0, 0xad, 0x5b, 0x69, 0x50, 0xcb, 0xab, 0x2e, 0xcb, 0x2d,
+	0x96, 0x76, 0xc1, 0x45, 0xb9, 0x8f, 0xf0, 0x5a, 0xb7, 0x70, 0xa1, 0x31, 0xc4, 0x26, 0x11, 0xbd,
+	0x84, 0x0e, 0xd7, 0x8b, 0x7b, 0xb6, 0xba, 0x62, 0xdd, 0x4a, 0x51, 0x0d, 0x13, 0xbc, 0xcc, 0x1d,
+	0xfd, 0x6c, 0x80, 0x3b, 0x31, 0x79, 0xe8, 0x05, 0x38, 0xfa, 0xc0, 0xa1, 0x83, 0x4a, 0xf9, 0xfa,
+	0xd1, 0xeb, 0xd6, 0xef, 0x23, 0x3a, 0x81, 0xed, 0xda, 0xd5, 0x42, 0x8f, 0xaf, 0x95, 0xd7, 0x2f,
+	0x5a, 0x77, 0x67, 0xbd, 0x4d, 0x31, 0x7f, 0x0c, 0x9b, 0xd5, 0x03, 0x84, 0x8e, 0x2a, 0x29, 0x37,
+	0x5c, 0xa6, 0x9b, 0x5a, 0x9c, 0xc1, 0x66, 0x95, 0x9e, 0xb5, 0x16, 0x37, 0x08, 0xbf, 0x7b, 0x78,
+	0x6b, 0x3c, 0x8d, 0xf3, 0xbe, 0x75, 0x6c, 0x7f, 0x6c, 0xf2, 0x34, 0xb8, 0x6c, 0xab, 0x5f, 0xf3,
+	0xf9, 0x9f, 0x01, 0x00, 0x03, 0xd8, 0x05, 0xf8, 0x0d, 0x07, 0x00, 0x00,
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net/http"
+	"time"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/AsT4re/cancities/api"
+)
+
+func dropAllHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		s.importMu.Lock()
+		defer s.importMu.Unlock()
+
+		s.beginModification()
+		deleted, err := s.db.DropAll(r.Context())
+		s.endModification()
+		// Cities dropped before an error are deleted as well
+		s.publishEvents(deletedEvents(deleted))
+		if err != nil {
+			return internalError(err)
+		}
+
+		return &httpRetMsg{code: http.StatusNoContent}
+	}
+}
+
+func countHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		count, err := s.db.CountCities()
+		if err != nil {
+			return internalError(err)
+		}
+
+		return &httpRetMsg{
+			http.StatusOK,
+			api.CountRep{Count: count},
+		}
+	}
+}
+
+func schemaHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		schema, err := s.db.GetSchema(r.Context())
+		if err != nil {
+			return internalError(err)
+		}
+
+		return &httpRetMsg{
+			http.StatusOK,
+			api.SchemaRep{Predicates: schema},
+		}
+	}
+}
+
+func lastImportHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		s.statsMu.Lock()
+		last := s.lastImport
+		s.statsMu.Unlock()
+
+		if last == nil {
+			return &httpRetMsg{
+				http.StatusNotFound,
+				api.ErrorRep{Error: ErrNoImport},
+			}
+		}
+
+		return &httpRetMsg{
+			http.StatusOK,
+			*last,
+		}
+	}
+}
+
+func rebuildIndexesHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		s.importMu.Lock()
+		defer s.importMu.Unlock()
+
+		rebuilt, err := s.db.RebuildIndexes(r.Context())
+		if err != nil {
+			return internalError(err)
+		}
+
+		return &httpRetMsg{
+			http.StatusOK,
+			api.RebuildIndexesRep{Rebuilt: rebuilt},
+		}
+	}
+}
+
+// Keep statistics about the last import for the admin API
+func (s *Server) recordImport(start time.Time, rep *api.ImportRep) {
+	stats := &api.LastImportRep{
+		ImportId: rep.ImportId,
+		Start: start,
+		Duration: time.Since(start).String(),
+		Status: rep.Status,
+		Imported: rep.Imported,
+		Rejected: len(rep.Rejected),
+		Changes: rep.Changes,
+		Mutations: rep.Mutations,
+	}
+
+	s.statsMu.Lock()
+	s.lastImport = stats
+	s.statsMu.Unlock()
+}
+
+func configHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		return &httpRetMsg{
+			http.StatusOK,
+			s.config.Redacted(),
+		}
+	}
+}
+
+// Prometheus metrics, written in text format by the Prometheus handler
+func metricsHandler(s *Server) appHandler {
+	handler := prometheus.Handler()
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		handler.ServeHTTP(w, r)
+		return nil
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+	"github.com/AsT4re/cancities/api"
+)
+
+
+/*
+ *  Roles
+ */
+
+// Roles are ordered, each one being granted the rights of the previous ones
+type role int
+
+const (
+	roleNone role = iota
+	roleReader
+	roleImporter
+	roleAdmin
+)
+
+var roleNames = []string{"none", "reader", "importer", "admin"}
+
+func (r role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(name string) (role, error) {
+	for i, n := range roleNames {
+		if n == name {
+			return role(i), nil
+		}
+	}
+	return roleNone, errors.Errorf("unknown role '%v'", name)
+}
+
+
+/*
+ *  API keys
+ */
+
+type apiKey struct {
+	name string
+	role role
+}
+
+// API keys indexed by the sha256 sum of the key
+type apiKeys map[[sha256.Size]byte]apiKey
+
+// Format of the API keys file
+type apiKeysFile struct {
+	Keys []struct {
+		Name string `yaml:"name"`
+		Key  string `yaml:"key"`
+		Role string `yaml:"role"`
+	}           `yaml:"keys"`
+}
+
+// Load API keys from a YAML file. No key is loaded if file is empty
+func loadAPIKeys(file string) (apiKeys, error) {
+	keys := make(apiKeys)
+	if file == "" {
+		return keys, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading API keys file")
+	}
+
+	var content apiKeysFile
+	if err := yaml.UnmarshalStrict(data, &content); err != nil {
+		return nil, errors.Wrap(err, "error parsing API keys file")
+	}
+
+	for i, k := range content.Keys {
+		if k.Name == "" || k.Key == "" {
+			return nil, errors.Errorf("API key %v: name and key are required", i)
+		}
+		r, err := parseRole(k.Role)
+		if err != nil || r == roleNone {
+			return nil, errors.Errorf("API key '%v': invalid role '%v'", k.Name, k.Role)
+		}
+		sum := sha256.Sum256([]byte(k.Key))
+		if _, ok := keys[sum]; ok {
+			return nil, errors.Errorf("API key '%v': same key as another one", k.Name)
+		}
+		keys[sum] = apiKey{k.Name, r}
+	}
+
+	return keys, nil
+}
+
+// Get API key given by 'X-API-Key' or 'Authorization: Bearer' headers
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// Wrap a handler so that only requests with at least the required role go through
+func authorize(s *Server, required role, fn appHandler) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		k, ret := checkAPIKey(s, requestKey(r), required, r.Method + " " + r.URL.Path, r.RemoteAddr)
+		if ret != nil {
+			if ret.code == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			return ret
+		}
+		if k == nil {
+			return fn(w, r)
+		}
+		return fn(w, r.WithContext(context.WithValue(r.Context(), apiKeyKey, *k)))
+	}
+}
+
+// Check that a key grants the required role to a request, shared by every API. Requests without key
+// get the anonymous role (nil key returned), requests with an unknown key are refused
+func checkAPIKey(s *Server, key string, required role, request, remote string) (*apiKey, *httpRetMsg) {
+	if key == "" {
+		if s.anonymousRole >= required {
+			return nil, nil
+		}
+		return nil, &httpRetMsg{
+			http.StatusUnauthorized,
+			api.ErrorRep{Error: ErrUnauthorized},
+		}
+	}
+
+	k, ok := s.apiKeys[sha256.Sum256([]byte(key))]
+	if !ok {
+		fmt.Printf("AUDIT: invalid API key for %s from %s\n", request, remote)
+		return nil, &httpRetMsg{
+			http.StatusUnauthorized,
+			api.ErrorRep{Error: ErrUnauthorized},
+		}
+	}
+
+	if k.role < required {
+		fmt.Printf("AUDIT: key '%s' (%s) forbidden for %s from %s\n", k.name, k.role, request, remote)
+		return nil, &httpRetMsg{
+			http.StatusForbidden,
+			api.ErrorRep{Error: fmt.Sprintf(ErrForbidden, required)},
+		}
+	}
+
+	fmt.Printf("AUDIT: key '%s' (%s) used for %s from %s\n", k.name, k.role, request, remote)
+	return &k, nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"github.com/pkg/errors"
+	"github.com/AsT4re/cancities/dgclient"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Bytes allowed per id in batch lookup bodies, ids having at most 20 characters with their separator
+const batchBytesPerId = 24
+
+// Get many cities by id with a single DB query, as they were at the as_of time if given.
+// Duplicated ids are looked up once
+func batchGetHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		maxIds := s.config.BatchGetMaxIds
+		maxSize := int64(maxIds) * batchBytesPerId + 1024
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSize + 1))
+		if err != nil {
+			return internalError(errors.Wrap(err, "Error reading body:"))
+		}
+		if err = r.Body.Close(); err != nil {
+			return internalError(errors.Wrap(err, "Error closing pipe:"))
+		}
+		if int64(len(body)) > maxSize {
+			return &httpRetMsg{
+				http.StatusRequestEntityTooLarge,
+				api.ErrorRep{Error: fmt.Sprintf(ErrBatchTooLarge, maxSize)},
+			}
+		}
+
+		var req api.BatchGetReq
+		if err = json.Unmarshal(body, &req); err != nil {
+			return &httpRetMsg{
+				http.StatusUnprocessableEntity,
+				api.ErrorRep{Error: fmt.Sprintf(ErrUnprocessableEntity, err)},
+			}
+		}
+
+		var ids []int64
+		seen := make(map[int64]bool)
+		for _, id := range req.Ids {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		if uint(len(ids)) > maxIds {
+			return &httpRetMsg{
+				http.StatusBadRequest,
+				api.ErrorRep{Error: fmt.Sprintf(ErrTooManyIds, len(ids), maxIds)},
+			}
+		}
+
+		rep := api.BatchGetRep{Cities: []api.CityTempl{}, Missing: []int64{}}
+		if len(ids) == 0 {
+			return &httpRetMsg{http.StatusOK, rep}
+		}
+
+		var cities dgclient.CitiesRep
+		if at := asOf(r); at.IsZero() {
+			cities, err = s.db.GetCitiesByIds(ids)
+		} else {
+			cities, err = s.db.GetCitiesByIdsAt(ids, at)
+		}
+		if err != nil {
+			return internalError(err)
+		}
+		found, err := citiesTempl(cities)
+		if err != nil {
+			return internalError(err)
+		}
+
+		byId := make(map[int64]api.CityTempl, len(found))
+		for _, city := range found {
+			byId[city.CartodbId] = city
+		}
+		for _, id := range ids {
+			if city, ok := byId[id]; ok {
+				rep.Cities = append(rep.Cities, city)
+			} else {
+				rep.Missing = append(rep.Missing, id)
+			}
+		}
+
+		return &httpRetMsg{
+			http.StatusOK,
+			rep,
+		}
+	}
+}
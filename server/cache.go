@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/AsT4re/cancities/dgclient"
+)
+
+var (
+	cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cancities_cache_hits_total",
+		Help: "Number of responses served from cache.",
+	})
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cancities_cache_misses_total",
+		Help: "Number of responses not found in cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(cacheHits, cacheMisses)
+}
+
+// Response cache settings of the server
+type CacheOptions struct {
+	// Maximum number of cached responses, cache disabled if 0
+	Size int
+	// Time after which a cached response is computed again
+	TTL  time.Duration
+}
+
+// Bounded LRU cache of responses, with expiration of entries. Cache is disabled if maxEntries is 0
+type responseCache struct {
+	sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	ll         *list.List
+	items      map[string]*list.Element
+	// Incremented on each purge, so that responses computed before are not added afterwards
+	generation uint64
+}
+
+type cacheEntry struct {
+	key     string
+	ret     *httpRetMsg
+	expires time.Time
+}
+
+func newResponseCache(maxEntries int, ttl time.Duration) *responseCache {
+	return &responseCache{
+		maxEntries: maxEntries,
+		ttl: ttl,
+		ll: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *responseCache) Get(key string) (*httpRetMsg, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.removeElement(elem)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(elem)
+	return entry.ret, true
+}
+
+func (c *responseCache) Generation() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.generation
+}
+
+// Add a response computed while cache was at given generation
+func (c *responseCache) Add(key string, generation uint64, ret *httpRetMsg) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.maxEntries <= 0 || generation != c.generation {
+		return
+	}
+
+	entry := &cacheEntry{key, ret, time.Now().Add(c.ttl)}
+	if elem, ok := c.items[key]; ok {
+		elem.Value = entry
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(entry)
+	if c.ll.Len() > c.maxEntries {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Remove every entry, called whenever datas are changed in DB by the server
+func (c *responseCache) Purge() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.generation++
+}
+
+func (c *responseCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.ll.Len()
+}
+
+func (c *responseCache) removeElement(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.items, elem.Value.(*cacheEntry).key)
+}
+
+// Wrap a handler so that its successful and not found responses are cached. Responses are keyed
+// by the dataset version stored in the request context, so that cities modified by another
+// process, e.g. a load, are not served from cache once the version is bumped. Query string is
+// already validated so that the key can be built from its values
+func cached(s *Server, fn appHandler) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		version, ok := r.Context().Value(datasetVersionKey).(dgclient.DatasetVersion)
+		if !ok {
+			return fn(w, r)
+		}
+
+		key := fmt.Sprintf("%d|%s", version.Version, cacheKey(r))
+		if ret, ok := s.cache.Get(key); ok {
+			cacheHits.Inc()
+			return ret
+		}
+		cacheMisses.Inc()
+
+		generation := s.cache.Generation()
+		ret := fn(w, r)
+		if ret.code == http.StatusOK || ret.code == http.StatusNotFound {
+			s.cache.Add(key, generation, ret)
+		}
+		return ret
+	}
+}
+
+// Normalized key of a request: path and parsed query string values sorted by name
+func cacheKey(r *http.Request) string {
+	values := getQsValues(r)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key bytes.Buffer
+	key.WriteString(r.URL.Path)
+	for _, name := range names {
+		fmt.Fprintf(&key, "&%s=%v", name, values[name])
+	}
+	return key.String()
+}
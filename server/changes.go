@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/AsT4re/cancities/dgclient"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Changes of cities modified after a time, for partners syncing incrementally. Pages are ordered by
+// modified_at then id, and the token of the last change is given for getting the next ones, even when
+// none follows yet
+func changesHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		qs := getQsValues(r)
+		since, hasSince := qs.getTime("since")
+		token, hasToken := qs.getString("token")
+		if hasSince == hasToken {
+			return &httpRetMsg{http.StatusBadRequest, api.ErrorRep{Error: ErrSinceOrToken}}
+		}
+
+		var cursor dgclient.ChangesCursor
+		if hasSince {
+			cursor = dgclient.ChangesSince(since)
+		} else {
+			var ok bool
+			if cursor, ok = decodeChangesToken(token); !ok {
+				return &httpRetMsg{http.StatusBadRequest, api.ErrorRep{Error: fmt.Sprintf(ErrInvalidChangesToken, token)}}
+			}
+		}
+
+		limit := uint64(DefaultPageSize)
+		if l, ok := qs.getUInt("limit"); ok {
+			limit = l
+		}
+
+		changes, more, err := s.db.GetChanges(cursor, int(limit))
+		if err != nil {
+			return internalError(err)
+		}
+
+		rep := api.ChangesRep{Changes: make([]api.CityChangeTempl, len(changes)), More: more}
+		for i, c := range changes {
+			rep.Changes[i] = api.CityChangeTempl{
+				CartodbId: c.Id(),
+				ModifiedAt: c.Modified_at,
+				Deleted: c.Deleted(),
+			}
+			if c.Deleted() {
+				continue
+			}
+			rep.Changes[i].UpdatedAt = &c.Updated_at
+
+			geo, err := dgclient.DecodeGeoDatas(c.Geo)
+			if err != nil {
+				return internalError(err)
+			}
+			rep.Changes[i].City = &api.CityTempl{
+				CartodbId: c.Cartodb_id,
+				Name: c.Name,
+				Population: c.Population,
+				Coordinates: geo.FlatCoords(),
+			}
+		}
+		if len(changes) > 0 {
+			last := changes[len(changes) - 1]
+			cursor = dgclient.ChangesCursor{Time: last.Modified_at, Id: last.Id()}
+		}
+		rep.Next = encodeChangesToken(cursor)
+
+		return &httpRetMsg{
+			http.StatusOK,
+			rep,
+		}
+	}
+}
+
+// Opaque continuation token, holding the time and the id of a cursor
+func encodeChangesToken(cursor dgclient.ChangesCursor) string {
+	raw := cursor.Time.Format(time.RFC3339Nano) + "," + strconv.FormatInt(cursor.Id, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeChangesToken(token string) (dgclient.ChangesCursor, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return dgclient.ChangesCursor{}, false
+	}
+	parts := strings.Split(string(raw), ",")
+	if len(parts) != 2 {
+		return dgclient.ChangesCursor{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return dgclient.ChangesCursor{}, false
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return dgclient.ChangesCursor{}, false
+	}
+	return dgclient.ChangesCursor{Time: t, Id: id}, true
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"github.com/AsT4re/cancities/dgclient"
+)
+
+/*
+ *  Dataset modifications
+ */
+
+// Mark the beginning of a modification of cities. Must be called with importMu held
+func (s *Server) beginModification() {
+	atomic.AddUint64(&s.modSeq, 1)
+}
+
+// Mark the end of a modification of cities, successful or not: dataset version is bumped
+// so that validators given to clients before are not matched anymore, and cache is emptied.
+// Must be called with importMu held
+func (s *Server) endModification() {
+	// Not bound to the request, version must be bumped even if client has gone away
+	if version, err := s.db.BumpDatasetVersion(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %+v\n", err)
+	} else {
+		s.knownVersion = version.Version
+	}
+	atomic.AddUint64(&s.modSeq, 1)
+	s.cache.Purge()
+}
+
+
+/*
+ *  Validators
+ */
+
+// Wrap a handler so that its responses get ETag and Last-Modified headers from the dataset version.
+// The version is got first, so that conditional requests still matching it are answered without
+// running the handler, and is stored in the request context for keying cached responses
+func withValidators(s *Server, fn appHandler) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		seq := atomic.LoadUint64(&s.modSeq)
+		version, err := s.db.DatasetVersion()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %+v\n", err)
+			return fn(w, r)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), datasetVersionKey, version))
+		return validated(s, seq, version, fn)(w, r)
+	}
+}
+
+// Serve a request with the dataset version got at modification sequence seq. No validators are
+// given when cities are modified while the response is computed, as they could then describe
+// either the previous or the new cities
+func validated(s *Server, seq uint64, version dgclient.DatasetVersion, fn appHandler) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		if version.Version == 0 || seq % 2 != 0 {
+			return fn(w, r)
+		}
+
+		setValidators(w.Header(), version)
+		if notModified(r, w.Header()) {
+			return &httpRetMsg{code: http.StatusNotModified}
+		}
+
+		ret := fn(w, r)
+		if atomic.LoadUint64(&s.modSeq) != seq {
+			w.Header().Del("ETag")
+			w.Header().Del("Last-Modified")
+		}
+		return ret
+	}
+}
+
+func setValidators(h http.Header, version dgclient.DatasetVersion) {
+	h.Set("ETag", fmt.Sprintf(`"%d-%x"`, version.Version, version.ModifiedAt.Unix()))
+	h.Set("Last-Modified", version.ModifiedAt.UTC().Format(http.TimeFormat))
+}
+
+// Check whether the conditional headers of a GET or HEAD request match the validators
+// of the response. If-Modified-Since is ignored when If-None-Match is given
+func notModified(r *http.Request, h http.Header) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := h.Get("ETag")
+		return etag != "" && etagMatch(inm, etag)
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ims)
+}
+
+// Weak comparison of an ETag against a list of ETags
+func etagMatch(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
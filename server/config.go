@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Settings of the server, validated and shown on the admin API
+type Config api.Config
+
+// Placeholder of settings hidden on admin endpoint
+const redacted = "<redacted>"
+
+// Check settings which would otherwise only fail once used
+func (c *Config) Validate() error {
+	if p, err := strconv.ParseUint(c.Port, 10, 16); err != nil || p == 0 {
+		return errors.Errorf("invalid port '%v'", c.Port)
+	}
+	if p, err := strconv.ParseUint(c.GRPCPort, 10, 16); c.GRPCPort != "" && (err != nil || p == 0) {
+		return errors.Errorf("invalid grpc-port '%v'", c.GRPCPort)
+	}
+	if c.GRPCPort == c.Port {
+		return errors.New("port and grpc-port must differ")
+	}
+	if c.GRPCImportMaxBytes == 0 {
+		return errors.New("grpc-import-max-bytes must be at least 1")
+	}
+	if c.DgConnsPool == 0 {
+		return errors.New("dg-conns-pool must be at least 1")
+	}
+	if _, _, err := net.SplitHostPort(c.DgHostAndPort); err != nil {
+		return errors.Wrapf(err, "invalid dg-host-and-port '%v'", c.DgHostAndPort)
+	}
+	if c.TLSCert == "" || c.TLSKey == "" {
+		return errors.New("tls-crt and tls-key are required")
+	}
+	if _, ok := tlsVersions[c.TLSMinVersion]; !ok && c.TLSMinVersion != "" {
+		return errors.Errorf("unknown TLS version '%v'", c.TLSMinVersion)
+	}
+	if _, err := parseRole(c.AnonymousRole); err != nil {
+		return errors.Wrap(err, "invalid anonymous-role")
+	}
+	if c.CacheSize < 0 {
+		return errors.New("cache-size must not be negative")
+	}
+	if c.GraphQLMaxDepth == 0 || c.GraphQLMaxComplexity == 0 {
+		return errors.New("graphql-max-depth and graphql-max-complexity must be at least 1")
+	}
+	if c.EventsBuffer < 0 {
+		return errors.New("events-buffer must not be negative")
+	}
+	if c.BatchGetMaxIds == 0 {
+		return errors.New("batch-get-max-ids must be at least 1")
+	}
+	if !(c.ImportRate > 0 && c.ReadRate > 0 && c.LargeDistRate > 0 && c.ExportRate > 0) {
+		return errors.New("import-rate, read-rate, large-dist-rate and export-rate must be positive")
+	}
+	if c.ImportBurst == 0 || c.ReadBurst == 0 || c.LargeDistBurst == 0 || c.ExportBurst == 0 {
+		return errors.New("import-burst, read-burst, large-dist-burst and export-burst must be at least 1")
+	}
+	if c.LargeDist > MaxDist {
+		return errors.Errorf("large-dist must be at most %v", MaxDist)
+	}
+	return nil
+}
+
+// Copy of the settings with paths of secrets hidden
+func (c Config) Redacted() Config {
+	c.TLSKey = redacted
+	if c.APIKeys != "" {
+		c.APIKeys = redacted
+	}
+	if c.Webhooks != "" {
+		c.Webhooks = redacted
+	}
+	return c
+}
+
+func (c *Config) tlsOptions() TLSOptions {
+	return TLSOptions{
+		Cert: c.TLSCert,
+		Key: c.TLSKey,
+		ClientCA: c.TLSClientCA,
+		MinVersion: c.TLSMinVersion,
+		Ciphers: c.TLSCiphers,
+	}
+}
+
+// Rate limits of each kind of routes and gRPC methods
+func (c *Config) rateLimits() map[string][]rateLimit {
+	return map[string][]rateLimit{
+		importLimits: {
+			{name: "import", rate: c.ImportRate / 60, burst: float64(c.ImportBurst)},
+		},
+		readLimits: {
+			{name: "read", rate: c.ReadRate / 60, burst: float64(c.ReadBurst)},
+			{name: "large-dist", rate: c.LargeDistRate / 60, burst: float64(c.LargeDistBurst), match: distAbove(c.LargeDist), grpcMatch: grpcDistAbove(c.LargeDist)},
+		},
+		exportLimits: {
+			{name: "export", rate: c.ExportRate / 60, burst: float64(c.ExportBurst)},
+		},
+	}
+}
+
+func (c *Config) cacheOptions() CacheOptions {
+	return CacheOptions{
+		Size: c.CacheSize,
+		TTL: time.Duration(c.CacheTTL) * time.Second,
+	}
+}
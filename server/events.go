@@ -0,0 +1,289 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/AsT4re/cancities/dgclient"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Types of change events
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+	// Cities modified by another process, e.g. the load command or another server, which must be
+	// fetched again by receivers, for instance from GET /cities/changes
+	EventReset   = "reset"
+)
+
+// Interval of comments sent on idle event streams, so that proxies do not close them
+const eventsHeartbeat = 15 * time.Second
+
+// Interval of checks of the dataset version, for detecting modifications by other processes
+const datasetWatchInterval = 10 * time.Second
+
+
+/*
+ *  Broker
+ */
+
+// Recent change events, kept for streams resuming after the last event they received. Ids are
+// consecutive and initialized from the clock, so that they keep increasing across restarts
+type eventBroker struct {
+	sync.Mutex
+	lastId  uint64
+	// Last events, oldest first
+	events  []api.ChangeEvent
+	size    int
+	// Closed and replaced when events are published, for waking up streams
+	changed chan struct{}
+	// Closed when the server stops, for ending streams
+	done    chan struct{}
+	closed  bool
+}
+
+func newEventBroker(size int) *eventBroker {
+	return &eventBroker{
+		lastId: uint64(time.Now().UnixNano() / int64(time.Microsecond)),
+		size: size,
+		changed: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Give ids to events and keep them, returning them with their ids
+func (b *eventBroker) publish(events []api.ChangeEvent) []api.ChangeEvent {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now().UTC()
+	for i := range events {
+		b.lastId++
+		events[i].Id = b.lastId
+		events[i].Time = now
+	}
+
+	b.events = append(b.events, events...)
+	if len(b.events) > b.size {
+		b.events = append([]api.ChangeEvent(nil), b.events[len(b.events) - b.size:]...)
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+	return events
+}
+
+// Events published after the given id along with the id of the last event. Missed is set when
+// events after the id are not kept anymore, or the id is unknown, only kept events being given
+func (b *eventBroker) since(id uint64) (events []api.ChangeEvent, lastId uint64, missed bool,
+                                        changed <-chan struct{}) {
+	b.Lock()
+	defer b.Unlock()
+
+	oldest := b.lastId + 1 - uint64(len(b.events))
+	switch {
+	case id > b.lastId:
+		missed = true
+	case id + 1 < oldest:
+		missed = true
+		events = append(events, b.events...)
+	default:
+		events = append(events, b.events[id + 1 - oldest:]...)
+	}
+	return events, b.lastId, missed, b.changed
+}
+
+func (b *eventBroker) last() uint64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.lastId
+}
+
+// End every stream
+func (b *eventBroker) close() {
+	b.Lock()
+	defer b.Unlock()
+	if !b.closed {
+		close(b.done)
+		b.closed = true
+	}
+}
+
+// Publish events of committed changes to streams and webhooks. Must be called with importMu held,
+// so that events are ordered as the changes
+func (s *Server) publishEvents(events []api.ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	s.webhooks.publish(s.events.publish(events))
+}
+
+
+/*
+ *  Events of changes
+ */
+
+// Event of a city created or updated by a feature, with the properties differing from the city
+// stored before, every property being given for created cities
+func changeEvent(feat *api.Feature, previous *dgclient.CityProps) (api.ChangeEvent, error) {
+	props := &feat.Properties
+	ev := api.ChangeEvent{
+		Type: EventCreated,
+		CartodbId: *props.Cartodb_id,
+		Changes: make(map[string]interface{}),
+	}
+
+	prev := &dgclient.CityProps{}
+	var prevCoords []float64
+	if previous != nil {
+		ev.Type = EventUpdated
+		prev = previous
+		geo, err := dgclient.DecodeGeoDatas(previous.Geo)
+		if err != nil {
+			return ev, err
+		}
+		prevCoords = geo.FlatCoords()
+	}
+
+	add := func(name string, value interface{}, same bool) {
+		if previous == nil || !same {
+			ev.Changes[name] = value
+		}
+	}
+	add("name", props.Name, props.Name == prev.Name)
+	add("place_key", props.Place_key, props.Place_key == prev.Place_key)
+	add("capital", props.Capital, props.Capital == prev.Capital)
+	add("population", props.Population, props.Population == prev.Population)
+	add("pclass", props.Pclass, props.Pclass == prev.Pclass)
+	add("coordinates", feat.Geometry.Coordinates, reflect.DeepEqual(feat.Geometry.Coordinates, prevCoords))
+	add("created_at", props.Created_at, props.Created_at.Equal(prev.Created_at))
+	add("updated_at", props.Updated_at, props.Updated_at.Equal(prev.Updated_at))
+	return ev, nil
+}
+
+func deletedEvents(ids []int64) []api.ChangeEvent {
+	events := make([]api.ChangeEvent, len(ids))
+	for i, id := range ids {
+		events[i] = api.ChangeEvent{Type: EventDeleted, CartodbId: id}
+	}
+	return events
+}
+
+
+/*
+ *  Modifications by other processes
+ */
+
+// Check the dataset version until the server stops, as modifications made by other processes
+// produce no events of their own
+func (s *Server) watchDataset() {
+	ticker := time.NewTicker(datasetWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.events.done:
+			return
+		}
+
+		version, err := s.db.DatasetVersion()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %+v\n", err)
+			continue
+		}
+		s.importMu.Lock()
+		s.datasetVersionSeen(version.Version)
+		s.importMu.Unlock()
+	}
+}
+
+// Publish a reset event when the dataset version is not the last one known by the server, i.e.
+// was bumped by another process. Must be called with importMu held
+func (s *Server) datasetVersionSeen(version int64) {
+	if version <= s.knownVersion {
+		return
+	}
+	s.knownVersion = version
+	s.publishEvents([]api.ChangeEvent{{Type: EventReset}})
+}
+
+
+/*
+ *  Stream
+ */
+
+// Stream change events as Server-Sent Events. Streams start with the next event, or after the
+// event given by the Last-Event-ID header (sent by EventSource when reconnecting) or the
+// last_event_id query string parameter
+func eventsHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			return internalError(errors.New("response writer does not support streaming"))
+		}
+
+		lastId, resume := getQsValues(r).getUInt("last_event_id")
+		if header := r.Header.Get("Last-Event-ID"); header != "" {
+			var err error
+			if lastId, err = strconv.ParseUint(header, 10, 64); err != nil {
+				return &httpRetMsg{
+					http.StatusBadRequest,
+					api.ErrorRep{Error: fmt.Sprintf(ErrInvalidLastEventId, header)},
+				}
+			}
+			resume = true
+		}
+		if !resume {
+			lastId = s.events.last()
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(eventsHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			events, last, missed, changed := s.events.since(lastId)
+			if missed {
+				// Clients must resynchronize, the stream going on with the kept events
+				writeEvent(w, "", "reset", api.ErrorRep{Error: fmt.Sprintf(ErrEventsMissed, lastId)})
+			}
+			for _, ev := range events {
+				writeEvent(w, strconv.FormatUint(ev.Id, 10), ev.Type, ev)
+			}
+			lastId = last
+			flusher.Flush()
+
+			select {
+			case <-changed:
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case <-r.Context().Done():
+				return nil
+			case <-s.events.done:
+				return nil
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, id, name string, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Fail to serialize event: %v\n", err)
+		return
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %v\n", id)
+	}
+	fmt.Fprintf(w, "event: %v\ndata: %s\n\n", name, body)
+}
@@ -0,0 +1,845 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Parser of GraphQL query documents (http://spec.graphql.org/). Type system definitions are
+// not supported, the schema being defined in Go
+
+/*
+ *  Document
+ */
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	// query, mutation or subscription
+	kind       string
+	name       string
+	variables  []*gqlVariableDef
+	selections []*gqlSelection
+	loc        api.GraphQLLocation
+}
+
+type gqlVariableDef struct {
+	name       string
+	typ        *gqlTypeRef
+	def        *gqlValue
+	loc        api.GraphQLLocation
+}
+
+type gqlFragment struct {
+	name       string
+	typeCond   string
+	directives []*gqlDirective
+	selections []*gqlSelection
+	loc        api.GraphQLLocation
+}
+
+type gqlSelectionKind int
+
+const (
+	gqlFieldSelection gqlSelectionKind = iota
+	gqlSpreadSelection
+	gqlInlineSelection
+)
+
+// Field, fragment spread or inline fragment
+type gqlSelection struct {
+	kind       gqlSelectionKind
+	alias      string
+	// Name of the field or of the spread fragment
+	name       string
+	args       []*gqlArgument
+	directives []*gqlDirective
+	// Type condition of inline fragments, none if empty
+	typeCond   string
+	selections []*gqlSelection
+	loc        api.GraphQLLocation
+}
+
+// Key of a field in the reply
+func (sel *gqlSelection) responseKey() string {
+	if sel.alias != "" {
+		return sel.alias
+	}
+	return sel.name
+}
+
+type gqlArgument struct {
+	name       string
+	value      *gqlValue
+	loc        api.GraphQLLocation
+}
+
+type gqlDirective struct {
+	name       string
+	args       []*gqlArgument
+	loc        api.GraphQLLocation
+}
+
+type gqlValueKind int
+
+const (
+	gqlVariableValue gqlValueKind = iota
+	gqlIntValue
+	gqlFloatValue
+	gqlStringValue
+	gqlBooleanValue
+	gqlNullValue
+	gqlEnumValue
+	gqlListValue
+	gqlObjectValue
+)
+
+type gqlValue struct {
+	kind       gqlValueKind
+	// Name of variables and enum values, or literal of scalars
+	raw        string
+	list       []*gqlValue
+	fields     []*gqlArgument
+	loc        api.GraphQLLocation
+}
+
+// Value as written in a document
+func (v *gqlValue) String() string {
+	switch v.kind {
+	case gqlVariableValue:
+		return "$" + v.raw
+	case gqlStringValue:
+		return strconv.Quote(v.raw)
+	case gqlListValue:
+		elems := make([]string, len(v.list))
+		for i, elem := range v.list {
+			elems[i] = elem.String()
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	case gqlObjectValue:
+		fields := make([]string, len(v.fields))
+		for i, field := range v.fields {
+			fields[i] = field.name + ": " + field.value.String()
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	}
+	return v.raw
+}
+
+// Type of a variable or an argument, e.g. [Int!]!
+type gqlTypeRef struct {
+	// Named type, empty for lists
+	name       string
+	elem       *gqlTypeRef
+	nonNull    bool
+}
+
+func (t *gqlTypeRef) String() string {
+	s := t.name
+	if t.elem != nil {
+		s = "[" + t.elem.String() + "]"
+	}
+	if t.nonNull {
+		s += "!"
+	}
+	return s
+}
+
+// Name of the type, or of the type of its elements for lists
+func (t *gqlTypeRef) named() string {
+	if t.elem != nil {
+		return t.elem.named()
+	}
+	return t.name
+}
+
+func (t *gqlTypeRef) isList() bool {
+	return t.elem != nil
+}
+
+// Error at a location of the document
+type gqlError struct {
+	msg string
+	loc api.GraphQLLocation
+}
+
+func (e *gqlError) Error() string {
+	return e.msg
+}
+
+
+/*
+ *  Lexer
+ */
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunctuator
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+	loc   api.GraphQLLocation
+}
+
+func (t gqlToken) String() string {
+	switch t.kind {
+	case gqlEOF:
+		return "<EOF>"
+	case gqlString:
+		return strconv.Quote(t.value)
+	}
+	return "\"" + t.value + "\""
+}
+
+type gqlLexer struct {
+	src  string
+	pos  int
+	line int
+	col  int
+}
+
+func (l *gqlLexer) loc() api.GraphQLLocation {
+	return api.GraphQLLocation{Line: l.line, Column: l.col}
+}
+
+// Advance of one rune, keeping track of lines and columns
+func (l *gqlLexer) advance() {
+	r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+	l.pos += size
+	if r == '\n' {
+		l.line++
+		l.col = 1
+	} else {
+		l.col++
+	}
+}
+
+// Skip ignored tokens: white spaces, line terminators, commas and comments
+func (l *gqlLexer) skipIgnored() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.advance()
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.advance()
+			}
+		case strings.HasPrefix(l.src[l.pos:], "\uFEFF"):
+			l.advance()
+		default:
+			return
+		}
+	}
+}
+
+func (l *gqlLexer) next() (gqlToken, error) {
+	l.skipIgnored()
+	loc := l.loc()
+	if l.pos >= len(l.src) {
+		return gqlToken{gqlEOF, "", loc}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.advance()
+		l.advance()
+		l.advance()
+		return gqlToken{gqlPunctuator, "...", loc}, nil
+	case strings.IndexByte("!$():=@[]{|}", c) >= 0:
+		l.advance()
+		return gqlToken{gqlPunctuator, string(c), loc}, nil
+	case c == '_' || isLetter(c):
+		start := l.pos
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.advance()
+		}
+		return gqlToken{gqlName, l.src[start:l.pos], loc}, nil
+	case c == '-' || isDigit(c):
+		return l.number(loc)
+	case c == '"':
+		if strings.HasPrefix(l.src[l.pos:], `"""`) {
+			return l.blockString(loc)
+		}
+		return l.string(loc)
+	}
+
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+	return gqlToken{}, &gqlError{fmt.Sprintf(ErrGraphQLUnexpectedChar, string(r)), loc}
+}
+
+func (l *gqlLexer) number(loc api.GraphQLLocation) (gqlToken, error) {
+	start := l.pos
+	kind := gqlInt
+	digits := func() int {
+		n := 0
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.advance()
+			n++
+		}
+		return n
+	}
+
+	if l.src[l.pos] == '-' {
+		l.advance()
+	}
+	if digits() == 0 {
+		return gqlToken{}, &gqlError{fmt.Sprintf(ErrGraphQLInvalidNumber, l.src[start:l.pos]), loc}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		kind = gqlFloat
+		l.advance()
+		if digits() == 0 {
+			return gqlToken{}, &gqlError{fmt.Sprintf(ErrGraphQLInvalidNumber, l.src[start:l.pos]), loc}
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		kind = gqlFloat
+		l.advance()
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.advance()
+		}
+		if digits() == 0 {
+			return gqlToken{}, &gqlError{fmt.Sprintf(ErrGraphQLInvalidNumber, l.src[start:l.pos]), loc}
+		}
+	}
+	// A number must not be directly followed by a name
+	if l.pos < len(l.src) && (l.src[l.pos] == '_' || l.src[l.pos] == '.' || isLetter(l.src[l.pos])) {
+		return gqlToken{}, &gqlError{fmt.Sprintf(ErrGraphQLInvalidNumber, l.src[start:l.pos + 1]), loc}
+	}
+	return gqlToken{kind, l.src[start:l.pos], loc}, nil
+}
+
+func (l *gqlLexer) string(loc api.GraphQLLocation) (gqlToken, error) {
+	l.advance()
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' || l.src[l.pos] == '\r' {
+			return gqlToken{}, &gqlError{ErrGraphQLUnterminatedString, loc}
+		}
+
+		c := l.src[l.pos]
+		if c == '"' {
+			l.advance()
+			return gqlToken{gqlString, b.String(), loc}, nil
+		}
+		if c != '\\' {
+			r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+			b.WriteRune(r)
+			l.advance()
+			continue
+		}
+
+		escLoc := l.loc()
+		l.advance()
+		if l.pos >= len(l.src) {
+			return gqlToken{}, &gqlError{ErrGraphQLUnterminatedString, loc}
+		}
+		esc := l.src[l.pos]
+		l.advance()
+		switch esc {
+		case '"', '\\', '/':
+			b.WriteByte(esc)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if l.pos + 4 > len(l.src) {
+				return gqlToken{}, &gqlError{ErrGraphQLUnterminatedString, loc}
+			}
+			code, err := strconv.ParseUint(l.src[l.pos:l.pos + 4], 16, 16)
+			if err != nil {
+				return gqlToken{}, &gqlError{fmt.Sprintf(ErrGraphQLInvalidEscape, "\\u" + l.src[l.pos:l.pos + 4]), escLoc}
+			}
+			for i := 0; i < 4; i++ {
+				l.advance()
+			}
+			b.WriteRune(rune(code))
+		default:
+			return gqlToken{}, &gqlError{fmt.Sprintf(ErrGraphQLInvalidEscape, "\\" + string(esc)), escLoc}
+		}
+	}
+}
+
+// Block strings are taken as is, without removing their common indentation
+func (l *gqlLexer) blockString(loc api.GraphQLLocation) (gqlToken, error) {
+	for i := 0; i < 3; i++ {
+		l.advance()
+	}
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		if strings.HasPrefix(l.src[l.pos:], `"""`) {
+			for i := 0; i < 3; i++ {
+				l.advance()
+			}
+			return gqlToken{gqlString, b.String(), loc}, nil
+		}
+		if strings.HasPrefix(l.src[l.pos:], `\"""`) {
+			b.WriteString(`"""`)
+			for i := 0; i < 4; i++ {
+				l.advance()
+			}
+			continue
+		}
+		r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+		b.WriteRune(r)
+		l.advance()
+	}
+	return gqlToken{}, &gqlError{ErrGraphQLUnterminatedString, loc}
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+
+/*
+ *  Parser
+ */
+
+type gqlParser struct {
+	lex *gqlLexer
+	tok gqlToken
+}
+
+// Parse a query document
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{lex: &gqlLexer{src: src, line: 1, col: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.tok.kind != gqlEOF {
+		if p.peekName("fragment") {
+			frag, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := doc.fragments[frag.name]; ok {
+				return nil, &gqlError{fmt.Sprintf(ErrGraphQLDuplicateFragment, frag.name), frag.loc}
+			}
+			doc.fragments[frag.name] = frag
+			continue
+		}
+
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		doc.operations = append(doc.operations, op)
+	}
+
+	if len(doc.operations) == 0 {
+		return nil, &gqlError{ErrGraphQLNoOperation, p.tok.loc}
+	}
+	return doc, nil
+}
+
+// Parse a type reference, e.g. of a variable
+func parseGraphQLType(src string) (*gqlTypeRef, error) {
+	p := &gqlParser{lex: &gqlLexer{src: src, line: 1, col: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	t, err := p.typeRef()
+	if err == nil && p.tok.kind != gqlEOF {
+		err = p.unexpected()
+	}
+	return t, err
+}
+
+func (p *gqlParser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *gqlParser) unexpected() error {
+	return &gqlError{fmt.Sprintf(ErrGraphQLUnexpectedToken, p.tok), p.tok.loc}
+}
+
+func (p *gqlParser) peek(punct string) bool {
+	return p.tok.kind == gqlPunctuator && p.tok.value == punct
+}
+
+func (p *gqlParser) peekName(name string) bool {
+	return p.tok.kind == gqlName && p.tok.value == name
+}
+
+// Consume the expected punctuator
+func (p *gqlParser) expect(punct string) error {
+	if !p.peek(punct) {
+		return &gqlError{fmt.Sprintf(ErrGraphQLExpected, "\"" + punct + "\"", p.tok), p.tok.loc}
+	}
+	return p.advance()
+}
+
+// Consume the punctuator if present
+func (p *gqlParser) skip(punct string) (bool, error) {
+	if !p.peek(punct) {
+		return false, nil
+	}
+	return true, p.advance()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != gqlName {
+		return "", &gqlError{fmt.Sprintf(ErrGraphQLExpected, "name", p.tok), p.tok.loc}
+	}
+	name := p.tok.value
+	return name, p.advance()
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: "query", loc: p.tok.loc}
+	if p.peek("{") {
+		var err error
+		op.selections, err = p.selectionSet()
+		return op, err
+	}
+
+	if !p.peekName("query") && !p.peekName("mutation") && !p.peekName("subscription") {
+		return nil, p.unexpected()
+	}
+	op.kind = p.tok.value
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if p.tok.kind == gqlName {
+		if op.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek("(") {
+		if op.variables, err = p.variableDefs(); err != nil {
+			return nil, err
+		}
+	}
+	// Directives of operations are parsed but have no effect
+	if _, err = p.directives(); err != nil {
+		return nil, err
+	}
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+func (p *gqlParser) variableDefs() ([]*gqlVariableDef, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var defs []*gqlVariableDef
+	for {
+		def := &gqlVariableDef{loc: p.tok.loc}
+		if err := p.expect("$"); err != nil {
+			return nil, err
+		}
+		var err error
+		if def.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if err = p.expect(":"); err != nil {
+			return nil, err
+		}
+		if def.typ, err = p.typeRef(); err != nil {
+			return nil, err
+		}
+		if ok, err := p.skip("="); err != nil {
+			return nil, err
+		} else if ok {
+			if def.def, err = p.value(true); err != nil {
+				return nil, err
+			}
+		}
+		defs = append(defs, def)
+
+		if ok, err := p.skip(")"); err != nil || ok {
+			return defs, err
+		}
+	}
+}
+
+func (p *gqlParser) typeRef() (*gqlTypeRef, error) {
+	t := &gqlTypeRef{}
+	if ok, err := p.skip("["); err != nil {
+		return nil, err
+	} else if ok {
+		if t.elem, err = p.typeRef(); err != nil {
+			return nil, err
+		}
+		if err = p.expect("]"); err != nil {
+			return nil, err
+		}
+	} else if t.name, err = p.name(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	t.nonNull, err = p.skip("!")
+	return t, err
+}
+
+func (p *gqlParser) fragment() (*gqlFragment, error) {
+	frag := &gqlFragment{loc: p.tok.loc}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var err error
+	if frag.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if frag.name == "on" {
+		return nil, &gqlError{fmt.Sprintf(ErrGraphQLUnexpectedToken, "\"on\""), frag.loc}
+	}
+	if !p.peekName("on") {
+		return nil, &gqlError{fmt.Sprintf(ErrGraphQLExpected, "\"on\"", p.tok), p.tok.loc}
+	}
+	if err = p.advance(); err != nil {
+		return nil, err
+	}
+	if frag.typeCond, err = p.name(); err != nil {
+		return nil, err
+	}
+	if frag.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	frag.selections, err = p.selectionSet()
+	return frag, err
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sels []*gqlSelection
+	for {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+
+		if ok, err := p.skip("}"); err != nil || ok {
+			return sels, err
+		}
+	}
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	sel := &gqlSelection{loc: p.tok.loc}
+	var err error
+
+	if ok, err := p.skip("..."); err != nil {
+		return nil, err
+	} else if ok {
+		if p.tok.kind == gqlName && !p.peekName("on") {
+			sel.kind = gqlSpreadSelection
+			if sel.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			sel.directives, err = p.directives()
+			return sel, err
+		}
+
+		sel.kind = gqlInlineSelection
+		if p.peekName("on") {
+			if err = p.advance(); err != nil {
+				return nil, err
+			}
+			if sel.typeCond, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if sel.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		sel.selections, err = p.selectionSet()
+		return sel, err
+	}
+
+	sel.kind = gqlFieldSelection
+	if sel.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if ok, err := p.skip(":"); err != nil {
+		return nil, err
+	} else if ok {
+		sel.alias = sel.name
+		if sel.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek("(") {
+		if sel.args, err = p.arguments(false); err != nil {
+			return nil, err
+		}
+	}
+	if sel.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.peek("{") {
+		sel.selections, err = p.selectionSet()
+	}
+	return sel, err
+}
+
+func (p *gqlParser) arguments(isConst bool) ([]*gqlArgument, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []*gqlArgument
+	for {
+		arg, err := p.argument(isConst)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		if ok, err := p.skip(")"); err != nil || ok {
+			return args, err
+		}
+	}
+}
+
+// Argument or field of an object value
+func (p *gqlParser) argument(isConst bool) (*gqlArgument, error) {
+	arg := &gqlArgument{loc: p.tok.loc}
+	var err error
+	if arg.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if err = p.expect(":"); err != nil {
+		return nil, err
+	}
+	arg.value, err = p.value(isConst)
+	return arg, err
+}
+
+func (p *gqlParser) directives() ([]*gqlDirective, error) {
+	var dirs []*gqlDirective
+	for p.peek("@") {
+		dir := &gqlDirective{loc: p.tok.loc}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		var err error
+		if dir.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if p.peek("(") {
+			if dir.args, err = p.arguments(false); err != nil {
+				return nil, err
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// Parse a value, variables being refused in constant values like default values of variables
+func (p *gqlParser) value(isConst bool) (*gqlValue, error) {
+	v := &gqlValue{raw: p.tok.value, loc: p.tok.loc}
+	switch p.tok.kind {
+	case gqlInt:
+		v.kind = gqlIntValue
+	case gqlFloat:
+		v.kind = gqlFloatValue
+	case gqlString:
+		v.kind = gqlStringValue
+	case gqlName:
+		switch p.tok.value {
+		case "true", "false":
+			v.kind = gqlBooleanValue
+		case "null":
+			v.kind = gqlNullValue
+		default:
+			v.kind = gqlEnumValue
+		}
+	case gqlPunctuator:
+		switch p.tok.value {
+		case "$":
+			if isConst {
+				return nil, p.unexpected()
+			}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			v.kind = gqlVariableValue
+			var err error
+			v.raw, err = p.name()
+			return v, err
+		case "[":
+			return p.listValue(v, isConst)
+		case "{":
+			return p.objectValue(v, isConst)
+		}
+		return nil, p.unexpected()
+	default:
+		return nil, p.unexpected()
+	}
+	return v, p.advance()
+}
+
+func (p *gqlParser) listValue(v *gqlValue, isConst bool) (*gqlValue, error) {
+	v.kind = gqlListValue
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	for {
+		if ok, err := p.skip("]"); err != nil || ok {
+			return v, err
+		}
+		elem, err := p.value(isConst)
+		if err != nil {
+			return nil, err
+		}
+		v.list = append(v.list, elem)
+	}
+}
+
+func (p *gqlParser) objectValue(v *gqlValue, isConst bool) (*gqlValue, error) {
+	v.kind = gqlObjectValue
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	for {
+		if ok, err := p.skip("}"); err != nil || ok {
+			return v, err
+		}
+		field, err := p.argument(isConst)
+		if err != nil {
+			return nil, err
+		}
+		v.fields = append(v.fields, field)
+	}
+}
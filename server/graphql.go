@@ -0,0 +1,1066 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/AsT4re/cancities/dgclient"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Maximum size (in bytes) of GraphQL request bodies
+const MaxGraphQLBodySize = 64 * 1024
+
+// Maximum number of selections of a query once its fragments are spread, bounding the work of
+// validating fragments spread several times by other ones
+const maxGraphQLSelections = 10000
+
+// Default number of neighbours of a city
+const DefaultNeighbours = 10
+
+// Complexity added by each field resolved by a DGraph query, so that complexity bounds the
+// number of queries of a request
+const gqlQueryCost = 100
+
+
+/*
+ *  Schema
+ */
+
+type gqlArgDef struct {
+	name string
+	typ  *gqlTypeRef
+	// Coerced default value, none if nil
+	def  interface{}
+}
+
+// Value of a field from the one of its parent object and its coerced arguments
+type gqlResolver func(s *Server, parent interface{}, args map[string]interface{}) (interface{}, error)
+
+type gqlFieldDef struct {
+	name    string
+	doc     string
+	args    []gqlArgDef
+	typ     *gqlTypeRef
+	resolve gqlResolver
+	// Complexity added to the one of the field itself
+	cost    uint64
+}
+
+type gqlObjectDef struct {
+	name   string
+	doc    string
+	fields []*gqlFieldDef
+}
+
+func (o *gqlObjectDef) field(name string) *gqlFieldDef {
+	for _, f := range o.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+type gqlInputDef struct {
+	name   string
+	doc    string
+	fields []gqlArgDef
+}
+
+type gqlSchema struct {
+	query   *gqlObjectDef
+	objects map[string]*gqlObjectDef
+	inputs  map[string]*gqlInputDef
+}
+
+var gqlScalars = map[string]bool{"Int": true, "Float": true, "String": true, "Boolean": true}
+
+var graphQLSchema = newGraphQLSchema()
+
+// Type reference of the schema, written in Go
+func gqlType(s string) *gqlTypeRef {
+	t, err := parseGraphQLType(s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func newGraphQLSchema() *gqlSchema {
+	filters := &gqlInputDef{
+		name: "CityFilters",
+		doc: "Filters of the cities of a search, bounds being included",
+		fields: []gqlArgDef{
+			{name: "minPopulation", typ: gqlType("Int")},
+			{name: "maxPopulation", typ: gqlType("Int")},
+		},
+	}
+
+	city := &gqlObjectDef{name: "City", doc: "City of Canada"}
+	city.fields = []*gqlFieldDef{
+		{name: "cartodbId", typ: gqlType("Int!"),
+			resolve: cityResolver(func(c *api.CityTempl) interface{} { return c.CartodbId })},
+		{name: "name", typ: gqlType("String!"),
+			resolve: cityResolver(func(c *api.CityTempl) interface{} { return c.Name })},
+		{name: "population", typ: gqlType("Int!"),
+			resolve: cityResolver(func(c *api.CityTempl) interface{} { return c.Population })},
+		{name: "longitude", typ: gqlType("Float!"),
+			resolve: cityResolver(func(c *api.CityTempl) interface{} { return c.Coordinates[0] })},
+		{name: "latitude", typ: gqlType("Float!"),
+			resolve: cityResolver(func(c *api.CityTempl) interface{} { return c.Coordinates[1] })},
+		{
+			name: "neighbours",
+			doc: "Other cities within radius (in kilometers) of the city, nearest first, as they were at the asOf time of the city",
+			args: []gqlArgDef{
+				{name: "radius", typ: gqlType("Int!")},
+				{name: "filters", typ: gqlType("CityFilters")},
+				{name: "limit", typ: gqlType("Int!"), def: int64(DefaultNeighbours)},
+			},
+			typ: gqlType("[City!]"),
+			resolve: gqlNeighbours,
+			cost: gqlQueryCost,
+		},
+	}
+
+	query := &gqlObjectDef{name: "Query", doc: "Read only queries of cities"}
+	query.fields = []*gqlFieldDef{
+		{
+			name: "city",
+			doc: "Get a city by id, as it was at the RFC 3339 time asOf if given, null if not found",
+			args: []gqlArgDef{
+				{name: "id", typ: gqlType("Int!")},
+				{name: "asOf", typ: gqlType("String")},
+			},
+			typ: gqlType("City"),
+			resolve: gqlCity,
+			cost: gqlQueryCost,
+		},
+		{
+			name: "citiesNear",
+			doc: "Get the cities within radius (in kilometers) of a location, nearest first, as they were at the RFC 3339 time asOf if given",
+			args: []gqlArgDef{
+				{name: "lon", typ: gqlType("Float!")},
+				{name: "lat", typ: gqlType("Float!")},
+				{name: "radius", typ: gqlType("Int!")},
+				{name: "filters", typ: gqlType("CityFilters")},
+				{name: "limit", typ: gqlType("Int!"), def: int64(DefaultPageSize)},
+				{name: "asOf", typ: gqlType("String")},
+			},
+			typ: gqlType("[City!]"),
+			resolve: gqlCitiesNear,
+			cost: gqlQueryCost,
+		},
+		{
+			name: "searchCities",
+			doc: "Get the current cities whose name holds every term of the given name, case insensitive, past names not being searchable",
+			args: []gqlArgDef{
+				{name: "name", typ: gqlType("String!")},
+				{name: "limit", typ: gqlType("Int!"), def: int64(DefaultPageSize)},
+			},
+			typ: gqlType("[City!]"),
+			resolve: gqlSearchCities,
+			cost: gqlQueryCost,
+		},
+	}
+
+	schema := &gqlSchema{
+		query: query,
+		objects: map[string]*gqlObjectDef{query.name: query, city.name: city},
+		inputs: map[string]*gqlInputDef{filters.name: filters},
+	}
+	for _, obj := range schema.objects {
+		name := obj.name
+		obj.fields = append(obj.fields, &gqlFieldDef{
+			name: "__typename",
+			typ: gqlType("String!"),
+			resolve: func(*Server, interface{}, map[string]interface{}) (interface{}, error) {
+				return name, nil
+			},
+		})
+	}
+	return schema
+}
+
+// Schema in the GraphQL schema definition language, fields starting with "__" being implicit
+func (schema *gqlSchema) sdl() string {
+	var b bytes.Buffer
+	writeDoc := func(indent, doc string) {
+		if doc != "" {
+			fmt.Fprintf(&b, "%v%v\n", indent, strconv.Quote(doc))
+		}
+	}
+	writeArg := func(arg gqlArgDef) {
+		fmt.Fprintf(&b, "%v: %v", arg.name, arg.typ)
+		if arg.def != nil {
+			def, _ := json.Marshal(arg.def)
+			fmt.Fprintf(&b, " = %s", def)
+		}
+	}
+
+	objects := []*gqlObjectDef{schema.query}
+	for _, obj := range schema.objects {
+		if obj != schema.query {
+			objects = append(objects, obj)
+		}
+	}
+	sort.SliceStable(objects[1:], func(i, j int) bool { return objects[i + 1].name < objects[j + 1].name })
+	for _, obj := range objects {
+		writeDoc("", obj.doc)
+		fmt.Fprintf(&b, "type %v {\n", obj.name)
+		for _, f := range obj.fields {
+			if strings.HasPrefix(f.name, "__") {
+				continue
+			}
+			writeDoc("  ", f.doc)
+			fmt.Fprintf(&b, "  %v", f.name)
+			if len(f.args) > 0 {
+				b.WriteString("(")
+				for i, arg := range f.args {
+					if i > 0 {
+						b.WriteString(", ")
+					}
+					writeArg(arg)
+				}
+				b.WriteString(")")
+			}
+			fmt.Fprintf(&b, ": %v\n", f.typ)
+		}
+		b.WriteString("}\n\n")
+	}
+
+	var inputs []string
+	for name := range schema.inputs {
+		inputs = append(inputs, name)
+	}
+	sort.Strings(inputs)
+	for _, name := range inputs {
+		input := schema.inputs[name]
+		writeDoc("", input.doc)
+		fmt.Fprintf(&b, "input %v {\n", input.name)
+		for _, f := range input.fields {
+			b.WriteString("  ")
+			writeArg(f)
+			b.WriteString("\n")
+		}
+		b.WriteString("}\n\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+
+/*
+ *  Handlers
+ */
+
+func graphqlHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxGraphQLBodySize + 1))
+		if err != nil {
+			return internalError(errors.Wrap(err, "Error reading body:"))
+		}
+		if err = r.Body.Close(); err != nil {
+			return internalError(errors.Wrap(err, "Error closing pipe:"))
+		}
+		if len(body) > MaxGraphQLBodySize {
+			return &httpRetMsg{
+				http.StatusRequestEntityTooLarge,
+				gqlErrors(errors.Errorf(ErrGraphQLBodyTooLarge, MaxGraphQLBodySize)),
+			}
+		}
+
+		// Numbers of variables are kept as written, for coercing them to Int or Float
+		var req api.GraphQLReq
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err = dec.Decode(&req); err != nil {
+			return &httpRetMsg{
+				http.StatusBadRequest,
+				gqlErrors(errors.Errorf(ErrGraphQLInvalidBody, err)),
+			}
+		}
+
+		return execGraphQL(s, req)
+	}
+}
+
+func graphqlSchemaHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		return &httpRetMsg{
+			http.StatusOK,
+			api.GraphQLSchemaRep{Schema: graphQLSchema.sdl()},
+		}
+	}
+}
+
+// Reply of a request failing before execution
+func gqlErrors(err error) api.GraphQLRep {
+	gqlErr := api.GraphQLError{Message: err.Error()}
+	if e, ok := err.(*gqlError); ok {
+		gqlErr.Locations = []api.GraphQLLocation{e.loc}
+	}
+	return api.GraphQLRep{Errors: []api.GraphQLError{gqlErr}}
+}
+
+
+/*
+ *  Validation
+ */
+
+// Field to resolve, with its coerced arguments and the fields selected on its value
+type gqlField struct {
+	key    string
+	def    *gqlFieldDef
+	args   map[string]interface{}
+	// Selected fields, nil for scalar fields
+	fields []*gqlField
+	loc    api.GraphQLLocation
+}
+
+// Validation and execution state of a request
+type gqlRequest struct {
+	s          *Server
+	doc        *gqlDocument
+	varDefs    map[string]*gqlVariableDef
+	vars       map[string]interface{}
+	// Fragments being spread, for detecting cycles
+	spreading  map[string]bool
+	selections int
+	errors     []api.GraphQLError
+}
+
+var gqlDirectiveArgs = []gqlArgDef{{name: "if", typ: gqlType("Boolean!")}}
+
+// Validate then execute a request. Invalid requests are replied with a 400 and nothing is
+// executed, while errors of fields are replied with the data of the other fields
+func execGraphQL(s *Server, req api.GraphQLReq) *httpRetMsg {
+	invalid := func(err error) *httpRetMsg {
+		return &httpRetMsg{http.StatusBadRequest, gqlErrors(err)}
+	}
+
+	if strings.TrimSpace(req.Query) == "" {
+		return invalid(errors.New(ErrGraphQLMissingQuery))
+	}
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return invalid(err)
+	}
+	op, err := selectOperation(doc, req.OperationName)
+	if err != nil {
+		return invalid(err)
+	}
+	if op.kind != "query" {
+		return invalid(&gqlError{fmt.Sprintf(ErrGraphQLUnsupportedOperation, op.kind), op.loc})
+	}
+
+	r := &gqlRequest{s: s, doc: doc, spreading: make(map[string]bool)}
+	if err = r.coerceVariables(op.variables, req.Variables); err != nil {
+		return invalid(err)
+	}
+	var fields []*gqlField
+	if err = r.collectFields(graphQLSchema.query, op.selections, 1, &fields); err != nil {
+		return invalid(err)
+	}
+	if c := gqlComplexity(fields); c > uint64(s.config.GraphQLMaxComplexity) {
+		return invalid(errors.Errorf(ErrGraphQLMaxComplexity, c, s.config.GraphQLMaxComplexity))
+	}
+
+	data := r.execute(nil, fields, nil)
+	return &httpRetMsg{
+		http.StatusOK,
+		api.GraphQLRep{Data: data, Errors: r.errors},
+	}
+}
+
+func selectOperation(doc *gqlDocument, name string) (*gqlOperation, error) {
+	if name == "" {
+		if len(doc.operations) > 1 {
+			return nil, errors.New(ErrGraphQLOperationName)
+		}
+		return doc.operations[0], nil
+	}
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, errors.Errorf(ErrGraphQLUnknownOperation, name)
+}
+
+// Coerce the values of the variables of the operation, from the JSON decoded ones of the request
+func (r *gqlRequest) coerceVariables(defs []*gqlVariableDef, values map[string]interface{}) error {
+	r.varDefs = make(map[string]*gqlVariableDef)
+	r.vars = make(map[string]interface{})
+	for _, def := range defs {
+		if _, ok := r.varDefs[def.name]; ok {
+			return &gqlError{fmt.Sprintf(ErrGraphQLDuplicateVariable, def.name), def.loc}
+		}
+		r.varDefs[def.name] = def
+
+		name := def.typ.named()
+		if !gqlScalars[name] && graphQLSchema.inputs[name] == nil {
+			if graphQLSchema.objects[name] == nil {
+				return &gqlError{fmt.Sprintf(ErrGraphQLUnknownType, name), def.loc}
+			}
+			return &gqlError{fmt.Sprintf(ErrGraphQLVariableInputType, def.name, def.typ), def.loc}
+		}
+
+		value, ok := values[def.name]
+		var err error
+		switch {
+		case ok:
+			if value, err = coerceJSON(value, def.typ); err != nil {
+				return &gqlError{fmt.Sprintf(ErrGraphQLInvalidVariable, def.name, err), def.loc}
+			}
+		case def.def != nil:
+			// Default values are constant, no variable is looked up
+			if value, err = r.coerceLiteral(def.def, def.typ); err != nil {
+				return err
+			}
+		case def.typ.nonNull:
+			return &gqlError{fmt.Sprintf(ErrGraphQLMissingVariable, def.name, def.typ), def.loc}
+		default:
+			continue
+		}
+		r.vars[def.name] = value
+	}
+	return nil
+}
+
+// Collect the fields selected on an object type, spreading fragments and merging the fields of
+// a same response key. Depth is the one of the selected fields, root fields being at depth 1
+func (r *gqlRequest) collectFields(obj *gqlObjectDef, sels []*gqlSelection, depth uint,
+                                   fields *[]*gqlField) error {
+	if depth > r.s.config.GraphQLMaxDepth {
+		return &gqlError{fmt.Sprintf(ErrGraphQLMaxDepth, r.s.config.GraphQLMaxDepth), sels[0].loc}
+	}
+
+	for _, sel := range sels {
+		if r.selections++; r.selections > maxGraphQLSelections {
+			return &gqlError{fmt.Sprintf(ErrGraphQLTooManySelections, maxGraphQLSelections), sel.loc}
+		}
+		skip, err := r.skipped(sel.directives)
+		if err != nil {
+			return err
+		}
+		if skip {
+			continue
+		}
+
+		switch sel.kind {
+		case gqlFieldSelection:
+			err = r.collectField(obj, sel, depth, fields)
+		case gqlSpreadSelection:
+			frag, ok := r.doc.fragments[sel.name]
+			if !ok {
+				return &gqlError{fmt.Sprintf(ErrGraphQLUnknownFragment, sel.name), sel.loc}
+			}
+			if r.spreading[sel.name] {
+				return &gqlError{fmt.Sprintf(ErrGraphQLFragmentCycle, sel.name), sel.loc}
+			}
+			if err = checkTypeCondition(obj, frag.typeCond, frag.loc); err != nil {
+				return err
+			}
+			r.spreading[sel.name] = true
+			err = r.collectFields(obj, frag.selections, depth, fields)
+			delete(r.spreading, sel.name)
+		case gqlInlineSelection:
+			if sel.typeCond != "" {
+				if err = checkTypeCondition(obj, sel.typeCond, sel.loc); err != nil {
+					return err
+				}
+			}
+			err = r.collectFields(obj, sel.selections, depth, fields)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *gqlRequest) collectField(obj *gqlObjectDef, sel *gqlSelection, depth uint, fields *[]*gqlField) error {
+	def := obj.field(sel.name)
+	if def == nil {
+		return &gqlError{fmt.Sprintf(ErrGraphQLUnknownField, sel.name, obj.name), sel.loc}
+	}
+	args, err := r.coerceArgs(def.args, sel.args, "field '" + sel.name + "'", sel.loc)
+	if err != nil {
+		return err
+	}
+
+	// Fields of a same response key are merged when they are the same field with the same arguments
+	var field *gqlField
+	for _, f := range *fields {
+		if f.key == sel.responseKey() {
+			field = f
+			break
+		}
+	}
+	if field == nil {
+		field = &gqlField{key: sel.responseKey(), def: def, args: args, loc: sel.loc}
+		*fields = append(*fields, field)
+	} else if field.def != def || !reflect.DeepEqual(field.args, args) {
+		return &gqlError{fmt.Sprintf(ErrGraphQLFieldConflict, field.key), sel.loc}
+	}
+
+	sub := graphQLSchema.objects[def.typ.named()]
+	switch {
+	case sub == nil && sel.selections != nil:
+		return &gqlError{fmt.Sprintf(ErrGraphQLNoSelection, sel.name, def.typ), sel.loc}
+	case sub != nil && sel.selections == nil:
+		return &gqlError{fmt.Sprintf(ErrGraphQLSelectionRequired, sel.name, def.typ), sel.loc}
+	case sub != nil:
+		if field.fields == nil {
+			field.fields = []*gqlField{}
+		}
+		return r.collectFields(sub, sel.selections, depth + 1, &field.fields)
+	}
+	return nil
+}
+
+// Fragments only apply to object types, whose type condition is their own name
+func checkTypeCondition(obj *gqlObjectDef, typeCond string, loc api.GraphQLLocation) error {
+	if graphQLSchema.objects[typeCond] == nil {
+		return &gqlError{fmt.Sprintf(ErrGraphQLUnknownType, typeCond), loc}
+	}
+	if typeCond != obj.name {
+		return &gqlError{fmt.Sprintf(ErrGraphQLFragmentType, typeCond, obj.name), loc}
+	}
+	return nil
+}
+
+// Whether a selection is excluded by @skip or @include directives
+func (r *gqlRequest) skipped(dirs []*gqlDirective) (bool, error) {
+	for _, dir := range dirs {
+		if dir.name != "skip" && dir.name != "include" {
+			return false, &gqlError{fmt.Sprintf(ErrGraphQLUnknownDirective, dir.name), dir.loc}
+		}
+		args, err := r.coerceArgs(gqlDirectiveArgs, dir.args, "directive '@" + dir.name + "'", dir.loc)
+		if err != nil {
+			return false, err
+		}
+		if args["if"].(bool) == (dir.name == "skip") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Coerce the arguments of a field or directive, or the fields of an input object. Arguments
+// neither given nor with a default value are left out
+func (r *gqlRequest) coerceArgs(defs []gqlArgDef, args []*gqlArgument, owner string,
+                                loc api.GraphQLLocation) (map[string]interface{}, error) {
+	given := make(map[string]*gqlArgument)
+	for _, arg := range args {
+		if gqlArgDefByName(defs, arg.name) == nil {
+			return nil, &gqlError{fmt.Sprintf(ErrGraphQLUnknownArgument, arg.name, owner), arg.loc}
+		}
+		if _, ok := given[arg.name]; ok {
+			return nil, &gqlError{fmt.Sprintf(ErrGraphQLDuplicateArgument, arg.name, owner), arg.loc}
+		}
+		given[arg.name] = arg
+	}
+
+	res := make(map[string]interface{})
+	for _, def := range defs {
+		arg, ok := given[def.name]
+		if ok && arg.value.kind == gqlVariableValue {
+			value, set, err := r.variable(arg.value, def.typ, def.def != nil)
+			if err != nil {
+				return nil, err
+			}
+			if set {
+				res[def.name] = value
+				continue
+			}
+			// Arguments of unset variables are handled as not given
+			ok = false
+		}
+
+		switch {
+		case ok:
+			value, err := r.coerceLiteral(arg.value, def.typ)
+			if err != nil {
+				return nil, err
+			}
+			res[def.name] = value
+		case def.def != nil:
+			res[def.name] = def.def
+		case def.typ.nonNull:
+			return nil, &gqlError{fmt.Sprintf(ErrGraphQLMissingArgument, def.name, def.typ, owner), loc}
+		}
+	}
+	return res, nil
+}
+
+func gqlArgDefByName(defs []gqlArgDef, name string) *gqlArgDef {
+	for i := range defs {
+		if defs[i].name == name {
+			return &defs[i]
+		}
+	}
+	return nil
+}
+
+// Value of a variable used where typ is expected, and whether the variable is set
+func (r *gqlRequest) variable(v *gqlValue, typ *gqlTypeRef, hasDefault bool) (interface{}, bool, error) {
+	def, ok := r.varDefs[v.raw]
+	if !ok {
+		return nil, false, &gqlError{fmt.Sprintf(ErrGraphQLUnknownVariable, v.raw), v.loc}
+	}
+	if !gqlTypeCompatible(def.typ, typ, def.def != nil || hasDefault) {
+		return nil, false, &gqlError{fmt.Sprintf(ErrGraphQLVariableType, v.raw, def.typ, typ), v.loc}
+	}
+
+	value, set := r.vars[v.raw]
+	if set && value == nil && typ.nonNull {
+		return nil, false, &gqlError{fmt.Sprintf(ErrGraphQLExpectedType, typ, "null"), v.loc}
+	}
+	return value, set, nil
+}
+
+// Whether a variable of type varType may be used where locType is expected, nullable variables
+// being allowed in non null positions when a default value applies
+func gqlTypeCompatible(varType, locType *gqlTypeRef, hasDefault bool) bool {
+	if locType.nonNull && !varType.nonNull && hasDefault {
+		nullable := *locType
+		nullable.nonNull = false
+		locType = &nullable
+	}
+	if locType.nonNull {
+		if !varType.nonNull {
+			return false
+		}
+	} else if varType.nonNull {
+		nullable := *varType
+		nullable.nonNull = false
+		varType = &nullable
+	}
+
+	if locType.isList() {
+		return varType.isList() && gqlTypeCompatible(varType.elem, locType.elem, false)
+	}
+	return !varType.isList() && varType.name == locType.name
+}
+
+// Coerce a value written in the document, Int being 32 bits integers as in the specification
+func (r *gqlRequest) coerceLiteral(v *gqlValue, typ *gqlTypeRef) (interface{}, error) {
+	if v.kind == gqlVariableValue {
+		value, _, err := r.variable(v, typ, false)
+		return value, err
+	}
+
+	mismatch := &gqlError{fmt.Sprintf(ErrGraphQLExpectedType, typ, v), v.loc}
+	if v.kind == gqlNullValue {
+		if typ.nonNull {
+			return nil, mismatch
+		}
+		return nil, nil
+	}
+
+	if typ.isList() {
+		list := v.list
+		if v.kind != gqlListValue {
+			// Single values are coerced to lists of one value
+			list = []*gqlValue{v}
+		}
+		res := make([]interface{}, len(list))
+		for i, elem := range list {
+			var err error
+			if res[i], err = r.coerceLiteral(elem, typ.elem); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+
+	switch typ.name {
+	case "Int":
+		if v.kind == gqlIntValue {
+			if i, err := strconv.ParseInt(v.raw, 10, 32); err == nil {
+				return i, nil
+			}
+		}
+	case "Float":
+		if v.kind == gqlIntValue || v.kind == gqlFloatValue {
+			if f, err := strconv.ParseFloat(v.raw, 64); err == nil {
+				return f, nil
+			}
+		}
+	case "String":
+		if v.kind == gqlStringValue {
+			return v.raw, nil
+		}
+	case "Boolean":
+		if v.kind == gqlBooleanValue {
+			return v.raw == "true", nil
+		}
+	default:
+		if input := graphQLSchema.inputs[typ.name]; input != nil && v.kind == gqlObjectValue {
+			return r.coerceArgs(input.fields, v.fields, "input type '" + input.name + "'", v.loc)
+		}
+	}
+	return nil, mismatch
+}
+
+// Coerce the JSON decoded value of a variable, numbers being decoded as json.Number
+func coerceJSON(value interface{}, typ *gqlTypeRef) (interface{}, error) {
+	mismatch := func() error {
+		found, _ := json.Marshal(value)
+		return errors.Errorf(ErrGraphQLExpectedType, typ, string(found))
+	}
+	if value == nil {
+		if typ.nonNull {
+			return nil, mismatch()
+		}
+		return nil, nil
+	}
+
+	if typ.isList() {
+		list, ok := value.([]interface{})
+		if !ok {
+			list = []interface{}{value}
+		}
+		res := make([]interface{}, len(list))
+		for i, elem := range list {
+			var err error
+			if res[i], err = coerceJSON(elem, typ.elem); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+
+	switch typ.name {
+	case "Int":
+		if n, ok := value.(json.Number); ok {
+			if i, err := strconv.ParseInt(string(n), 10, 32); err == nil {
+				return i, nil
+			}
+		}
+	case "Float":
+		if n, ok := value.(json.Number); ok {
+			if f, err := n.Float64(); err == nil {
+				return f, nil
+			}
+		}
+	case "String":
+		if str, ok := value.(string); ok {
+			return str, nil
+		}
+	case "Boolean":
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	default:
+		input := graphQLSchema.inputs[typ.name]
+		obj, ok := value.(map[string]interface{})
+		if input == nil || !ok {
+			break
+		}
+		owner := "input type '" + input.name + "'"
+
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if gqlArgDefByName(input.fields, key) == nil {
+				return nil, errors.Errorf(ErrGraphQLUnknownArgument, key, owner)
+			}
+		}
+
+		res := make(map[string]interface{})
+		for _, f := range input.fields {
+			v, ok := obj[f.name]
+			switch {
+			case ok:
+				var err error
+				if res[f.name], err = coerceJSON(v, f.typ); err != nil {
+					return nil, err
+				}
+			case f.def != nil:
+				res[f.name] = f.def
+			case f.typ.nonNull:
+				return nil, errors.Errorf(ErrGraphQLMissingArgument, f.name, f.typ, owner)
+			}
+		}
+		return res, nil
+	}
+	return nil, mismatch()
+}
+
+// Cost of resolving fields: 1 per field plus the cost of its resolver, the fields selected on
+// lists counting once per element they may hold
+func gqlComplexity(fields []*gqlField) uint64 {
+	var total uint64
+	for _, f := range fields {
+		cost := 1 + f.def.cost
+		if f.fields != nil {
+			children := gqlComplexity(f.fields)
+			if f.def.typ.isList() {
+				children = saturatedMul(children, gqlListSize(f))
+			}
+			cost = saturatedAdd(cost, children)
+		}
+		total = saturatedAdd(total, cost)
+	}
+	return total
+}
+
+// Maximum number of elements of a list field, given by its limit
+func gqlListSize(f *gqlField) uint64 {
+	limit, ok := f.args["limit"].(int64)
+	if !ok {
+		return MaxPageSize
+	}
+	if limit < 0 {
+		return 0
+	}
+	return uint64(limit)
+}
+
+func saturatedAdd(a, b uint64) uint64 {
+	if a > math.MaxUint64 - b {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+func saturatedMul(a, b uint64) uint64 {
+	if a != 0 && b > math.MaxUint64 / a {
+		return math.MaxUint64
+	}
+	return a * b
+}
+
+
+/*
+ *  Execution
+ */
+
+// Object of a reply, keeping the order of its selected fields
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value interface{}
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, e := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(e.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Resolve fields on the value of their parent object. Errors of fields are gathered with their
+// path, the value of failed fields being null
+func (r *gqlRequest) execute(parent interface{}, fields []*gqlField, path []interface{}) gqlObject {
+	obj := make(gqlObject, 0, len(fields))
+	for _, f := range fields {
+		fieldPath := append(path[:len(path):len(path)], f.key)
+		value, err := f.def.resolve(r.s, parent, f.args)
+		if err != nil {
+			r.errors = append(r.errors, api.GraphQLError{
+				Message: err.Error(),
+				Locations: []api.GraphQLLocation{f.loc},
+				Path: fieldPath,
+			})
+			value = nil
+		} else {
+			value = r.complete(f, value, fieldPath)
+		}
+		obj = append(obj, gqlEntry{f.key, value})
+	}
+	return obj
+}
+
+// Resolve the fields selected on the value of a field
+func (r *gqlRequest) complete(f *gqlField, value interface{}, path []interface{}) interface{} {
+	if value == nil || f.fields == nil {
+		return value
+	}
+	if list, ok := value.([]interface{}); ok {
+		res := make([]interface{}, len(list))
+		for i, elem := range list {
+			res[i] = r.execute(elem, f.fields, append(path[:len(path):len(path)], i))
+		}
+		return res
+	}
+	return r.execute(value, f.fields, path)
+}
+
+
+/*
+ *  Resolvers
+ */
+
+// Value of City objects: a city as it was at a time, zero for the current one, so that its
+// neighbours are searched at the same time
+type gqlCityAt struct {
+	*api.CityTempl
+	at time.Time
+}
+
+// Resolver of a field of cities
+func cityResolver(get func(c *api.CityTempl) interface{}) gqlResolver {
+	return func(s *Server, parent interface{}, args map[string]interface{}) (interface{}, error) {
+		return get(parent.(*gqlCityAt).CityTempl), nil
+	}
+}
+
+// Time of the asOf argument, zero when not given
+func gqlAsOf(args map[string]interface{}) (time.Time, error) {
+	value, ok := args["asOf"].(string)
+	if !ok {
+		return time.Time{}, nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return at, errors.Errorf(ErrGraphQLInvalidTimeArg, value, "asOf")
+	}
+	return at, nil
+}
+
+func gqlCity(s *Server, parent interface{}, args map[string]interface{}) (interface{}, error) {
+	at, err := gqlAsOf(args)
+	if err != nil {
+		return nil, err
+	}
+	city, _, ret := findCityAt(s, strconv.FormatInt(args["id"].(int64), 10), at)
+	if ret != nil {
+		if ret.code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, errors.New(retMessage(ret))
+	}
+	return &gqlCityAt{city, at}, nil
+}
+
+func gqlCitiesNear(s *Server, parent interface{}, args map[string]interface{}) (interface{}, error) {
+	lon, lat := args["lon"].(float64), args["lat"].(float64)
+	if lon < -MaxLongitude || lon > MaxLongitude {
+		return nil, errors.Errorf(ErrGraphQLOutOfRangeArg, lon, "lon", -MaxLongitude, MaxLongitude)
+	}
+	if lat < -MaxLatitude || lat > MaxLatitude {
+		return nil, errors.Errorf(ErrGraphQLOutOfRangeArg, lat, "lat", -MaxLatitude, MaxLatitude)
+	}
+	at, err := gqlAsOf(args)
+	if err != nil {
+		return nil, err
+	}
+	return gqlNearby(s, []float64{lon, lat}, at, args, nil)
+}
+
+func gqlNeighbours(s *Server, parent interface{}, args map[string]interface{}) (interface{}, error) {
+	city := parent.(*gqlCityAt)
+	return gqlNearby(s, city.Coordinates, city.at, args, city.CityTempl)
+}
+
+// Cities within the radius of a location as they were at a time, nearest first, filtered and
+// limited by arguments
+func gqlNearby(s *Server, center []float64, at time.Time, args map[string]interface{},
+               exclude *api.CityTempl) (interface{}, error) {
+	radius, limit := args["radius"].(int64), args["limit"].(int64)
+	if radius < 0 || radius > MaxDist {
+		return nil, errors.Errorf(ErrGraphQLOutOfRangeArg, radius, "radius", 0, MaxDist)
+	}
+	if limit < 1 || limit > MaxPageSize {
+		return nil, errors.Errorf(ErrGraphQLOutOfRangeArg, limit, "limit", 1, MaxPageSize)
+	}
+	if radius == 0 {
+		// Case where radius == 0, no city is searched in an empty square
+		return []interface{}{}, nil
+	}
+	minPop, maxPop := int64(math.MinInt64), int64(math.MaxInt64)
+	if filters, ok := args["filters"].(map[string]interface{}); ok {
+		if min, ok := filters["minPopulation"].(int64); ok {
+			minPop = min
+		}
+		if max, ok := filters["maxPopulation"].(int64); ok {
+			maxPop = max
+		}
+	}
+
+	// Cities are searched in the square bounding the circle of the radius
+	cities, ret := citiesAroundAt(s, center, uint64(radius), at)
+	if ret != nil {
+		return nil, errors.New(retMessage(ret))
+	}
+
+	type nearCity struct {
+		city *api.CityTempl
+		dist float64
+	}
+	var near []nearCity
+	for i := range cities {
+		c := &cities[i]
+		if (exclude != nil && c.CartodbId == exclude.CartodbId) || len(c.Coordinates) != 2 ||
+		   c.Population < minPop || c.Population > maxPop {
+			continue
+		}
+		dist := dgclient.Distance(center[0], center[1], c.Coordinates[0], c.Coordinates[1])
+		if dist <= float64(radius) {
+			near = append(near, nearCity{c, dist})
+		}
+	}
+	sort.SliceStable(near, func(i, j int) bool { return near[i].dist < near[j].dist })
+	if int64(len(near)) > limit {
+		near = near[:limit]
+	}
+
+	res := make([]interface{}, len(near))
+	for i := range near {
+		res[i] = &gqlCityAt{near[i].city, at}
+	}
+	return res, nil
+}
+
+func gqlSearchCities(s *Server, parent interface{}, args map[string]interface{}) (interface{}, error) {
+	name, limit := args["name"].(string), args["limit"].(int64)
+	if strings.TrimSpace(name) == "" {
+		return nil, errors.Errorf(ErrGraphQLEmptyArg, "name")
+	}
+	if limit < 1 || limit > MaxPageSize {
+		return nil, errors.Errorf(ErrGraphQLOutOfRangeArg, limit, "limit", 1, MaxPageSize)
+	}
+
+	cities, ret := searchByName(s, name, uint64(limit))
+	if ret != nil {
+		return nil, errors.New(retMessage(ret))
+	}
+	res := make([]interface{}, len(cities))
+	for i := range cities {
+		res[i] = &gqlCityAt{CityTempl: &cities[i]}
+	}
+	return res, nil
+}
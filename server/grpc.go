@@ -0,0 +1,369 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/AsT4re/cancities/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Role and kind of rate limits of a gRPC method
+type grpcMethod struct {
+	role   role
+	limits string
+}
+
+// gRPC methods indexed by full name. Rate limits are shared with REST routes of the same kind
+var grpcMethods = map[string]grpcMethod{
+	"/cancities.Cancities/GetCity": {roleReader, readLimits},
+	"/cancities.Cancities/GetCitiesAround": {roleReader, readLimits},
+	"/cancities.Cancities/SearchByName": {roleReader, readLimits},
+	"/cancities.Cancities/ImportCities": {roleImporter, importLimits},
+}
+
+// Implementation of the gRPC API, sharing the business logic of REST handlers
+type grpcService struct {
+	s *Server
+}
+
+// gRPC server of the API, checking API keys and rate limits as REST routes do
+func newGRPCServer(s *Server, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.UnaryInterceptor(grpcUnaryInterceptor(s)),
+		grpc.StreamInterceptor(grpcStreamInterceptor(s)))
+	gs := grpc.NewServer(opts...)
+	rpc.RegisterCancitiesServer(gs, &grpcService{s})
+	return gs
+}
+
+
+/*
+ *  Methods
+ */
+
+func (g *grpcService) GetCity(ctx context.Context, req *rpc.GetCityRequest) (*rpc.City, error) {
+	if req.CartodbId < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, ErrNegativeField, req.CartodbId, "cartodb_id")
+	}
+	at, err := grpcAsOf(req.AsOf)
+	if err != nil {
+		return nil, err
+	}
+
+	city, _, ret := findCityAt(g.s, strconv.FormatInt(req.CartodbId, 10), at)
+	if ret != nil {
+		return nil, grpcError(ret)
+	}
+	return grpcCity(city), nil
+}
+
+func (g *grpcService) GetCitiesAround(ctx context.Context, req *rpc.GetCitiesAroundRequest) (*rpc.Cities, error) {
+	if req.CartodbId < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, ErrNegativeField, req.CartodbId, "cartodb_id")
+	}
+	if req.Dist > MaxDist {
+		return nil, status.Errorf(codes.InvalidArgument, ErrOutOfRangeField, req.Dist, "dist", 0, MaxDist)
+	}
+	at, err := grpcAsOf(req.AsOf)
+	if err != nil {
+		return nil, err
+	}
+
+	city, coords, ret := findCityAt(g.s, strconv.FormatInt(req.CartodbId, 10), at)
+	if ret != nil {
+		return nil, grpcError(ret)
+	}
+
+	// Case where dist == 0, only the city is returned
+	if req.Dist == 0 {
+		return &rpc.Cities{Cities: []*rpc.City{grpcCity(city)}}, nil
+	}
+
+	cities, ret := citiesAroundAt(g.s, coords, req.Dist, at)
+	if ret != nil {
+		return nil, grpcError(ret)
+	}
+	return grpcCities(cities), nil
+}
+
+func (g *grpcService) SearchByName(ctx context.Context, req *rpc.SearchByNameRequest) (*rpc.Cities, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, status.Errorf(codes.InvalidArgument, ErrEmptyField, "name")
+	}
+	limit := uint64(req.Limit)
+	if limit == 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		return nil, status.Errorf(codes.InvalidArgument, ErrOutOfRangeField, req.Limit, "limit", 1, MaxPageSize)
+	}
+
+	cities, ret := searchByName(g.s, req.Name, limit)
+	if ret != nil {
+		return nil, grpcError(ret)
+	}
+	return grpcCities(cities), nil
+}
+
+// Features are gathered until the client closes the stream, then imported at once like a REST import.
+// Streams larger than the configured size are refused, as they are kept in memory
+func (g *grpcService) ImportCities(stream rpc.Cancities_ImportCitiesServer) error {
+	start := time.Now()
+	var opts *rpc.ImportOptions
+	var feats []api.Feature
+	var size uint64
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if size += uint64(proto.Size(req)); size > g.s.config.GRPCImportMaxBytes {
+			return status.Errorf(codes.ResourceExhausted, ErrImportTooLarge, g.s.config.GRPCImportMaxBytes)
+		}
+
+		if opts == nil {
+			opts = req.Options
+			if opts == nil {
+				opts = &rpc.ImportOptions{}
+			}
+		}
+		if req.Feature != nil {
+			feat, err := grpcFeature(req.Feature)
+			if err != nil {
+				return status.Errorf(codes.InvalidArgument, ErrInvalidFeature, len(feats), err)
+			}
+			feats = append(feats, feat)
+		}
+	}
+
+	onError := api.OnErrorFail
+	if opts != nil && opts.OnError != "" {
+		if opts.OnError != api.OnErrorFail && opts.OnError != api.OnErrorSkip {
+			return status.Errorf(codes.InvalidArgument, ErrInvalidEnumField, opts.OnError, "on_error",
+				strings.Join([]string{api.OnErrorFail, api.OnErrorSkip}, ", "))
+		}
+		onError = opts.OnError
+	}
+	dryRun := opts != nil && opts.DryRun
+
+	ret := importFeatures(g.s, stream.Context(), start, feats, onError, dryRun)
+	if ret.code != http.StatusOK && ret.code != http.StatusCreated {
+		return grpcError(ret)
+	}
+
+	rep := ret.jsonTempl.(api.ImportRep)
+	reply := &rpc.ImportCitiesReply{
+		Status: rep.Status,
+		DryRun: rep.DryRun,
+		Imported: int32(rep.Imported),
+	}
+	if rep.Changes != nil {
+		reply.Changes = &rpc.ImportChanges{
+			Inserted: int32(rep.Changes.Inserted),
+			Updated: int32(rep.Changes.Updated),
+			Unchanged: int32(rep.Changes.Unchanged),
+		}
+	}
+	for _, r := range rep.Rejected {
+		rejected := &rpc.RejectedFeature{Index: int32(r.Index), Reasons: r.Reasons}
+		if r.CartodbId != nil {
+			rejected.CartodbId = *r.CartodbId
+		}
+		reply.Rejected = append(reply.Rejected, rejected)
+	}
+	return stream.SendAndClose(reply)
+}
+
+
+/*
+ *  Interceptors
+ */
+
+func grpcUnaryInterceptor(s *Server) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	            handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := grpcCheck(s, ctx, info.FullMethod, req)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func grpcStreamInterceptor(s *Server) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	            handler grpc.StreamHandler) error {
+		ctx, err := grpcCheck(s, ss.Context(), info.FullMethod, nil)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &grpcStream{ss, ctx})
+	}
+}
+
+// Server stream with the context of the checked API key
+type grpcStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (gs *grpcStream) Context() context.Context {
+	return gs.ctx
+}
+
+// Check API key and rate limits of a call, req being nil for streams
+func grpcCheck(s *Server, ctx context.Context, method string, req interface{}) (context.Context, error) {
+	m, ok := grpcMethods[method]
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, ErrRouteNotFound, "RPC", method)
+	}
+
+	remote := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+	}
+
+	k, ret := checkAPIKey(s, grpcRequestKey(ctx), m.role, "RPC " + method, remote)
+	if ret != nil {
+		return nil, grpcError(ret)
+	}
+	if k != nil {
+		ctx = context.WithValue(ctx, apiKeyKey, *k)
+	}
+
+	applies := func(limit *rateLimit) bool {
+		if limit.grpcMatch == nil {
+			return limit.match == nil
+		}
+		return req != nil && limit.grpcMatch(req)
+	}
+	if ret := throttle(s, method, s.limits[m.limits], contextClientId(ctx, remote), applies); ret != nil {
+		return nil, grpcError(&ret.httpRetMsg)
+	}
+
+	return ctx, nil
+}
+
+// Get API key given by 'x-api-key' or 'authorization: Bearer' metadata
+func grpcRequestKey(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if keys := md["x-api-key"]; len(keys) > 0 && keys[0] != "" {
+		return keys[0]
+	}
+	if auth := md["authorization"]; len(auth) > 0 && strings.HasPrefix(auth[0], "Bearer ") {
+		return strings.TrimPrefix(auth[0], "Bearer ")
+	}
+	return ""
+}
+
+// Match searches around a city with a distance above threshold
+func grpcDistAbove(threshold uint64) func(req interface{}) bool {
+	return func(req interface{}) bool {
+		r, ok := req.(*rpc.GetCitiesAroundRequest)
+		return ok && r.Dist > threshold
+	}
+}
+
+
+/*
+ *  Conversions
+ */
+
+// Status of a failed call, from the reply of the business logic shared with REST handlers
+func grpcError(ret *httpRetMsg) error {
+	code := codes.Internal
+	switch ret.code {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, retMessage(ret))
+}
+
+// Time of an as_of field, zero when not set
+func grpcAsOf(ts *timestamp.Timestamp) (time.Time, error) {
+	if ts == nil {
+		return time.Time{}, nil
+	}
+	at, err := ptypes.Timestamp(ts)
+	if err != nil {
+		return at, status.Errorf(codes.InvalidArgument, ErrInvalidTimeField, "as_of", err)
+	}
+	return at, nil
+}
+
+func grpcCity(city *api.CityTempl) *rpc.City {
+	c := &rpc.City{
+		CartodbId: city.CartodbId,
+		Name: city.Name,
+		Population: city.Population,
+	}
+	if len(city.Coordinates) == 2 {
+		c.Longitude, c.Latitude = city.Coordinates[0], city.Coordinates[1]
+	}
+	return c
+}
+
+func grpcCities(cities []api.CityTempl) *rpc.Cities {
+	rep := &rpc.Cities{Cities: make([]*rpc.City, len(cities))}
+	for i := range cities {
+		rep.Cities[i] = grpcCity(&cities[i])
+	}
+	return rep
+}
+
+// Convert an imported feature to the GeoJSON one validated by REST imports
+func grpcFeature(f *rpc.Feature) (api.Feature, error) {
+	var feat api.Feature
+	feat.Type = "Feature"
+	feat.Geometry = api.Geometry{Type: "Point", Coordinates: []float64{f.Longitude, f.Latitude}}
+
+	props := &feat.Properties
+	id := f.CartodbId
+	props.Cartodb_id = &id
+	props.Name = f.Name
+	props.Place_key = f.PlaceKey
+	props.Capital = f.Capital
+	props.Population = f.Population
+	props.Pclass = f.Pclass
+
+	var err error
+	if f.CreatedAt != nil {
+		if props.Created_at, err = ptypes.Timestamp(f.CreatedAt); err != nil {
+			return feat, err
+		}
+	}
+	if f.UpdatedAt != nil {
+		if props.Updated_at, err = ptypes.Timestamp(f.UpdatedAt); err != nil {
+			return feat, err
+		}
+	}
+	return feat, nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"github.com/gorilla/mux"
+	"github.com/AsT4re/cancities/dgclient"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Time of the as_of query string parameter, zero when not given
+func asOf(r *http.Request) time.Time {
+	at, _ := getQsValues(r).getTime("as_of")
+	return at
+}
+
+// Every version of a city, including the last one of a deleted city
+func historyHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		cityId := mux.Vars(r)["id"]
+		id, err := strconv.ParseInt(cityId, 10, 64)
+		if err != nil {
+			return &httpRetMsg{
+				http.StatusNotFound,
+				api.ErrorRep{Error: fmt.Sprintf(ErrNotFoundId, cityId)},
+			}
+		}
+
+		current, versions, err := s.db.GetCityHistory(id)
+		if err != nil {
+			return internalError(err)
+		}
+		if current == nil && len(versions) == 0 {
+			return &httpRetMsg{
+				http.StatusNotFound,
+				api.ErrorRep{Error: fmt.Sprintf(ErrNotFoundId, cityId)},
+			}
+		}
+
+		rep := api.CityHistoryRep{CartodbId: id, Versions: make([]api.CityVersionTempl, 0, len(versions) + 1)}
+		for _, v := range versions {
+			validTo := v.Valid_to
+			version, err := versionTempl(v.City(), &validTo)
+			if err != nil {
+				return internalError(err)
+			}
+			rep.Versions = append(rep.Versions, version)
+		}
+		if current != nil {
+			version, err := versionTempl(current, nil)
+			if err != nil {
+				return internalError(err)
+			}
+			rep.Versions = append(rep.Versions, version)
+		}
+
+		return &httpRetMsg{
+			http.StatusOK,
+			rep,
+		}
+	}
+}
+
+func versionTempl(city *dgclient.CityProps, validTo *time.Time) (api.CityVersionTempl, error) {
+	geo, err := dgclient.DecodeGeoDatas(city.Geo)
+	if err != nil {
+		return api.CityVersionTempl{}, err
+	}
+
+	version := api.CityVersionTempl{
+		Name: city.Name,
+		PlaceKey: city.Place_key,
+		Capital: city.Capital,
+		Population: city.Population,
+		Pclass: city.Pclass,
+		Coordinates: geo.FlatCoords(),
+		CreatedAt: city.Created_at,
+		UpdatedAt: city.Updated_at,
+		ValidTo: validTo,
+		ImportId: city.Import_id,
+	}
+	if !city.Valid_from.IsZero() {
+		validFrom := city.Valid_from
+		version.ValidFrom = &validFrom
+	}
+	return version, nil
+}
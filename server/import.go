@@ -0,0 +1,352 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/AsT4re/cancities/dgclient"
+	"github.com/AsT4re/cancities/api"
+)
+
+func importHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		start := time.Now()
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return internalError(errors.Wrap(err, "Error reading body:"))
+		}
+
+		if err = r.Body.Close(); err != nil {
+			return internalError(errors.Wrap(err, "Error closing pipe:"))
+		}
+
+		feats := api.ImportReq{}
+
+		if err = json.Unmarshal(body, &feats); err != nil {
+			return &httpRetMsg{
+				http.StatusUnprocessableEntity,
+				api.ErrorRep{Error: fmt.Sprintf(ErrUnprocessableEntity, err)},
+			}
+		}
+
+		onError, ok := getQsValues(r).getString("on_error")
+		if !ok {
+			onError = api.OnErrorFail
+		}
+		dryRun, _ := getQsValues(r).getBool("dry_run")
+
+		return importFeatures(s, r.Context(), start, feats.Features, onError, dryRun)
+	}
+}
+
+// Validate features and import them, shared by every API. Reply is a 201 with an api.ImportRep
+// when the import is committed
+func importFeatures(s *Server, ctx context.Context, start time.Time, feats []api.Feature, onError string,
+                    dryRun bool) *httpRetMsg {
+	valid, rejected := validateFeatures(feats)
+	if len(rejected) > 0 && onError == api.OnErrorFail {
+		return &httpRetMsg{
+			http.StatusUnprocessableEntity,
+			api.ImportRep{
+				Error: fmt.Sprintf(ErrInvalidFeatures, len(rejected)),
+				Rejected: rejected,
+			},
+		}
+	}
+
+	// Imports are serialized so that existing cities do not change between planning and commit
+	s.importMu.Lock()
+	defer s.importMu.Unlock()
+
+	plan, changes, err := planImport(s, valid)
+	if err != nil {
+		return internalError(err)
+	}
+
+	// Nothing is imported by a dry run, changes telling what an import would do
+	if dryRun {
+		return &httpRetMsg{
+			http.StatusOK,
+			api.ImportRep{
+				DryRun: true,
+				Changes: &changes,
+				Rejected: rejected,
+			},
+		}
+	}
+
+	// Versions are timed under the lock, so that their validity follows the order of imports
+	at := time.Now().UTC()
+	imp := s.db.NewImport(fmt.Sprintf("import-%d", at.UnixNano()), at)
+	var events []api.ChangeEvent
+	for _, p := range plan {
+		if p.unchanged {
+			continue
+		}
+
+		city, err := featureToCity(p.feat)
+		if err == nil {
+			err = imp.AddCity(city, p.previous)
+		}
+		if err == nil {
+			var ev api.ChangeEvent
+			ev, err = changeEvent(p.feat, p.previous)
+			events = append(events, ev)
+		}
+		if err != nil {
+			imp.Abort()
+			return importFailed(s, start, imp, rejected, err)
+		}
+	}
+
+	// Even a rolled back import may have been partially visible
+	modified := changes.Inserted + changes.Updated > 0
+	if modified {
+		s.beginModification()
+	}
+	err = imp.Commit(ctx)
+	if modified {
+		s.endModification()
+	}
+	if err != nil {
+		return importFailed(s, start, imp, rejected, err)
+	}
+	s.publishEvents(events)
+
+	rep := api.ImportRep{
+		ImportId: imp.Id(),
+		Status: imp.Status(),
+		Imported: len(valid),
+		Changes: &changes,
+		Mutations: importMutations(imp),
+		Rejected: rejected,
+	}
+	s.recordImport(start, &rep)
+
+	return &httpRetMsg{
+		http.StatusCreated,
+		rep,
+	}
+}
+
+// Outcome planned for a valid feature
+type plannedCity struct {
+	feat      *api.Feature
+	previous  *dgclient.CityProps
+	unchanged bool
+}
+
+// Maximum number of ids looked up by a single query when planning an import
+const idsPerLookup = 1000
+
+// Find for each feature whether it inserts a new city, updates an existing one or leaves it unchanged
+func planImport(s *Server, feats []*api.Feature) ([]plannedCity, api.ImportChanges, error) {
+	var changes api.ImportChanges
+
+	ids := make([]int64, len(feats))
+	for i, feat := range feats {
+		ids[i] = *feat.Properties.Cartodb_id
+	}
+
+	existing := make(map[int64]*dgclient.CityProps)
+	for start := 0; start < len(ids); start += idsPerLookup {
+		end := start + idsPerLookup
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		cities, err := s.db.GetCitiesByIds(ids[start:end])
+		if err != nil {
+			return nil, changes, err
+		}
+		for _, city := range cities.Root {
+			existing[city.Cartodb_id] = city
+		}
+	}
+
+	plan := make([]plannedCity, len(feats))
+	for i, feat := range feats {
+		plan[i].feat = feat
+		city, ok := existing[*feat.Properties.Cartodb_id]
+		if !ok {
+			changes.Inserted++
+			continue
+		}
+
+		plan[i].previous = city
+		unchanged, err := sameCity(feat, city)
+		if err != nil {
+			return nil, changes, err
+		}
+		plan[i].unchanged = unchanged
+		if plan[i].unchanged {
+			changes.Unchanged++
+		} else {
+			changes.Updated++
+		}
+	}
+
+	return plan, changes, nil
+}
+
+func importMutations(imp *dgclient.Import) *api.ImportMutations {
+	stats := imp.Stats()
+	return &api.ImportMutations{
+		Total: stats.Mutations,
+		Sent: stats.Sent,
+		Retries: stats.Retries,
+		Failed: stats.Failed,
+	}
+}
+
+// Check a feature read outside of an import request, e.g. from a file by the load command,
+// and build the city it holds
+func CityFromFeature(feat *api.Feature) (*dgclient.CityProps, error) {
+	if reasons := validateFeature(feat); len(reasons) > 0 {
+		return nil, errors.New(strings.Join(reasons, ", "))
+	}
+	return featureToCity(feat)
+}
+
+func featureToCity(feat *api.Feature) (*dgclient.CityProps, error) {
+	geo, err := dgclient.EncodePoint(feat.Geometry.Coordinates)
+	if err != nil {
+		return nil, err
+	}
+
+	props := &feat.Properties
+	return &dgclient.CityProps{
+		Name: props.Name,
+		Place_key: props.Place_key,
+		Capital: props.Capital,
+		Population: props.Population,
+		Pclass: props.Pclass,
+		Cartodb_id: *props.Cartodb_id,
+		Geo: geo,
+		Created_at: props.Created_at,
+		Updated_at: props.Updated_at,
+	}, nil
+}
+
+// Print to the console + return json message with the final status of the import
+func importFailed(s *Server, start time.Time, imp *dgclient.Import, rejected []api.RejectedFeature,
+                  err error) *httpRetMsg {
+	fmt.Fprintf(os.Stderr, "ERROR: %+v\n", err)
+	rep := api.ImportRep{
+		Error: fmt.Sprintf(ErrImportFailed, imp.Status()),
+		Status: imp.Status(),
+		Mutations: importMutations(imp),
+		Rejected: rejected,
+	}
+	s.recordImport(start, &rep)
+
+	return &httpRetMsg{
+		http.StatusInternalServerError,
+		rep,
+	}
+}
+
+// Check whether a feature holds the same informations as the city stored in DB
+func sameCity(feat *api.Feature, city *dgclient.CityProps) (bool, error) {
+	props := &feat.Properties
+	if props.Name != city.Name ||
+		props.Place_key != city.Place_key ||
+		props.Capital != city.Capital ||
+		props.Population != city.Population ||
+		props.Pclass != city.Pclass ||
+		!props.Created_at.Equal(city.Created_at) ||
+		!props.Updated_at.Equal(city.Updated_at) {
+		return false, nil
+	}
+
+	geo, err := dgclient.DecodeGeoDatas(city.Geo)
+	if err != nil {
+		return false, err
+	}
+	coords := geo.FlatCoords()
+	if len(coords) != len(feat.Geometry.Coordinates) {
+		return false, nil
+	}
+	for i := range coords {
+		if coords[i] != feat.Geometry.Coordinates[i] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Split features between valid ones and rejected ones with the reasons of rejection
+func validateFeatures(feats []api.Feature) ([]*api.Feature, []api.RejectedFeature) {
+	valid := make([]*api.Feature, 0, len(feats))
+	rejected := make([]api.RejectedFeature, 0)
+	seen := make(map[int64]int)
+
+	for i := range feats {
+		feat := &feats[i]
+		reasons := validateFeature(feat)
+
+		if id := feat.Properties.Cartodb_id; id != nil {
+			if first, ok := seen[*id]; ok {
+				reasons = append(reasons, fmt.Sprintf(ErrDuplicatedCartodbId, first))
+			} else {
+				seen[*id] = i
+			}
+		}
+
+		if len(reasons) > 0 {
+			rejected = append(rejected, api.RejectedFeature{
+				Index: i,
+				CartodbId: feat.Properties.Cartodb_id,
+				Reasons: reasons,
+			})
+		} else {
+			valid = append(valid, feat)
+		}
+	}
+
+	return valid, rejected
+}
+
+// Check one feature, returning every problem found
+func validateFeature(feat *api.Feature) []string {
+	var reasons []string
+
+	if feat.Type != "Feature" {
+		reasons = append(reasons, fmt.Sprintf(ErrFeatureType, feat.Type))
+	}
+
+	if feat.Geometry.Type != "Point" {
+		reasons = append(reasons, fmt.Sprintf(ErrGeometryType, feat.Geometry.Type))
+	} else if len(feat.Geometry.Coordinates) != 2 {
+		reasons = append(reasons, fmt.Sprintf(ErrCoordinatesLen, len(feat.Geometry.Coordinates)))
+	} else {
+		lon, lat := feat.Geometry.Coordinates[0], feat.Geometry.Coordinates[1]
+		if lon < -180 || lon > 180 {
+			reasons = append(reasons, fmt.Sprintf(ErrLongitudeRange, lon))
+		}
+		if lat < -90 || lat > 90 {
+			reasons = append(reasons, fmt.Sprintf(ErrLatitudeRange, lat))
+		}
+	}
+
+	props := &feat.Properties
+	if props.Cartodb_id == nil {
+		reasons = append(reasons, ErrMissingCartodbId)
+	}
+	if props.Name == "" {
+		reasons = append(reasons, ErrEmptyName)
+	}
+	if props.Population < 0 {
+		reasons = append(reasons, fmt.Sprintf(ErrNegativePopulation, props.Population))
+	}
+
+	return reasons
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Documentation of a route, used for generating the OpenAPI specification
+type routeDoc struct {
+	summary   string
+	// Body of requests, none if nil
+	request   interface{}
+	// Body of responses by status code, none if nil. Responses common to every route
+	// (invalid query string, authentication, rate limiting, internal error) are added
+	responses responses
+	// Set for aliases kept for compatibility
+	deprecated bool
+}
+
+type responses map[int]interface{}
+
+// Body being one of several types
+type oneOf []interface{}
+
+// Body in plain text rather than JSON
+type textBody string
+
+const openAPIContentType = "application/json"
+
+// Variables of route patterns, e.g. {id:[0-9]+}
+var patternVar = regexp.MustCompile(`\{(\w+)(?::([^}]+))?\}`)
+
+// Build OpenAPI 3 specification of the routes
+func buildOpenAPISpec(routes []route) map[string]interface{} {
+	g := &schemaGen{make(map[string]interface{})}
+	paths := make(map[string]map[string]interface{})
+
+	for i := range routes {
+		r := &routes[i]
+		path, params := pathParams(r.pattern)
+		params = append(params, queryParams(r.params)...)
+
+		op := map[string]interface{}{
+			"operationId": r.name,
+			"summary": r.doc.summary,
+			"responses": g.responses(r),
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if r.doc.deprecated {
+			op["deprecated"] = true
+		}
+		if r.doc.request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": g.content(r.doc.request),
+			}
+		}
+		if r.role != roleNone {
+			op["description"] = fmt.Sprintf("Requires role '%v'.", r.role)
+			op["security"] = []map[string][]string{{"apiKey": {}}, {"bearer": {}}}
+		}
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(r.method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title": "cancities",
+			"description": "Canadian cities API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// Convert a route pattern to an OpenAPI path and its parameters
+func pathParams(pattern string) (string, []interface{}) {
+	var params []interface{}
+	for _, m := range patternVar.FindAllStringSubmatch(pattern, -1) {
+		schema := map[string]interface{}{"type": "string"}
+		if m[2] != "" {
+			schema["pattern"] = "^" + m[2] + "$"
+		}
+		params = append(params, map[string]interface{}{
+			"name": m[1],
+			"in": "path",
+			"required": true,
+			"schema": schema,
+		})
+	}
+	return patternVar.ReplaceAllString(pattern, "{$1}"), params
+}
+
+func queryParams(qsParams []qsParam) []interface{} {
+	var params []interface{}
+	for _, p := range qsParams {
+		var schema map[string]interface{}
+		switch p.kind {
+		case qsUInt:
+			schema = map[string]interface{}{"type": "integer", "minimum": 0}
+		case qsFloat:
+			schema = map[string]interface{}{"type": "number"}
+		case qsBool:
+			schema = map[string]interface{}{"type": "boolean"}
+		case qsTime:
+			schema = map[string]interface{}{"type": "string", "format": "date-time"}
+		default:
+			schema = map[string]interface{}{"type": "string"}
+			if len(p.values) > 0 {
+				schema["enum"] = p.values
+			}
+		}
+		if p.min != 0 || p.max != 0 {
+			schema["minimum"] = p.min
+			schema["maximum"] = p.max
+		}
+		if p.repeatable {
+			schema = map[string]interface{}{"type": "array", "items": schema}
+		}
+
+		param := map[string]interface{}{
+			"name": p.name,
+			"in": "query",
+			"schema": schema,
+		}
+		if p.required {
+			param["required"] = true
+		}
+		params = append(params, param)
+	}
+	return params
+}
+
+
+/*
+ *  Schemas of Go types
+ */
+
+type schemaGen struct {
+	// Schemas of named structs, referenced by other schemas
+	schemas map[string]interface{}
+}
+
+func (g *schemaGen) responses(r *route) map[string]interface{} {
+	bodies := make(responses)
+	if len(r.params) > 0 {
+		bodies[http.StatusBadRequest] = api.ErrorRep{}
+	}
+	if r.role != roleNone {
+		bodies[http.StatusUnauthorized] = api.ErrorRep{}
+		bodies[http.StatusForbidden] = api.ErrorRep{}
+	}
+	if r.limits != "" {
+		bodies[http.StatusTooManyRequests] = api.ErrorRep{}
+	}
+	bodies[http.StatusInternalServerError] = api.ErrorRep{}
+	for code, body := range r.doc.responses {
+		bodies[code] = body
+	}
+
+	resps := make(map[string]interface{})
+	for code, body := range bodies {
+		resp := map[string]interface{}{"description": http.StatusText(code)}
+		if body != nil {
+			resp["content"] = g.content(body)
+		}
+		if code == http.StatusTooManyRequests {
+			resp["headers"] = map[string]interface{}{
+				"Retry-After": map[string]interface{}{
+					"schema": map[string]interface{}{"type": "integer"},
+				},
+			}
+		}
+		resps[strconv.Itoa(code)] = resp
+	}
+	return resps
+}
+
+func (g *schemaGen) content(body interface{}) map[string]interface{} {
+	if _, ok := body.(textBody); ok {
+		return map[string]interface{}{
+			"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		}
+	}
+
+	var schema map[string]interface{}
+	if types, ok := body.(oneOf); ok {
+		var schemas []interface{}
+		for _, t := range types {
+			schemas = append(schemas, g.schema(reflect.TypeOf(t)))
+		}
+		schema = map[string]interface{}{"oneOf": schemas}
+	} else {
+		schema = g.schema(reflect.TypeOf(body))
+	}
+	return map[string]interface{}{
+		openAPIContentType: map[string]interface{}{"schema": schema},
+	}
+}
+
+func (g *schemaGen) schema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			// Registered before being built, in case of recursive types
+			g.schemas[t.Name()] = nil
+			g.schemas[t.Name()] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		// Any value
+		return map[string]interface{}{}
+	}
+}
+
+// Schema of a struct, using json tags for naming properties. Properties without
+// omitempty are required
+func (g *schemaGen) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		props[name] = g.schema(f.Type)
+		if len(tag) < 2 || tag[1] != "omitempty" {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func openAPIHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		return &httpRetMsg{
+			http.StatusOK,
+			s.openAPISpec,
+		}
+	}
+}
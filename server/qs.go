@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/AsT4re/cancities/api"
+)
+
+
+/*
+ *  Query string parameters schema
+ */
+
+type qsType int
+
+const (
+	qsUInt qsType = iota
+	qsFloat
+	qsBool
+	qsString
+	// RFC 3339 time
+	qsTime
+)
+
+// Declaration of a query string parameter accepted by a route
+type qsParam struct {
+	name       string
+	kind       qsType
+	// Inclusive range for numeric parameters, not checked when both are 0
+	min        float64
+	max        float64
+	// Allowed values for string parameters, any value accepted when empty
+	values     []string
+	repeatable bool
+	required   bool
+}
+
+// Parsed query string values, indexed by parameter name
+type qsValues map[string][]interface{}
+
+// Keys of values stored in request context
+type ctxKey int
+
+const (
+	qsValuesKey ctxKey = iota
+	apiKeyKey
+	datasetVersionKey
+)
+
+// Wrap a handler so that query string is checked against route params before calling it
+func checkQsParams(params []qsParam, fn appHandler) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		values, problems := parseQsParams(params, r.URL.Query())
+		if len(problems) > 0 {
+			return &httpRetMsg{
+				http.StatusBadRequest,
+				api.ErrorRep{Error: ErrInvalidQsParams, Details: problems},
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), qsValuesKey, values)
+		return fn(w, r.WithContext(ctx))
+	}
+}
+
+// Get query string values parsed by checkQsParams
+func getQsValues(r *http.Request) qsValues {
+	if values, ok := r.Context().Value(qsValuesKey).(qsValues); ok {
+		return values
+	}
+	return qsValues{}
+}
+
+func (v qsValues) getUInt(name string) (uint64, bool) {
+	if vals, ok := v[name]; ok {
+		return vals[0].(uint64), true
+	}
+	return 0, false
+}
+
+func (v qsValues) getFloat(name string) (float64, bool) {
+	if vals, ok := v[name]; ok {
+		return vals[0].(float64), true
+	}
+	return 0, false
+}
+
+func (v qsValues) getBool(name string) (bool, bool) {
+	if vals, ok := v[name]; ok {
+		return vals[0].(bool), true
+	}
+	return false, false
+}
+
+func (v qsValues) getTime(name string) (time.Time, bool) {
+	if vals, ok := v[name]; ok {
+		return vals[0].(time.Time), true
+	}
+	return time.Time{}, false
+}
+
+func (v qsValues) getString(name string) (string, bool) {
+	if vals, ok := v[name]; ok {
+		return vals[0].(string), true
+	}
+	return "", false
+}
+
+// Check every query string parameter and return all problems found
+func parseQsParams(params []qsParam, query url.Values) (qsValues, []string) {
+	values := make(qsValues)
+	var problems []string
+
+	declared := make(map[string]qsParam)
+	for _, p := range params {
+		declared[p.name] = p
+	}
+
+	for _, p := range params {
+		if _, ok := query[p.name]; p.required && !ok {
+			problems = append(problems, fmt.Sprintf(ErrMissingQsParam, p.name))
+		}
+	}
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		p, ok := declared[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf(ErrUnknownQsParam, key))
+			continue
+		}
+
+		raw := query[key]
+		if len(raw) > 1 && !p.repeatable {
+			problems = append(problems, fmt.Sprintf(ErrTooManyValues, key))
+			continue
+		}
+
+		for _, s := range raw {
+			if v, err := p.parse(s); err != nil {
+				problems = append(problems, err.Error())
+			} else {
+				values[key] = append(values[key], v)
+			}
+		}
+	}
+
+	return values, problems
+}
+
+func (p *qsParam) parse(s string) (interface{}, error) {
+	switch p.kind {
+	case qsUInt:
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf(ErrInvalidUIntQsParam, s, p.name)
+		}
+		return u, p.checkRange(s, float64(u))
+	case qsFloat:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf(ErrInvalidFloatQsParam, s, p.name)
+		}
+		return f, p.checkRange(s, f)
+	case qsBool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf(ErrInvalidBoolQsParam, s, p.name)
+		}
+		return b, nil
+	case qsTime:
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, fmt.Errorf(ErrInvalidTimeQsParam, s, p.name)
+		}
+		return t, nil
+	default:
+		if len(p.values) == 0 {
+			return s, nil
+		}
+		for _, allowed := range p.values {
+			if s == allowed {
+				return s, nil
+			}
+		}
+		return nil, fmt.Errorf(ErrInvalidEnumQsParam, s, p.name, strings.Join(p.values, ", "))
+	}
+}
+
+func (p *qsParam) checkRange(s string, f float64) error {
+	if p.min == 0 && p.max == 0 {
+		return nil
+	}
+	if f < p.min || f > p.max {
+		return fmt.Errorf(ErrOutOfRangeQsParam, s, p.name, p.min, p.max)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Token bucket limit applied per client on a route
+type rateLimit struct {
+	// Buckets are shared by routes using the same limit name
+	name   string
+	// Tokens added per second, and maximum number of tokens
+	rate   float64
+	burst  float64
+	// Limit applied only to matching requests, every request if nil
+	match  func(r *http.Request) bool
+	// Same for gRPC requests, limit applied to every gRPC request only if both matches are nil
+	grpcMatch func(req interface{}) bool
+}
+
+// Idle buckets are removed at this interval
+const bucketsPruneInterval = time.Minute
+
+var throttledRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cancities_throttled_requests_total",
+		Help: "Number of requests refused because of rate limiting.",
+	},
+	[]string{"route", "limit"},
+)
+
+func init() {
+	prometheus.MustRegister(throttledRequests)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// Time when the bucket is full again if no token is taken
+	full   time.Time
+}
+
+// Token buckets indexed by limit name and client
+type rateLimiter struct {
+	sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*bucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// Take a token from the bucket of the client of each limit, only if none is empty. Otherwise the
+// first empty limit is returned with the time to wait for its next token
+func (rl *rateLimiter) take(limits []*rateLimit, client string, now time.Time) (*rateLimit, time.Duration) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	if now.Sub(rl.lastPrune) > bucketsPruneInterval {
+		rl.prune(now)
+	}
+
+	buckets := make([]*bucket, len(limits))
+	for i, limit := range limits {
+		key := limit.name + "|" + client
+		b, ok := rl.buckets[key]
+		if !ok {
+			b = &bucket{tokens: limit.burst, last: now}
+			rl.buckets[key] = b
+		}
+
+		b.tokens = math.Min(limit.burst, b.tokens + now.Sub(b.last).Seconds() * limit.rate)
+		b.last = now
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) / limit.rate * float64(time.Second))
+			return limit, wait
+		}
+		buckets[i] = b
+	}
+
+	for i, b := range buckets {
+		b.tokens--
+		b.full = now.Add(time.Duration((limits[i].burst - b.tokens) / limits[i].rate * float64(time.Second)))
+	}
+	return nil, 0
+}
+
+// Remove buckets idle long enough to be full again
+func (rl *rateLimiter) prune(now time.Time) {
+	for key, b := range rl.buckets {
+		if now.After(b.full) {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastPrune = now
+}
+
+// Identify client by API key name, or by IP address for requests without key
+func clientId(r *http.Request) string {
+	return contextClientId(r.Context(), r.RemoteAddr)
+}
+
+func contextClientId(ctx context.Context, remoteAddr string) string {
+	if k, ok := ctx.Value(apiKeyKey).(apiKey); ok {
+		return "key:" + k.name
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+// Wrap a handler so that requests over one of the route limits are refused
+func rateLimited(s *Server, routeName string, limits []rateLimit, fn appHandler) appHandler {
+	if len(limits) == 0 {
+		return fn
+	}
+
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		applies := func(limit *rateLimit) bool {
+			return limit.match == nil || limit.match(r)
+		}
+		if ret := throttle(s, routeName, limits, clientId(r), applies); ret != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(ret.retryAfter))
+			return &ret.httpRetMsg
+		}
+
+		return fn(w, r)
+	}
+}
+
+// Request refused by a rate limit
+type throttled struct {
+	httpRetMsg
+	// Seconds to wait before retrying
+	retryAfter int
+}
+
+// Take a token from each limit applying to a request of the client, shared by every API. A refused
+// request takes no token, so that it does not use the budget of the other limits
+func throttle(s *Server, routeName string, limits []rateLimit, client string,
+              applies func(*rateLimit) bool) *throttled {
+	var applying []*rateLimit
+	for i := range limits {
+		if applies(&limits[i]) {
+			applying = append(applying, &limits[i])
+		}
+	}
+
+	limit, wait := s.limiter.take(applying, client, time.Now())
+	if limit == nil {
+		return nil
+	}
+
+	throttledRequests.WithLabelValues(routeName, limit.name).Inc()
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	return &throttled{
+		httpRetMsg{
+			http.StatusTooManyRequests,
+			api.ErrorRep{Error: fmt.Sprintf(ErrTooManyRequests, retryAfter)},
+		},
+		retryAfter,
+	}
+}
+
+// Match searches around a city with a distance above threshold
+func distAbove(threshold uint64) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		dist, ok := getQsValues(r).getUInt("dist")
+		return ok && dist > threshold
+	}
+}
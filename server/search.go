@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net/http"
+	"time"
+	"github.com/AsT4re/cancities/dgclient"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Maximum longitude and latitude accepted for searching cities around a location
+const (
+	MaxLongitude = 180
+	MaxLatitude = 90
+)
+
+// Cities around a location
+type nearCities struct {
+	center []float64
+	dist   uint64
+	cities []api.CityTempl
+}
+
+// Get the cities around the location of a near request, shared by every API version
+func searchNear(s *Server, r *http.Request) (*nearCities, *httpRetMsg) {
+	qs := getQsValues(r)
+	lon, _ := qs.getFloat("lon")
+	lat, _ := qs.getFloat("lat")
+	dist, _ := qs.getUInt("dist")
+
+	near := &nearCities{center: []float64{lon, lat}, dist: dist}
+	if dist == 0 {
+		// Case where dist == 0, no city is searched in an empty square
+		near.cities = []api.CityTempl{}
+		return near, nil
+	}
+
+	var ret *httpRetMsg
+	if near.cities, ret = citiesAroundAt(s, near.center, dist, asOf(r)); ret != nil {
+		return nil, ret
+	}
+	return near, nil
+}
+
+func nearHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		near, ret := searchNear(s, r)
+		if ret != nil {
+			return ret
+		}
+
+		return &httpRetMsg{
+			http.StatusOK,
+			api.CitiesTempl{
+				Cities: near.cities,
+			},
+		}
+	}
+}
+
+// Get every city, as they were at a time unless at is zero, shared by every API version
+func allCities(s *Server, at time.Time) ([]api.CityTempl, *httpRetMsg) {
+	var cities dgclient.CitiesRep
+	var err error
+	if at.IsZero() {
+		cities, err = s.db.GetAllCities()
+	} else {
+		cities, err = s.db.GetAllCitiesAt(at)
+	}
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	citiesArr, err := citiesTempl(cities)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	return citiesArr, nil
+}
+
+// Get the cities whose name holds every term of the given name, shared by every API
+func searchByName(s *Server, name string, limit uint64) ([]api.CityTempl, *httpRetMsg) {
+	cities, err := s.db.SearchCitiesByName(name, limit)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	citiesArr, err := citiesTempl(cities)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	return citiesArr, nil
+}
+
+// Every city, for exporting them
+func citiesHandler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		cities, ret := allCities(s, asOf(r))
+		if ret != nil {
+			return ret
+		}
+
+		return &httpRetMsg{
+			http.StatusOK,
+			api.CitiesTempl{
+				Cities: cities,
+			},
+		}
+	}
+}
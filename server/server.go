@@ -6,12 +6,17 @@ import (
 	"github.com/pkg/errors"
 	"github.com/gorilla/mux"
 	"encoding/json"
-	"io/ioutil"
 	"os"
 	"fmt"
-	"strconv"
 	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"time"
 	"github.com/AsT4re/cancities/dgclient"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"github.com/AsT4re/cancities/api"
 )
 
 
@@ -23,32 +28,471 @@ type route struct {
 	name        string
 	method      string
 	pattern     string
+	role        role
+	params      []qsParam
+	// Kind of rate limits of the route, none if empty
+	limits      string
+	doc         routeDoc
 	handler     appHandler
 }
 
 type routes []route
 
+// Kinds of rate limits, shared by the routes and gRPC methods of the same kind. Limits of each kind
+// are set by the config
+const (
+	importLimits = "import"
+	readLimits = "read"
+	exportLimits = "export"
+)
+
 func getRoutes(s *Server) []route {
-	return routes {
+	rs := routes {
 		route{
 			"Status",
 			"GET",
 			"/",
+			roleNone,
+			nil,
+			"",
+			routeDoc{
+				summary: "Server and DB connections status",
+				responses: responses{
+					http.StatusOK: api.StatusRep{},
+					http.StatusServiceUnavailable: api.StatusRep{},
+				},
+			},
 			statusHandler(s),
 		},
+	}
+
+	rs = append(rs, apiRoutes(
 		route{
 			"Import",
 			"POST",
 			"/import",
+			roleImporter,
+			[]qsParam{
+				{name: "on_error", kind: qsString, values: []string{api.OnErrorFail, api.OnErrorSkip}},
+				{name: "dry_run", kind: qsBool},
+			},
+			importLimits,
+			routeDoc{
+				summary: "Import cities from GeoJSON features, all or nothing",
+				request: api.ImportReq{},
+				responses: responses{
+					http.StatusCreated: api.ImportRep{},
+					http.StatusOK: api.ImportRep{},
+					http.StatusUnprocessableEntity: oneOf{api.ErrorRep{}, api.ImportRep{}},
+					http.StatusInternalServerError: api.ImportRep{},
+				},
+			},
 			importHandler(s),
 		},
+		route{
+			"Import",
+			"POST",
+			"/import",
+			roleImporter,
+			[]qsParam{
+				{name: "on_error", kind: qsString, values: []string{api.OnErrorFail, api.OnErrorSkip}},
+				{name: "dry_run", kind: qsBool},
+			},
+			importLimits,
+			routeDoc{
+				summary: "Import cities from GeoJSON features, all or nothing",
+				request: api.ImportReq{},
+				responses: responses{
+					http.StatusCreated: api.ImportRepV2{},
+					http.StatusOK: api.ImportRepV2{},
+					http.StatusUnprocessableEntity: oneOf{api.ErrorRep{}, api.ImportRep{}},
+					http.StatusInternalServerError: api.ImportRep{},
+				},
+			},
+			enveloped(importEnvelope, importHandler(s)),
+		},
+	)...)
+
+	rs = append(rs, apiRoutes(
 		route{
 			"Find",
 			"GET",
 			"/id/{id:[0-9]+}",
-			findHandler(s),
+			roleReader,
+			[]qsParam{
+				{name: "dist", kind: qsUInt, min: 0, max: MaxDist},
+				{name: "as_of", kind: qsTime},
+			},
+			readLimits,
+			routeDoc{
+				summary: "Get a city, or the cities around it when dist (in kilometers) is given",
+				responses: responses{
+					http.StatusOK: oneOf{api.CityTempl{}, api.CitiesTempl{}},
+					http.StatusNotModified: nil,
+					http.StatusNotFound: api.ErrorRep{},
+				},
+			},
+			withValidators(s, cached(s, findHandler(s))),
 		},
-	}
+		route{
+			"Find",
+			"GET",
+			"/id/{id:[0-9]+}",
+			roleReader,
+			[]qsParam{
+				{name: "dist", kind: qsUInt, min: 0, max: MaxDist},
+				{name: "limit", kind: qsUInt, min: 1, max: MaxPageSize},
+				{name: "offset", kind: qsUInt},
+				{name: "as_of", kind: qsTime},
+			},
+			readLimits,
+			routeDoc{
+				summary: "Get a city, or the cities around it when dist (in kilometers) is given",
+				responses: responses{
+					http.StatusOK: oneOf{api.CityRepV2{}, api.CitiesRepV2{}},
+					http.StatusNotModified: nil,
+					http.StatusNotFound: api.ErrorRep{},
+				},
+			},
+			withValidators(s, cached(s, findV2Handler(s))),
+		},
+	)...)
+
+	rs = append(rs, apiRoutes(
+		route{
+			"Near",
+			"GET",
+			"/near",
+			roleReader,
+			[]qsParam{
+				{name: "lon", kind: qsFloat, min: -MaxLongitude, max: MaxLongitude, required: true},
+				{name: "lat", kind: qsFloat, min: -MaxLatitude, max: MaxLatitude, required: true},
+				{name: "dist", kind: qsUInt, min: 0, max: MaxDist, required: true},
+				{name: "as_of", kind: qsTime},
+			},
+			readLimits,
+			routeDoc{
+				summary: "Get the cities around a location, in a square of side dist (in kilometers)",
+				responses: responses{
+					http.StatusOK: api.CitiesTempl{},
+					http.StatusNotModified: nil,
+				},
+			},
+			withValidators(s, cached(s, nearHandler(s))),
+		},
+		route{
+			"Near",
+			"GET",
+			"/near",
+			roleReader,
+			[]qsParam{
+				{name: "lon", kind: qsFloat, min: -MaxLongitude, max: MaxLongitude, required: true},
+				{name: "lat", kind: qsFloat, min: -MaxLatitude, max: MaxLatitude, required: true},
+				{name: "dist", kind: qsUInt, min: 0, max: MaxDist, required: true},
+				{name: "limit", kind: qsUInt, min: 1, max: MaxPageSize},
+				{name: "offset", kind: qsUInt},
+				{name: "as_of", kind: qsTime},
+			},
+			readLimits,
+			routeDoc{
+				summary: "Get the cities around a location, in a square of side dist (in kilometers)",
+				responses: responses{
+					http.StatusOK: api.CitiesRepV2{},
+					http.StatusNotModified: nil,
+				},
+			},
+			withValidators(s, cached(s, nearV2Handler(s))),
+		},
+	)...)
+
+	rs = append(rs, apiRoutes(
+		route{
+			"Cities",
+			"GET",
+			"/cities",
+			roleReader,
+			[]qsParam{
+				{name: "as_of", kind: qsTime},
+			},
+			exportLimits,
+			routeDoc{
+				summary: "Get every city, ordered by id",
+				responses: responses{
+					http.StatusOK: api.CitiesTempl{},
+					http.StatusNotModified: nil,
+				},
+			},
+			withValidators(s, cached(s, citiesHandler(s))),
+		},
+		route{
+			"Cities",
+			"GET",
+			"/cities",
+			roleReader,
+			[]qsParam{
+				{name: "limit", kind: qsUInt, min: 1, max: MaxPageSize},
+				{name: "offset", kind: qsUInt},
+				{name: "as_of", kind: qsTime},
+			},
+			exportLimits,
+			routeDoc{
+				summary: "Get every city, ordered by id",
+				responses: responses{
+					http.StatusOK: api.CitiesRepV2{},
+					http.StatusNotModified: nil,
+				},
+			},
+			withValidators(s, cached(s, citiesV2Handler(s))),
+		},
+	)...)
+
+	rs = append(rs, routes{
+		route{
+			"GraphQL",
+			"POST",
+			"/graphql",
+			roleReader,
+			nil,
+			readLimits,
+			routeDoc{
+				summary: "Query cities with GraphQL, queries being limited in depth and complexity",
+				request: api.GraphQLReq{},
+				responses: responses{
+					http.StatusOK: api.GraphQLRep{},
+					http.StatusBadRequest: api.GraphQLRep{},
+					http.StatusRequestEntityTooLarge: api.GraphQLRep{},
+				},
+			},
+			graphqlHandler(s),
+		},
+		route{
+			"GraphQLSchema",
+			"GET",
+			"/graphql/schema",
+			roleReader,
+			nil,
+			readLimits,
+			routeDoc{
+				summary: "GraphQL schema, in schema definition language",
+				responses: responses{
+					http.StatusOK: api.GraphQLSchemaRep{},
+				},
+			},
+			graphqlSchemaHandler(s),
+		},
+		route{
+			"BatchGet",
+			"POST",
+			"/cities:batchGet",
+			roleReader,
+			[]qsParam{
+				{name: "as_of", kind: qsTime},
+			},
+			readLimits,
+			routeDoc{
+				summary: "Get the cities with the given ids, listing the ids of the missing ones",
+				request: api.BatchGetReq{},
+				responses: responses{
+					http.StatusOK: api.BatchGetRep{},
+					http.StatusBadRequest: api.ErrorRep{},
+					http.StatusRequestEntityTooLarge: api.ErrorRep{},
+					http.StatusUnprocessableEntity: api.ErrorRep{},
+				},
+			},
+			batchGetHandler(s),
+		},
+		route{
+			"History",
+			"GET",
+			"/id/{id:[0-9]+}/history",
+			roleReader,
+			nil,
+			readLimits,
+			routeDoc{
+				summary: "Get every version of a city with its validity and the import which produced it",
+				responses: responses{
+					http.StatusOK: api.CityHistoryRep{},
+					http.StatusNotFound: api.ErrorRep{},
+				},
+			},
+			historyHandler(s),
+		},
+		route{
+			"CitiesChanges",
+			"GET",
+			"/cities/changes",
+			roleReader,
+			[]qsParam{
+				{name: "since", kind: qsTime},
+				{name: "token", kind: qsString},
+				{name: "limit", kind: qsUInt, min: 1, max: MaxPageSize},
+			},
+			exportLimits,
+			routeDoc{
+				summary: "Get the cities modified after since, or after the continuation token of a previous page, deleted ones as tombstones",
+				responses: responses{
+					http.StatusOK: api.ChangesRep{},
+					http.StatusBadRequest: api.ErrorRep{},
+				},
+			},
+			changesHandler(s),
+		},
+		route{
+			"Events",
+			"GET",
+			"/events",
+			roleReader,
+			[]qsParam{
+				{name: "last_event_id", kind: qsUInt},
+			},
+			readLimits,
+			routeDoc{
+				summary: "Stream changes of cities as Server-Sent Events, resuming after Last-Event-ID when given",
+				responses: responses{
+					http.StatusOK: api.ChangeEvent{},
+					http.StatusBadRequest: api.ErrorRep{},
+				},
+			},
+			eventsHandler(s),
+		},
+	}...)
+
+	return append(rs, routes {
+		route{
+			"AdminDropAll",
+			"DELETE",
+			"/admin/cities",
+			roleAdmin,
+			nil,
+			"",
+			routeDoc{
+				summary: "Drop all cities",
+				responses: responses{
+					http.StatusNoContent: nil,
+				},
+			},
+			dropAllHandler(s),
+		},
+		route{
+			"AdminCount",
+			"GET",
+			"/admin/cities/count",
+			roleAdmin,
+			nil,
+			"",
+			routeDoc{
+				summary: "Count cities",
+				responses: responses{
+					http.StatusOK: api.CountRep{},
+				},
+			},
+			countHandler(s),
+		},
+		route{
+			"AdminSchema",
+			"GET",
+			"/admin/schema",
+			roleAdmin,
+			nil,
+			"",
+			routeDoc{
+				summary: "Show DB schema",
+				responses: responses{
+					http.StatusOK: api.SchemaRep{},
+				},
+			},
+			schemaHandler(s),
+		},
+		route{
+			"AdminLastImport",
+			"GET",
+			"/admin/imports/last",
+			roleAdmin,
+			nil,
+			"",
+			routeDoc{
+				summary: "Show statistics about the last import",
+				responses: responses{
+					http.StatusOK: api.LastImportRep{},
+					http.StatusNotFound: api.ErrorRep{},
+				},
+			},
+			lastImportHandler(s),
+		},
+		route{
+			"AdminRebuildIndexes",
+			"POST",
+			"/admin/indexes/rebuild",
+			roleAdmin,
+			nil,
+			"",
+			routeDoc{
+				summary: "Rebuild indexes",
+				responses: responses{
+					http.StatusOK: api.RebuildIndexesRep{},
+				},
+			},
+			rebuildIndexesHandler(s),
+		},
+		route{
+			"AdminConfig",
+			"GET",
+			"/admin/config",
+			roleAdmin,
+			nil,
+			"",
+			routeDoc{
+				summary: "Show effective configuration",
+				responses: responses{
+					http.StatusOK: Config{},
+				},
+			},
+			configHandler(s),
+		},
+		route{
+			"Metrics",
+			"GET",
+			"/metrics",
+			roleAdmin,
+			nil,
+			"",
+			routeDoc{
+				summary: "Prometheus metrics, in text exposition format",
+				responses: responses{
+					http.StatusOK: textBody(""),
+				},
+			},
+			metricsHandler(s),
+		},
+		route{
+			"OpenAPI",
+			"GET",
+			"/openapi.json",
+			roleNone,
+			nil,
+			"",
+			routeDoc{
+				summary: "OpenAPI specification of the API",
+				responses: responses{
+					http.StatusOK: map[string]interface{}{},
+				},
+			},
+			openAPIHandler(s),
+		},
+	}...)
+}
+
+// Routes of the public API are served under /v1 and /v2. The unversioned pattern is kept
+// as a deprecated alias of v1
+func apiRoutes(v1, v2 route) []route {
+	alias := v1
+	alias.doc.deprecated = true
+
+	v1.name += "V1"
+	v1.pattern = "/v1" + v1.pattern
+	v2.name += "V2"
+	v2.pattern = "/v2" + v2.pattern
+	return []route{alias, v1, v2}
 }
 
 
@@ -57,37 +501,90 @@ func getRoutes(s *Server) []route {
  */
 
 type Server struct {
-	db     *dgclient.DGClient
-	server *http.Server
+	// Odd while cities are modified, accessed atomically and kept first for alignment
+	modSeq        uint64
+	config        Config
+	db            *dgclient.DGClient
+	server        *http.Server
+	apiKeys       apiKeys
+	anonymousRole role
+	importMu      sync.Mutex
+	statsMu       sync.Mutex
+	lastImport    *api.LastImportRep
+	// Guard what is created from TLS settings once started
+	tlsMu         sync.Mutex
+	certs         *certReloader
+	grpcServer    *grpc.Server
+	limiter       *rateLimiter
+	limits        map[string][]rateLimit
+	cache         *responseCache
+	openAPISpec   map[string]interface{}
+	events        *eventBroker
+	webhooks      *webhooks
+	// Last dataset version bumped or seen by the server, guarded by importMu
+	knownVersion  int64
 }
 
 const JsonContentType = "application/json; charset=UTF-8"
 
+// Maximum distance (in kilometers) accepted for searching cities around another one
+const MaxDist = 5000
+
 // Server constructor
-func (s *Server) Init(port, dgraph string, nbConns uint) error {
-	// Init s.db
+func (s *Server) Init(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	s.config = config
+
+	// Init authentication
 	var err error
-	if s.db, err = dgclient.NewDGClient(dgraph, nbConns); err != nil {
+	if s.apiKeys, err = loadAPIKeys(config.APIKeys); err != nil {
+		return err
+	}
+	if s.anonymousRole, err = parseRole(config.AnonymousRole); err != nil {
+		return err
+	}
+
+	// Init change events, before s.db which would be left open on errors
+	s.events = newEventBroker(config.EventsBuffer)
+	if s.webhooks, err = loadWebhooks(config.Webhooks); err != nil {
+		return err
+	}
+
+	// Init s.db
+	if s.db, err = dgclient.NewDGClient(config.DgHostAndPort, config.DgConnsPool); err != nil {
+		s.webhooks.stop(context.Background())
 		return err
 	}
-	s.db.Init()
 
 	// Init router
+	s.limiter = newRateLimiter()
+	s.limits = config.rateLimits()
+	cacheOpts := config.cacheOptions()
+	s.cache = newResponseCache(cacheOpts.Size, cacheOpts.TTL)
 	routes := getRoutes(s)
+	s.openAPISpec = buildOpenAPISpec(routes)
 	router := mux.NewRouter().StrictSlash(true)
 	for _, route := range routes {
+		handler := authorize(s, route.role,
+			checkQsParams(route.params,
+				rateLimited(s, route.name, s.limits[route.limits], route.handler)))
+		if route.doc.deprecated {
+			handler = deprecated(handler)
+		}
 		router.
 			Methods(route.method).
 			Path(route.pattern).
 			Name(route.name).
-			Handler(route.handler)
+			Handler(handler)
 	}
 
 	router.NotFoundHandler = notFoundHandler(s)
 
 	var buf bytes.Buffer
 	buf.WriteString(":")
-	buf.WriteString(port)
+	buf.WriteString(config.Port)
 	// Init http server
 	s.server = &http.Server{
 		Addr: buf.String(),
@@ -97,19 +594,127 @@ func (s *Server) Init(port, dgraph string, nbConns uint) error {
 	return nil
 }
 
-func (s *Server) Start(cert, key string) error {
-	if err := s.server.ListenAndServeTLS(cert, key); err != nil {
+func (s *Server) Start() error {
+	// Refuse to serve with a schema older than the one expected by this binary
+	version, err := s.db.AppliedSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version < dgclient.SchemaVersion {
+		return errors.Errorf("DB schema version %v is behind expected version %v, run 'cancities migrate up'",
+			version, dgclient.SchemaVersion)
+	}
+
+	// Modifications made before starting are not announced
+	dataset, err := s.db.DatasetVersion()
+	if err != nil {
+		return err
+	}
+	s.importMu.Lock()
+	s.knownVersion = dataset.Version
+	s.importMu.Unlock()
+	go s.watchDataset()
+
+	opts := s.config.tlsOptions()
+	certs, err := newCertReloader(opts.Cert, opts.Key)
+	if err != nil {
+		return err
+	}
+	if s.server.TLSConfig, err = newTLSConfig(opts, certs); err != nil {
+		return err
+	}
+
+	// gRPC API is served with the same TLS settings, and stopped along with the HTTP server
+	var grpcLis net.Listener
+	var grpcServer *grpc.Server
+	if s.config.GRPCPort != "" {
+		if grpcLis, err = net.Listen("tcp", ":" + s.config.GRPCPort); err != nil {
+			return errors.Wrap(err, "Fail to listen for gRPC")
+		}
+		grpcServer = newGRPCServer(s, grpc.Creds(credentials.NewTLS(s.server.TLSConfig)))
+	}
+
+	s.tlsMu.Lock()
+	s.certs = certs
+	s.grpcServer = grpcServer
+	s.tlsMu.Unlock()
+	go certs.watch()
+
+	cGrpcErr := make(chan error, 1)
+	if grpcServer != nil {
+		go func() {
+			// Only fails if not stopped
+			if err := grpcServer.Serve(grpcLis); err != nil {
+				cGrpcErr <- errors.Wrap(err, "Fail to serve gRPC")
+				s.server.Close()
+			}
+		}()
+	}
+
+	// Certificate and key are given by TLS config
+	if err := s.server.ListenAndServeTLS("", ""); err != nil {
 		if err != http.ErrServerClosed {
+			if grpcServer != nil {
+				grpcServer.Stop()
+			}
 			return errors.Wrap(err, "Fail to serve")
 		}
+		select {
+		case grpcErr := <-cGrpcErr:
+			return grpcErr
+		default:
+		}
 		return err
 	}
 
 	return nil
 }
 
+// HTTP handler of every route, for serving them with another server
+func (s *Server) Handler() http.Handler {
+	return s.server.Handler
+}
+
+// Load TLS certificate and key from disk again, without dropping connections
+func (s *Server) ReloadCertificate() error {
+	s.tlsMu.Lock()
+	certs := s.certs
+	s.tlsMu.Unlock()
+
+	if certs == nil {
+		return errors.New("server not started")
+	}
+	return certs.Reload()
+}
+
+// Gracefully stop HTTP and gRPC servers together, connections still open at deadline are closed
 func (s *Server) Stop(ctx *context.Context) error {
-	if err := s.server.Shutdown(*ctx); err != nil {
+	s.tlsMu.Lock()
+	grpcServer := s.grpcServer
+	s.tlsMu.Unlock()
+
+	// Nil when gRPC is disabled, so that it is not waited for
+	var grpcStopped chan struct{}
+	if grpcServer != nil {
+		grpcStopped = make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(grpcStopped)
+		}()
+	}
+
+	// Event streams never end by themselves
+	s.events.close()
+	err := s.server.Shutdown(*ctx)
+	if grpcServer != nil {
+		select {
+		case <-grpcStopped:
+		case <-(*ctx).Done():
+			grpcServer.Stop()
+		}
+	}
+	s.webhooks.stop(*ctx)
+	if err != nil {
 		return errors.Wrap(err, "Fail to properly shutdown the server")
 	}
 
@@ -117,7 +722,25 @@ func (s *Server) Stop(ctx *context.Context) error {
 }
 
 func (s *Server) Close() {
-	s.db.Close()
+	s.tlsMu.Lock()
+	if s.certs != nil {
+		s.certs.close()
+	}
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+	s.tlsMu.Unlock()
+	if s.events != nil {
+		s.events.close()
+	}
+	if s.webhooks != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		s.webhooks.stop(ctx)
+	}
+	if s.db != nil {
+		s.db.Close()
+	}
 }
 
 
@@ -135,6 +758,10 @@ type appHandler func(http.ResponseWriter, *http.Request) *httpRetMsg
 // Executed before sending response
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ret := fn(w, r)
+	if ret == nil {
+		// Response already written by the handler, e.g. streamed
+		return
+	}
 	if ret.code == 0 {
 		fmt.Fprintf(os.Stderr, "ERROR: Return code has not been set by handler\n")
 		ret.code = http.StatusInternalServerError
@@ -156,177 +783,186 @@ func notFoundHandler(s *Server) appHandler {
 	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
 		return &httpRetMsg{
 			http.StatusNotFound,
-			ErrorRep{fmt.Sprintf(ErrRouteNotFound, r.Method, r.URL.Path)},
+			api.ErrorRep{Error: fmt.Sprintf(ErrRouteNotFound, r.Method, r.URL.Path)},
 		}
 	}
 }
 
 func statusHandler(s *Server) appHandler {
 	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		pool := s.db.PoolStatus()
+		code := http.StatusOK
+		if pool.Healthy == 0 {
+			code = http.StatusServiceUnavailable
+		}
+
 		return &httpRetMsg{
-			http.StatusOK,
-			StatusRep{"Server running on port 8443"},
+			code,
+			api.StatusRep{Message: fmt.Sprintf("Server running on port %v", s.config.Port), Db: &pool},
 		}
 	}
 }
 
-func importHandler(s *Server) appHandler {
+func findHandler(s *Server) appHandler {
 	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
-
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			return internalError(errors.Wrap(err, "Error reading body:"))
+		found, ret := findCities(s, r)
+		if ret != nil {
+			return ret
 		}
 
-		if err = r.Body.Close(); err != nil {
-			return internalError(errors.Wrap(err, "Error closing pipe:"))
-		}
-
-		feats := ImportReq{}
-
-		if err = json.Unmarshal(body, &feats); err != nil {
+		if found.around == nil {
+			// Simple get of city informations
 			return &httpRetMsg{
-				http.StatusUnprocessableEntity,
-				ErrorRep{fmt.Sprintf(ErrUnprocessableEntity, err)},
+				http.StatusOK,
+				found.city,
 			}
 		}
 
-		for _, feat := range feats.Features {
-			buf := bytes.Buffer{}
-			if err := json.NewEncoder(&buf).Encode(feat.Geometry); err != nil {
-				return internalError(err)
-			}
-			err := s.db.AddNewNodeToBatch(
-				feat.Properties.Name,
-				feat.Properties.Place_key,
-				feat.Properties.Capital,
-				feat.Properties.Pclass,
-				buf.String(),
-				feat.Properties.Population,
-				feat.Properties.Cartodb_id,
-				feat.Properties.Created_at,
-				feat.Properties.Updated_at)
-			if err != nil {
-				return internalError(err)
-			}
+		return &httpRetMsg{
+			http.StatusOK,
+			api.CitiesTempl{
+				Cities: found.around,
+			},
 		}
-
-		s.db.BatchFlush()
-
-		return &httpRetMsg{code: http.StatusCreated}
 	}
 }
 
-func findHandler(s *Server) appHandler {
-	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
-		vars := mux.Vars(r)
-		cityId := vars["id"]
-
-		// Get city node
-		city, err := s.db.GetCity(cityId)
-		if err != nil {
-			return internalError(err)
-		}
+// City of a find request, and cities around it when a distance is given
+type foundCities struct {
+	city   api.CityTempl
+	dist   uint64
+	around []api.CityTempl
+}
 
-		// City not found
-		if city.Root == nil {
-			return &httpRetMsg{
-				http.StatusNotFound,
-				ErrorRep{fmt.Sprintf(ErrNotFoundId, cityId)},
-			}
-		}
+// Get the city of a find request and the cities around it, shared by every API version
+func findCities(s *Server, r *http.Request) (*foundCities, *httpRetMsg) {
+	vars := mux.Vars(r)
+	at := asOf(r)
+	city, geo, ret := findCityAt(s, vars["id"], at)
+	if ret != nil {
+		return nil, ret
+	}
+	found := &foundCities{city: *city}
 
-		geo, err := dgclient.DecodeGeoDatas(city.Root.Geo)
-		if err != nil {
-			return internalError(err)
-		}
+	u, ok := getQsValues(r).getUInt("dist")
+	if ok == false {
+		return found, nil
+	}
+	found.dist = u
 
-		r.ParseForm()
+	if u == 0 {
+		// Case where dist == 0, only the city is returned
+		found.around = []api.CityTempl{found.city}
+		return found, nil
+	}
 
-		cityInfos := CityTempl{
-			CartodbId: city.Root.Cartodb_id,
-			Name: city.Root.Name,
-			Population: city.Root.Population,
-			Coordinates: geo.FlatCoords(),
-		}
+	if found.around, ret = citiesAroundAt(s, geo, u, at); ret != nil {
+		return nil, ret
+	}
+	return found, nil
+}
 
-		v, ok := r.Form["dist"]
-		if ok == false {
-			// Simple get of city informations
-			return &httpRetMsg{
-				http.StatusOK,
-				cityInfos,
-			}
-		}
+// Get a city and its coordinates by id as it was at a time, the current one when at is zero,
+// shared by every API
+func findCityAt(s *Server, cityId string, at time.Time) (*api.CityTempl, []float64, *httpRetMsg) {
+	// Get city node
+	var city dgclient.CityRep
+	var err error
+	if at.IsZero() {
+		city, err = s.db.GetCity(cityId)
+	} else {
+		city, err = s.db.GetCityAt(cityId, at)
+	}
+	if err != nil {
+		return nil, nil, internalError(err)
+	}
 
-		u, err := getUIntQsParam(v, "dist")
-		if err != nil {
-			// Bad uint parameter
-			return &httpRetMsg{
-				http.StatusBadRequest,
-				ErrorRep{err.Error()},
-			}
+	// City not found
+	if city.Root == nil {
+		msg := fmt.Sprintf(ErrNotFoundId, cityId)
+		if !at.IsZero() {
+			msg = fmt.Sprintf(ErrNotFoundIdAt, cityId, at.Format(time.RFC3339Nano))
 		}
-		if u == 0 {
-			// Case where dist == 0, only the city is returned
-			return &httpRetMsg{
-				http.StatusOK,
-				CitiesTempl{
-					[]CityTempl{
-						cityInfos,
-					},
-				},
-			}
+		return nil, nil, &httpRetMsg{
+			http.StatusNotFound,
+			api.ErrorRep{Error: msg},
 		}
+	}
 
-		var cities dgclient.CitiesRep
-		cities, err = s.db.GetCitiesAround(geo.FlatCoords(), u)
-		if err != nil {
-			return internalError(err)
-		}
+	geo, err := dgclient.DecodeGeoDatas(city.Root.Geo)
+	if err != nil {
+		return nil, nil, internalError(err)
+	}
 
-		citiesArr := make([]CityTempl, len(cities.Root))
-		for i, city := range cities.Root {
-			citiesArr[i].CartodbId = city.Cartodb_id
-			citiesArr[i].Name = city.Name
-			citiesArr[i].Population = city.Population
+	return &api.CityTempl{
+		CartodbId: city.Root.Cartodb_id,
+		Name: city.Root.Name,
+		Population: city.Root.Population,
+		Coordinates: geo.FlatCoords(),
+	}, geo.FlatCoords(), nil
+}
 
-			if geo, err := dgclient.DecodeGeoDatas(city.Geo); err != nil {
-				return internalError(err)
-			} else {
-				citiesArr[i].Coordinates = geo.FlatCoords()
-			}
-		}
+// Get the cities in a square of side dist (in kilometers) around a location as they were at a
+// time, the current ones when at is zero, shared by every API
+func citiesAroundAt(s *Server, center []float64, dist uint64, at time.Time) ([]api.CityTempl, *httpRetMsg) {
+	var cities dgclient.CitiesRep
+	var err error
+	if at.IsZero() {
+		cities, err = s.db.GetCitiesAround(center, dist)
+	} else {
+		cities, err = s.db.GetCitiesAroundAt(center, dist, at)
+	}
+	if err != nil {
+		return nil, internalError(err)
+	}
 
-		return &httpRetMsg{
-			http.StatusOK,
-			CitiesTempl{
-				citiesArr,
-			},
-		}
+	citiesArr, err := citiesTempl(cities)
+	if err != nil {
+		return nil, internalError(err)
 	}
+	return citiesArr, nil
 }
 
+func citiesTempl(cities dgclient.CitiesRep) ([]api.CityTempl, error) {
+	citiesArr := make([]api.CityTempl, len(cities.Root))
+	for i, city := range cities.Root {
+		citiesArr[i].CartodbId = city.Cartodb_id
+		citiesArr[i].Name = city.Name
+		citiesArr[i].Population = city.Population
+
+		if geo, err := dgclient.DecodeGeoDatas(city.Geo); err != nil {
+			return nil, err
+		} else {
+			citiesArr[i].Coordinates = geo.FlatCoords()
+		}
+	}
+	return citiesArr, nil
+}
 
 /*
  *  Private Helpers
  */
 
+// Error message of a reply, for APIs replying with a single message
+func retMessage(ret *httpRetMsg) string {
+	msg := http.StatusText(ret.code)
+	switch rep := ret.jsonTempl.(type) {
+	case api.ErrorRep:
+		msg = rep.Error
+		if len(rep.Details) > 0 {
+			msg += ": " + strings.Join(rep.Details, ", ")
+		}
+	case api.ImportRep:
+		msg = rep.Error
+		for _, r := range rep.Rejected {
+			msg += fmt.Sprintf("; feature %v: %v", r.Index, strings.Join(r.Reasons, ", "))
+		}
+	}
+	return msg
+}
+
 // Print to the console + return json message internal error
 func internalError(err error) *httpRetMsg {
 	fmt.Fprintf(os.Stderr, "ERROR: %+v\n", err)
 	return &httpRetMsg{code: http.StatusInternalServerError}
 }
-
-// Check validation of uint64 query string parameter
-func getUIntQsParam(v []string, key string) (uint64, error) {
-	if len(v) != 1 {
-		return 0, fmt.Errorf(ErrTooManyValues, key)
-	} else {
-		if u, err := strconv.ParseUint(v[0], 10, 64); err != nil {
-			return 0, fmt.Errorf(ErrInvalidUIntQsParam, v[0], key)
-		} else {
-			return u, nil
-		}
-	}
-}
@@ -1,18 +1,69 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"github.com/AsT4re/cancities/dgclient"
+	"github.com/AsT4re/cancities/rpc"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"github.com/AsT4re/cancities/api"
 )
 
+var testKeysFile string
+
+var updateOpenAPI = flag.Bool("update-openapi", false, "Write generated OpenAPI specification to "+openAPIFile)
+
+// OpenAPI specification committed along with the code
+const openAPIFile = "../openapi.json"
+
+const testKeys = `
+keys:
+  - name: test-reader
+    key: reader-key
+    role: reader
+  - name: test-importer
+    key: importer-key
+    role: importer
+  - name: test-admin
+    key: admin-key
+    role: admin
+`
+
 func TestMain(m *testing.M) {
+	f, err := ioutil.TempFile("", "api_keys_")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %+v\n", err)
+		os.Exit(1)
+	}
+	f.WriteString(testKeys)
+	f.Close()
+	testKeysFile = f.Name()
+
 	code := m.Run()
+	os.Remove(testKeysFile)
 	os.Exit(code)
 }
 
@@ -28,9 +79,9 @@ func TestRouteNotFound(t *testing.T) {
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
 
-	expected := ErrorRep{fmt.Sprintf(ErrRouteNotFound, req.Method, req.URL.Path)}
+	expected := api.ErrorRep{Error: fmt.Sprintf(ErrRouteNotFound, req.Method, req.URL.Path)}
 
-	var result ErrorRep
+	var result api.ErrorRep
 	checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
 }
 
@@ -41,9 +92,9 @@ func TestBadId(t *testing.T) {
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
 
-	expected := ErrorRep{fmt.Sprintf(ErrRouteNotFound, req.Method, req.URL.Path)}
+	expected := api.ErrorRep{Error: fmt.Sprintf(ErrRouteNotFound, req.Method, req.URL.Path)}
 
-	var result ErrorRep
+	var result api.ErrorRep
 	checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
 }
 
@@ -54,14 +105,32 @@ func TestFoundId(t *testing.T) {
 	checkResponseCode(t, http.StatusOK, response.Code)
 	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
 
-	expected := CityTempl {
-		42,
-		"Amherstburg",
-		8921,
-		[]float64{-83.108128, 42.100072},
+	expected := api.CityTempl {
+		CartodbId: 42,
+		Name: "Amherstburg",
+		Population: 8921,
+		Coordinates: []float64{-83.108128, 42.100072},
 	}
 
-	var result CityTempl
+	var result api.CityTempl
+	checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
+}
+
+// Test v2 envelope of a found city
+func TestFoundIdV2(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/v2/id/42", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
+
+	id := int64(42)
+	coords := []float64{-83.108128, 42.100072}
+	expected := api.CityRepV2 {
+		Data: api.CityTempl{CartodbId: 42, Name: "Amherstburg", Population: 8921, Coordinates: coords},
+		Meta: api.QueryMetaRep{CartodbId: &id, Center: coords},
+	}
+
+	var result api.CityRepV2
 	checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
 }
 
@@ -73,9 +142,9 @@ func TestNotFoundId(t *testing.T) {
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
 
-	expected := ErrorRep{fmt.Sprintf(ErrNotFoundId, id)}
+	expected := api.ErrorRep{Error: fmt.Sprintf(ErrNotFoundId, id)}
 
-	var result ErrorRep
+	var result api.ErrorRep
 	checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
 }
 
@@ -87,9 +156,92 @@ func TestInvalidDistParam(t *testing.T) {
 	checkResponseCode(t, http.StatusBadRequest, response.Code)
 	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
 
-	expected := ErrorRep{fmt.Sprintf(ErrInvalidUIntQsParam, dist, "dist")}
+	expected := api.ErrorRep{
+		Error: ErrInvalidQsParams,
+		Details: []string{fmt.Sprintf(ErrInvalidUIntQsParam, dist, "dist")},
+	}
+
+	var result api.ErrorRep
+	checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
+}
+
+// Test for invalid as_of qs parameter, accepted by every read route
+func TestInvalidAsOfParam(t *testing.T) {
+	for _, path := range []string{"/v1/id/42", "/v2/id/42", "/near?lon=1&lat=2&dist=3", "/v2/cities", "/cities:batchGet"} {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		method := "GET"
+		if strings.HasSuffix(path, ":batchGet") {
+			method = "POST"
+		}
+		req, _ := http.NewRequest(method, path + sep + "as_of=2017-13-01", strings.NewReader(`{"ids": [42]}`))
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+		expected := api.ErrorRep{
+			Error: ErrInvalidQsParams,
+			Details: []string{fmt.Sprintf(ErrInvalidTimeQsParam, "2017-13-01", "as_of")},
+		}
+
+		var result api.ErrorRep
+		checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
+	}
+}
+
+// Test for versions stored before history was recorded, and current versions
+func TestVersionTempl(t *testing.T) {
+	geo, _ := dgclient.EncodePoint([]float64{-73.57, 45.5})
+	validTo := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	legacy, err := versionTempl(&dgclient.CityProps{Name: "Montreal", Population: 1600000, Geo: geo}, &validTo)
+	if err != nil || legacy.ValidFrom != nil || legacy.ValidTo == nil || legacy.ImportId != "" {
+		t.Errorf("Unexpected legacy version %+v, error %v\n", legacy, err)
+	}
+
+	city := &dgclient.CityProps{Name: "Montreal", Geo: geo, Valid_from: validTo, Import_id: "import-1"}
+	current, err := versionTempl(city, nil)
+	if err != nil || current.ValidFrom == nil || !current.ValidFrom.Equal(validTo) || current.ValidTo != nil ||
+		current.ImportId != "import-1" || !reflect.DeepEqual(current.Coordinates, []float64{-73.57, 45.5}) {
+		t.Errorf("Unexpected current version %+v, error %v\n", current, err)
+	}
+}
+
+// Test for unknown, duplicated and out of range qs parameters reported together
+func TestInvalidQsParams(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/id/42?distance=10&dist=1&dist=2&foo=bar", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
+
+	expected := api.ErrorRep{
+		Error: ErrInvalidQsParams,
+		Details: []string{
+			fmt.Sprintf(ErrTooManyValues, "dist"),
+			fmt.Sprintf(ErrUnknownQsParam, "distance"),
+			fmt.Sprintf(ErrUnknownQsParam, "foo"),
+		},
+	}
 
-	var result ErrorRep
+	var result api.ErrorRep
+	checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
+}
+
+// Test for dist qs parameter out of allowed range
+func TestOutOfRangeDistParam(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/id/42?dist=100000", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
+
+	expected := api.ErrorRep{
+		Error: ErrInvalidQsParams,
+		Details: []string{
+			fmt.Sprintf(ErrOutOfRangeQsParam, "100000", "dist", 0, MaxDist),
+		},
+	}
+
+	var result api.ErrorRep
 	checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
 }
 
@@ -100,36 +252,36 @@ func TestCitiesAround(t *testing.T) {
 	checkResponseCode(t, http.StatusOK, response.Code)
 	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
 
-	expected := CitiesTempl {
-		[]CityTempl {
-			CityTempl {
-				134,
-				"Bradley",
-				2500,
-				[]float64{-82.411366, 42.339783},
+	expected := api.CitiesTempl {
+		Cities: []api.CityTempl {
+			api.CityTempl {
+				CartodbId: 134,
+				Name: "Bradley",
+				Population: 2500,
+				Coordinates: []float64{-82.411366, 42.339783},
 			},
-			CityTempl {
-				123,
-				"Jeannettes Creek",
-				244,
-				[]float64{-82.421253, 42.315238},
+			api.CityTempl {
+				CartodbId: 123,
+				Name: "Jeannettes Creek",
+				Population: 244,
+				Coordinates: []float64{-82.421253, 42.315238},
 			},
-			CityTempl {
-				106,
-				"Lighthouse",
-				410,
-				[]float64{-82.452364, 42.290865},
+			api.CityTempl {
+				CartodbId: 106,
+				Name: "Lighthouse",
+				Population: 410,
+				Coordinates: []float64{-82.452364, 42.290865},
 			},
 		},
 	}
 
-	expMap := make(map[int64]CityTempl)
+	expMap := make(map[int64]api.CityTempl)
 	for _, city := range expected.Cities {
 		expMap[city.CartodbId] = city
 	}
 
 	body := response.Body.Bytes()
-	var result CitiesTempl
+	var result api.CitiesTempl
 	if err := json.Unmarshal(body, &result); err != nil {
 		var out bytes.Buffer
 		json.Indent(&out, body, "", "  ")
@@ -157,21 +309,1013 @@ func TestNotFoundIdWithDist(t *testing.T) {
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
 
-	expected := ErrorRep{fmt.Sprintf(ErrNotFoundId, id)}
+	expected := api.ErrorRep{Error: fmt.Sprintf(ErrNotFoundId, id)}
 
-	var result ErrorRep
+	var result api.ErrorRep
 	checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
 }
 
+// Test import rejected as a whole when a feature is invalid
+func TestImportInvalidFeatures(t *testing.T) {
+	body := `{
+  "type": "FeatureCollection",
+  "features": [
+    {
+      "type": "Feature",
+      "geometry": {"type": "Point", "coordinates": [-80.643498, 43.069946]},
+      "properties": {"name": "Oriel", "population": 2500, "cartodb_id": 744}
+    },
+    {
+      "type": "Feature",
+      "geometry": {"type": "Polygon", "coordinates": [[[0, 0], [1, 1], [0, 1], [0, 0]]]},
+      "properties": {"name": "", "population": -3}
+    },
+    {
+      "type": "Feature",
+      "geometry": {"type": "Point", "coordinates": [-200, 43.069946]},
+      "properties": {"name": "Oriel bis", "population": 10, "cartodb_id": 744}
+    }
+  ]
+}`
+	req, _ := http.NewRequest("POST", "/import", bytes.NewBufferString(body))
+	req.Header.Set("X-API-Key", "importer-key")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
+
+	id := int64(744)
+	expected := api.ImportRep{
+		Error: fmt.Sprintf(ErrInvalidFeatures, 2),
+		Imported: 0,
+		Rejected: []api.RejectedFeature{
+			{
+				Index: 1,
+				CartodbId: nil,
+				Reasons: []string{
+					fmt.Sprintf(ErrGeometryType, "Polygon"),
+					ErrMissingCartodbId,
+					ErrEmptyName,
+					fmt.Sprintf(ErrNegativePopulation, -3),
+				},
+			},
+			{
+				Index: 2,
+				CartodbId: &id,
+				Reasons: []string{
+					fmt.Sprintf(ErrLongitudeRange, -200.0),
+					fmt.Sprintf(ErrDuplicatedCartodbId, 0),
+				},
+			},
+		},
+	}
+
+	var result api.ImportRep
+	checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
+}
+
+// Test dry run import counting changes without modifying DB
+func TestImportDryRun(t *testing.T) {
+	body := `{
+  "type": "FeatureCollection",
+  "features": [
+    {
+      "type": "Feature",
+      "geometry": {"type": "Point", "coordinates": [-83.108128, 42.100072]},
+      "properties": {"name": "Amherstburg", "population": 9999, "cartodb_id": 42}
+    },
+    {
+      "type": "Feature",
+      "geometry": {"type": "Point", "coordinates": [-80.643498, 43.069946]},
+      "properties": {"name": "Nowhere", "population": 1, "cartodb_id": 4234534}
+    }
+  ]
+}`
+	req, _ := http.NewRequest("POST", "/import?dry_run=true", bytes.NewBufferString(body))
+	req.Header.Set("X-API-Key", "importer-key")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
+
+	expected := api.ImportRep{
+		DryRun: true,
+		Imported: 0,
+		Changes: &api.ImportChanges{Inserted: 1, Updated: 1, Unchanged: 0},
+		Rejected: []api.RejectedFeature{},
+	}
+
+	var result api.ImportRep
+	checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
+}
+
+// Test write routes refused without valid API key
+func TestImportUnauthorized(t *testing.T) {
+	for _, key := range []string{"", "wrong-key"} {
+		req, _ := http.NewRequest("POST", "/import", bytes.NewBufferString(`{"features": []}`))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusUnauthorized, response.Code)
+		checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
+
+		expected := api.ErrorRep{Error: ErrUnauthorized}
+
+		var result api.ErrorRep
+		checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
+	}
+}
+
+// Test metrics served to admins
+func TestMetrics(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("X-API-Key", "admin-key")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if !strings.Contains(response.Body.String(), "go_goroutines") {
+		t.Errorf("Expected Prometheus metrics, got:\n%s\n", response.Body.String())
+	}
+}
+
+// Test routes refused for API keys without the required role
+func TestForbiddenRole(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		key    string
+		role   role
+	}{
+		{"POST", "/import", "reader-key", roleImporter},
+		{"DELETE", "/admin/cities", "reader-key", roleAdmin},
+		{"DELETE", "/admin/cities", "importer-key", roleAdmin},
+		{"GET", "/metrics", "reader-key", roleAdmin},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.path, nil)
+		req.Header.Set("Authorization", "Bearer " + test.key)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusForbidden, response.Code)
+		checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
+
+		expected := api.ErrorRep{Error: fmt.Sprintf(ErrForbidden, test.role)}
+
+		var result api.ErrorRep
+		checkJsonBody(t, req, response.Body.Bytes(), &expected, &result)
+	}
+}
+
+// Test TLS configuration built from options
+func TestTLSConfig(t *testing.T) {
+	certs, err := newCertReloader("../certificates/server.crt", "../certificates/server.key")
+	if err != nil {
+		t.Fatalf("Unexpected error loading certificate: %v\n", err)
+	}
+
+	opts := TLSOptions{
+		ClientCA: "../certificates/server.crt",
+		MinVersion: "1.2",
+		Ciphers: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	}
+	config, err := newTLSConfig(opts, certs)
+	if err != nil {
+		t.Fatalf("Unexpected error building TLS config: %v\n", err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || config.ClientAuth != tls.RequireAndVerifyClientCert ||
+		!reflect.DeepEqual(config.CipherSuites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}) {
+		t.Errorf("TLS config does not match options %+v\n", opts)
+	}
+	if cert, _ := config.GetCertificate(nil); cert == nil {
+		t.Errorf("No certificate given by TLS config\n")
+	}
+
+	for _, bad := range []TLSOptions{{MinVersion: "2.0"}, {Ciphers: "TLS_NOPE"}} {
+		if _, err := newTLSConfig(bad, certs); err == nil {
+			t.Errorf("Expected error for TLS options %+v\n", bad)
+		}
+	}
+}
+
+// Test token buckets of rate limiter
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter()
+	limit := &rateLimit{name: "test", rate: 0.5, burst: 2}
+	limits := []*rateLimit{limit}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if refused, _ := rl.take(limits, "ip:10.0.0.1", now); refused != nil {
+			t.Errorf("Request %v refused within burst\n", i)
+		}
+	}
+
+	refused, wait := rl.take(limits, "ip:10.0.0.1", now)
+	if refused != limit || wait != 2 * time.Second {
+		t.Errorf("Expected request refused with 2s wait, got %v and %v\n", refused, wait)
+	}
+
+	if refused, _ := rl.take(limits, "ip:10.0.0.2", now); refused != nil {
+		t.Errorf("Request of another client refused\n")
+	}
+
+	if refused, _ := rl.take(limits, "ip:10.0.0.1", now.Add(wait)); refused != nil {
+		t.Errorf("Request refused after waiting for a new token\n")
+	}
+}
+
+// Test limits set by the config applied to the routes of their kind
+func TestConfiguredRateLimit(t *testing.T) {
+	config := testConfig()
+	config.ReadBurst = 2
+	s := new(Server)
+	if err := s.Init(config); err != nil {
+		t.Fatalf("Fail to init server: %+v\n", err)
+	}
+	defer s.Close()
+
+	for i, code := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		req, _ := http.NewRequest("POST", "/cities:batchGet", bytes.NewBufferString(`{"ids": []}`))
+		req.Header.Set("X-API-Key", "reader-key")
+		response := httptest.NewRecorder()
+		s.Handler().ServeHTTP(response, req)
+		if response.Code != code {
+			t.Errorf("Request %v: expected response code %v, got %v\n", i, code, response.Code)
+		}
+	}
+}
+
+// Test tokens of other limits kept when one of the limits of a request refuses it
+func TestRateLimiterRefusedKeepsTokens(t *testing.T) {
+	rl := newRateLimiter()
+	general := &rateLimit{name: "general", rate: 0.5, burst: 2}
+	strict := &rateLimit{name: "strict", rate: 0.5, burst: 1}
+	now := time.Now()
+
+	for i, expected := range []*rateLimit{nil, strict, strict} {
+		if refused, _ := rl.take([]*rateLimit{general, strict}, "ip:10.0.0.1", now); refused != expected {
+			t.Errorf("Request %v: expected refusal by %v, got %v\n", i, expected, refused)
+		}
+	}
+
+	if refused, _ := rl.take([]*rateLimit{general}, "ip:10.0.0.1", now); refused != nil {
+		t.Errorf("Request refused by a limit whose tokens were taken by refused requests\n")
+	}
+}
+
+// Test LRU eviction, expiry and purge of cached responses
+func TestResponseCache(t *testing.T) {
+	c := newResponseCache(2, time.Minute)
+	ok := &httpRetMsg{http.StatusOK, nil}
+
+	c.Add("a", c.Generation(), ok)
+	c.Add("b", c.Generation(), ok)
+	c.Get("a")
+	c.Add("c", c.Generation(), ok)
+	if _, found := c.Get("b"); found {
+		t.Errorf("Least recently used entry not evicted\n")
+	}
+	if _, found := c.Get("a"); !found {
+		t.Errorf("Recently used entry evicted\n")
+	}
+
+	gen := c.Generation()
+	c.Purge()
+	if c.Len() != 0 {
+		t.Errorf("Expected empty cache after purge, got %v entries\n", c.Len())
+	}
+	c.Add("a", gen, ok)
+	if _, found := c.Get("a"); found {
+		t.Errorf("Response computed before purge added to cache\n")
+	}
+
+	expired := newResponseCache(2, 0)
+	expired.Add("a", expired.Generation(), ok)
+	if _, found := expired.Get("a"); found {
+		t.Errorf("Expired entry returned\n")
+	}
+
+	disabled := newResponseCache(0, time.Minute)
+	disabled.Add("a", disabled.Generation(), ok)
+	if disabled.Len() != 0 {
+		t.Errorf("Entry added to disabled cache\n")
+	}
+}
+
+// Test cached responses not served anymore once the dataset version is bumped, e.g. by a load
+func TestCachedDatasetVersion(t *testing.T) {
+	s := &Server{cache: newResponseCache(10, time.Minute)}
+	calls := 0
+	handler := cached(s, func(w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		calls++
+		return &httpRetMsg{http.StatusOK, nil}
+	})
+
+	for i, version := range []int64{1, 1, 2} {
+		req, _ := http.NewRequest("GET", "/id/1", nil)
+		ctx := context.WithValue(req.Context(), datasetVersionKey, dgclient.DatasetVersion{Version: version})
+		handler(httptest.NewRecorder(), req.WithContext(ctx))
+		if expected := int(version); calls != expected {
+			t.Errorf("Request %v: expected %v handler calls, got %v\n", i, expected, calls)
+		}
+	}
+}
+
+// Test 304 replies to If-None-Match and If-Modified-Since matching the dataset version
+func TestConditionalRequest(t *testing.T) {
+	h := make(http.Header)
+	setValidators(h, dgclient.DatasetVersion{Version: 3, ModifiedAt: time.Unix(1500000000, 0)})
+
+	cases := []struct {
+		method   string
+		header   string
+		value    string
+		expected bool
+	}{
+		{"GET", "If-None-Match", h.Get("ETag"), true},
+		{"HEAD", "If-None-Match", `"other", ` + h.Get("ETag"), true},
+		{"GET", "If-None-Match", "W/" + h.Get("ETag"), true},
+		{"GET", "If-None-Match", "*", true},
+		{"GET", "If-None-Match", `"2-596682f0"`, false},
+		{"POST", "If-None-Match", h.Get("ETag"), false},
+		{"GET", "If-Modified-Since", h.Get("Last-Modified"), true},
+		{"GET", "If-Modified-Since", time.Unix(1499999999, 0).UTC().Format(http.TimeFormat), false},
+		{"GET", "If-Modified-Since", "not a date", false},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, "/id/1", nil)
+		req.Header.Set(c.header, c.value)
+		if res := notModified(req, h); res != c.expected {
+			t.Errorf("%v with %v: %v, expected not modified %v, got %v\n",
+				c.method, c.header, c.value, c.expected, res)
+		}
+	}
+}
+
+// Test conditional requests matching the dataset version answered without running the handler,
+// and validators dropped when cities are modified while the response is computed
+func TestValidatedRequest(t *testing.T) {
+	s := new(Server)
+	version := dgclient.DatasetVersion{Version: 3, ModifiedAt: time.Unix(1500000000, 0)}
+	h := make(http.Header)
+	setValidators(h, version)
+
+	calls := 0
+	handler := func(modify bool) appHandler {
+		return func(w http.ResponseWriter, r *http.Request) *httpRetMsg {
+			calls++
+			if modify {
+				atomic.AddUint64(&s.modSeq, 2)
+			}
+			return &httpRetMsg{http.StatusOK, nil}
+		}
+	}
+
+	cases := []struct {
+		etag     string
+		modify   bool
+		code     int
+		calls    int
+		expected string
+	}{
+		{h.Get("ETag"), false, http.StatusNotModified, 0, h.Get("ETag")},
+		{`"2-596682f0"`, false, http.StatusOK, 1, h.Get("ETag")},
+		{`"2-596682f0"`, true, http.StatusOK, 1, ""},
+	}
+	for i, c := range cases {
+		calls = 0
+		req, _ := http.NewRequest("GET", "/id/1", nil)
+		req.Header.Set("If-None-Match", c.etag)
+		response := httptest.NewRecorder()
+		validated(s, atomic.LoadUint64(&s.modSeq), version, handler(c.modify)).ServeHTTP(response, req)
+		if response.Code != c.code || calls != c.calls || response.HeaderMap.Get("ETag") != c.expected {
+			t.Errorf("Case %v: expected code %v, %v handler calls and ETag %q, got %v, %v and %q\n", i,
+				c.code, c.calls, c.expected, response.Code, calls, response.HeaderMap.Get("ETag"))
+		}
+	}
+}
+
+// Test settings refused by config validation
+func TestConfigValidate(t *testing.T) {
+	config := testConfig()
+	if err := config.Validate(); err != nil {
+		t.Errorf("Unexpected error for valid config: %v\n", err)
+	}
+
+	invalid := []func(c *Config){
+		func(c *Config) { c.Port = "http" },
+		func(c *Config) { c.Port = "70000" },
+		func(c *Config) { c.GRPCImportMaxBytes = 0 },
+		func(c *Config) { c.DgConnsPool = 0 },
+		func(c *Config) { c.DgHostAndPort = "localhost" },
+		func(c *Config) { c.TLSKey = "" },
+		func(c *Config) { c.TLSMinVersion = "2.0" },
+		func(c *Config) { c.AnonymousRole = "guest" },
+		func(c *Config) { c.CacheSize = -1 },
+		func(c *Config) { c.GraphQLMaxDepth = 0 },
+		func(c *Config) { c.GraphQLMaxComplexity = 0 },
+		func(c *Config) { c.EventsBuffer = -1 },
+		func(c *Config) { c.BatchGetMaxIds = 0 },
+		func(c *Config) { c.ReadRate = 0 },
+		func(c *Config) { c.ExportRate = -1 },
+		func(c *Config) { c.ImportBurst = 0 },
+		func(c *Config) { c.LargeDist = MaxDist + 1 },
+	}
+	for i, change := range invalid {
+		config := testConfig()
+		change(&config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected error for invalid config %v: %+v\n", i, config)
+		}
+	}
+
+	shown := testConfig().Redacted()
+	if shown.TLSKey != redacted || shown.APIKeys != redacted {
+		t.Errorf("Secrets not redacted: %+v\n", shown)
+	}
+}
+
+// Test effective configuration shown to admins, secrets being redacted
+func TestAdminConfig(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/config", nil)
+	req.Header.Set("X-API-Key", "admin-key")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
+	expected := testConfig().Redacted()
+	checkJsonBody(t, req, response.Body.Bytes(), &expected, &Config{})
+}
+
+// Fail when routes or templates change without the committed specification being updated
+func TestOpenAPISpec(t *testing.T) {
+	generated, err := json.MarshalIndent(buildOpenAPISpec(getRoutes(new(Server))), "", "  ")
+	if err != nil {
+		t.Fatalf("Fail to serialize OpenAPI specification: %v\n", err)
+	}
+	generated = append(generated, '\n')
+
+	if *updateOpenAPI {
+		if err := ioutil.WriteFile(openAPIFile, generated, 0644); err != nil {
+			t.Fatalf("Fail to write %v: %v\n", openAPIFile, err)
+		}
+	}
+
+	committed, err := ioutil.ReadFile(openAPIFile)
+	if err != nil {
+		t.Fatalf("Fail to read %v: %v\n", openAPIFile, err)
+	}
+	if !bytes.Equal(generated, committed) {
+		t.Errorf("%v is out of date, update it with 'go test ./server -run TestOpenAPISpec -update-openapi'\n",
+			openAPIFile)
+	}
+}
+
+// Test specification served at /openapi.json without key
+func TestOpenAPIRoute(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
+
+	var spec map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &spec); err != nil || spec["openapi"] != "3.0.0" {
+		t.Errorf("Invalid OpenAPI specification served: %v\n", err)
+	}
+}
+
+// Test near requests refused without longitude
+func TestNearMissingParams(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/v1/near?lat=45.5&dist=10", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
+
+	expected := api.ErrorRep{
+		Error: ErrInvalidQsParams,
+		Details: []string{fmt.Sprintf(ErrMissingQsParam, "lon")},
+	}
+	checkJsonBody(t, req, response.Body.Bytes(), &expected, &api.ErrorRep{})
+}
+
+// Test near requests with a null distance answered without searching
+func TestNearNullDist(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/v1/near?lon=-79.07&lat=43.09&dist=0", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	expected := api.CitiesTempl{Cities: []api.CityTempl{}}
+	checkJsonBody(t, req, response.Body.Bytes(), &expected, &api.CitiesTempl{})
+}
+
+// Test public routes served under /v1 and /v2, unversioned paths being deprecated
+func TestVersionedPaths(t *testing.T) {
+	cases := []struct {
+		path       string
+		code       int
+		deprecated bool
+	}{
+		{"/id/42?dist=abc", http.StatusBadRequest, true},
+		{"/v1/id/42?dist=abc", http.StatusBadRequest, false},
+		{"/v1/id/42?limit=10", http.StatusBadRequest, false},
+		{"/v2/id/42?limit=0", http.StatusBadRequest, false},
+		{"/v3/id/42", http.StatusNotFound, false},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", c.path, nil)
+		response := executeRequest(req)
+		checkResponseCode(t, c.code, response.Code)
+
+		deprecation := response.HeaderMap.Get("Deprecation")
+		if c.deprecated && (deprecation != "true" ||
+			response.HeaderMap.Get("Link") != `</v1/id/42>; rel="successor-version"`) {
+			t.Errorf("Expected deprecation headers for %v, got %v\n", c.path, response.HeaderMap)
+		} else if !c.deprecated && deprecation != "" {
+			t.Errorf("Unexpected Deprecation header for %v\n", c.path)
+		}
+	}
+}
+
+// Test gRPC requests with out of range arguments refused before DGraph is reached
+func TestGRPCInvalidArguments(t *testing.T) {
+	c, stop := startGRPC(t, testConfig())
+	defer stop()
+
+	ctx := context.Background()
+	_, err := c.GetCitiesAround(ctx, &rpc.GetCitiesAroundRequest{CartodbId: 42, Dist: MaxDist + 1})
+	checkGRPCCode(t, codes.InvalidArgument, err)
+	_, err = c.GetCity(ctx, &rpc.GetCityRequest{CartodbId: -1})
+	checkGRPCCode(t, codes.InvalidArgument, err)
+	_, err = c.GetCity(ctx, &rpc.GetCityRequest{CartodbId: 42, AsOf: &timestamp.Timestamp{Nanos: -1}})
+	checkGRPCCode(t, codes.InvalidArgument, err)
+	_, err = c.GetCitiesAround(ctx, &rpc.GetCitiesAroundRequest{CartodbId: 42, AsOf: &timestamp.Timestamp{Nanos: -1}})
+	checkGRPCCode(t, codes.InvalidArgument, err)
+	_, err = c.SearchByName(ctx, &rpc.SearchByNameRequest{Name: " "})
+	checkGRPCCode(t, codes.InvalidArgument, err)
+	_, err = c.SearchByName(ctx, &rpc.SearchByNameRequest{Name: "Montreal", Limit: MaxPageSize + 1})
+	checkGRPCCode(t, codes.InvalidArgument, err)
+}
+
+// Test gRPC methods refused to unknown keys and to keys without the required role
+func TestGRPCAuthorization(t *testing.T) {
+	c, stop := startGRPC(t, testConfig())
+	defer stop()
+
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("x-api-key", "unknown-key"))
+	_, err := c.GetCity(ctx, &rpc.GetCityRequest{CartodbId: 42})
+	checkGRPCCode(t, codes.Unauthenticated, err)
+
+	// Anonymous role is reader
+	stream, err := c.ImportCities(context.Background())
+	if err == nil {
+		_, err = stream.CloseAndRecv()
+	}
+	checkGRPCCode(t, codes.Unauthenticated, err)
+
+	ctx = metadata.NewOutgoingContext(context.Background(), metadata.Pairs("x-api-key", "reader-key"))
+	if stream, err = c.ImportCities(ctx); err == nil {
+		_, err = stream.CloseAndRecv()
+	}
+	checkGRPCCode(t, codes.PermissionDenied, err)
+}
+
+// Test stopping past the deadline when gRPC is disabled, which has nothing to force to stop
+func TestStopWithoutGRPC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 50; i++ {
+		s := &Server{events: newEventBroker(1), server: &http.Server{}}
+		s.webhooks, _ = loadWebhooks("")
+		s.Stop(&ctx)
+	}
+}
+
+// Invalid features are rejected before DGraph is reached
+func TestGRPCImportInvalidFeature(t *testing.T) {
+	c, stop := startGRPC(t, testConfig())
+	defer stop()
+
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("authorization", "Bearer importer-key"))
+	stream, err := c.ImportCities(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	reqs := []*rpc.ImportCitiesRequest{
+		{Options: &rpc.ImportOptions{DryRun: true}, Feature: &rpc.Feature{CartodbId: 1, Name: "A", Latitude: 100}},
+		{Feature: &rpc.Feature{CartodbId: 2, Name: ""}},
+	}
+	for _, req := range reqs {
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	checkGRPCCode(t, codes.InvalidArgument, err)
+
+	expected := fmt.Sprintf(ErrInvalidFeatures, 2) + "; feature 0: " + fmt.Sprintf(ErrLatitudeRange, 100.0) +
+		"; feature 1: " + ErrEmptyName
+	if st, _ := status.FromError(err); st.Message() != expected {
+		t.Errorf("Expected message %q, got %q\n", expected, st.Message())
+	}
+}
+
+// Test gRPC imports refused once the streamed features exceed the configured size
+func TestGRPCImportTooLarge(t *testing.T) {
+	config := testConfig()
+	config.GRPCImportMaxBytes = 100
+	c, stop := startGRPC(t, config)
+	defer stop()
+
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("authorization", "Bearer importer-key"))
+	stream, err := c.ImportCities(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	for i := int64(1); i <= 10; i++ {
+		// Sending fails once the server has refused the stream
+		if err := stream.Send(&rpc.ImportCitiesRequest{Feature: &rpc.Feature{CartodbId: i, Name: "Montreal"}}); err != nil {
+			break
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	checkGRPCCode(t, codes.ResourceExhausted, err)
+}
+
+// Invalid queries are refused before anything is resolved
+func TestGraphQLInvalidQueries(t *testing.T) {
+	// Each aliased city is a DGraph query
+	var aliases string
+	for i := 0; i < 100; i++ {
+		aliases += fmt.Sprintf("c%v: city(id: %v) { name } ", i, i)
+	}
+
+	cases := []struct {
+		query     string
+		variables map[string]interface{}
+		error     string
+	}{
+		{"{ city(id: 1) { name }", nil, fmt.Sprintf(ErrGraphQLExpected, "name", "<EOF>")},
+		{"{ city(id: 1) { nom } }", nil, fmt.Sprintf(ErrGraphQLUnknownField, "nom", "City")},
+		{"{ city { name } }", nil, fmt.Sprintf(ErrGraphQLMissingArgument, "id", "Int!", "field 'city'")},
+		{"{ city(id: 1) }", nil, fmt.Sprintf(ErrGraphQLSelectionRequired, "city", "City")},
+		{"{ city(id: \"1\") { name } }", nil, fmt.Sprintf(ErrGraphQLExpectedType, "Int!", `"1"`)},
+		{"mutation { city(id: 1) { name } }", nil, fmt.Sprintf(ErrGraphQLUnsupportedOperation, "mutation")},
+		{"query($id: Float!) { city(id: $id) { name } }", map[string]interface{}{"id": 1},
+			fmt.Sprintf(ErrGraphQLVariableType, "id", "Float!", "Int!")},
+		{"query($id: Int!) { city(id: $id) { name } }", nil, fmt.Sprintf(ErrGraphQLMissingVariable, "id", "Int!")},
+		{"{ ...A } fragment A on Query { ...B } fragment B on Query { ...A }", nil,
+			fmt.Sprintf(ErrGraphQLFragmentCycle, "A")},
+		{"{ a: city(id: 1) { name } a: city(id: 2) { name } }", nil, fmt.Sprintf(ErrGraphQLFieldConflict, "a")},
+		{"{ city(id: 1) { neighbours(radius: 1) { neighbours(radius: 1) { neighbours(radius: 1) {" +
+			" neighbours(radius: 1) { name } } } } } }", nil, fmt.Sprintf(ErrGraphQLMaxDepth, 5)},
+		{"{ citiesNear(lon: 0, lat: 0, radius: 1) { neighbours(radius: 1, limit: 100) { name population } } }",
+			nil, fmt.Sprintf(ErrGraphQLMaxComplexity, 30201, 10000)},
+		{"{ " + aliases + "}", nil, fmt.Sprintf(ErrGraphQLMaxComplexity, 10200, 10000)},
+	}
+
+	for _, c := range cases {
+		body, _ := json.Marshal(api.GraphQLReq{Query: c.query, Variables: c.variables})
+		req, _ := http.NewRequest("POST", "/graphql", bytes.NewReader(body))
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+		var rep api.GraphQLRep
+		if err := json.Unmarshal(response.Body.Bytes(), &rep); err != nil || rep.Data != nil ||
+			len(rep.Errors) != 1 || rep.Errors[0].Message != c.error {
+			t.Errorf("Expected error %q for query %q, got %s\n", c.error, c.query, response.Body.Bytes())
+		}
+	}
+}
+
+// Fields failing before reaching DGraph are null in data, with their error
+func TestGraphQLFieldErrors(t *testing.T) {
+	query := `query Near($radius: Int!) {
+  __typename
+  near: citiesNear(lon: 0, lat: 0, radius: $radius) { name }
+  ... on Query @skip(if: false) { searchCities(name: " ") { name } }
+}`
+	body, _ := json.Marshal(api.GraphQLReq{Query: query, Variables: map[string]interface{}{"radius": MaxDist + 1}})
+	req, _ := http.NewRequest("POST", "/graphql", bytes.NewReader(body))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkContentType(t, JsonContentType, response.HeaderMap.Get("Content-Type"))
+
+	expected := `{"data":{"__typename":"Query","near":null,"searchCities":null},"errors":[` +
+		`{"message":"` + fmt.Sprintf(ErrGraphQLOutOfRangeArg, MaxDist + 1, "radius", 0, MaxDist) +
+		`","locations":[{"line":3,"column":3}],"path":["near"]},` +
+		`{"message":"` + fmt.Sprintf(ErrGraphQLEmptyArg, "name") +
+		`","locations":[{"line":4,"column":35}],"path":["searchCities"]}]}` + "\n"
+	if response.Body.String() != expected {
+		t.Errorf("Expected body:\n%v\nGot:\n%v\n", expected, response.Body.String())
+	}
+}
+
+// Test asOf arguments which are not RFC 3339 times, and asOf refused by searches by name
+func TestGraphQLAsOf(t *testing.T) {
+	query := `{
+  city(id: 1, asOf: "yesterday") { name }
+  citiesNear(lon: 0, lat: 0, radius: 0, asOf: "2017-01-02T03:04:05Z") { name }
+}`
+	body, _ := json.Marshal(api.GraphQLReq{Query: query})
+	req, _ := http.NewRequest("POST", "/graphql", bytes.NewReader(body))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	expected := `{"data":{"city":null,"citiesNear":[]},"errors":[` +
+		`{"message":"` + fmt.Sprintf(ErrGraphQLInvalidTimeArg, "yesterday", "asOf") +
+		`","locations":[{"line":2,"column":3}],"path":["city"]}]}` + "\n"
+	if response.Body.String() != expected {
+		t.Errorf("Expected body:\n%v\nGot:\n%v\n", expected, response.Body.String())
+	}
+
+	body, _ = json.Marshal(api.GraphQLReq{Query: `{ searchCities(name: "Montreal", asOf: "2017-01-02T03:04:05Z") { name } }`})
+	req, _ = http.NewRequest("POST", "/graphql", bytes.NewReader(body))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+	if message := fmt.Sprintf(ErrGraphQLUnknownArgument, "asOf", "field 'searchCities'"); !strings.Contains(response.Body.String(), message) {
+		t.Errorf("Expected error %q, got %s\n", message, response.Body.String())
+	}
+}
+
+// Test searches with a null radius answered without querying DGraph
+func TestGraphQLNullRadius(t *testing.T) {
+	body, _ := json.Marshal(api.GraphQLReq{Query: "{ citiesNear(lon: 0, lat: 0, radius: 0) { name } }"})
+	req, _ := http.NewRequest("POST", "/graphql", bytes.NewReader(body))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if expected := `{"data":{"citiesNear":[]}}` + "\n"; response.Body.String() != expected {
+		t.Errorf("Expected %s, got %s\n", expected, response.Body.String())
+	}
+}
+
+// Test schema served in schema definition language
+func TestGraphQLSchema(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/graphql/schema", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var rep api.GraphQLSchemaRep
+	field := "citiesNear(lon: Float!, lat: Float!, radius: Int!, filters: CityFilters, limit: Int! = 100, asOf: String): [City!]"
+	if err := json.Unmarshal(response.Body.Bytes(), &rep); err != nil || !strings.Contains(rep.Schema, field) {
+		t.Errorf("Expected schema holding %q, got %s\n", field, response.Body.Bytes())
+	}
+}
+
+// Test rejected changes parameters and round trip of continuation tokens
+func TestChangesParams(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected api.ErrorRep
+	}{
+		{"", api.ErrorRep{Error: ErrSinceOrToken}},
+		{"?since=2017-01-02T03:04:05Z&token=abc", api.ErrorRep{Error: ErrSinceOrToken}},
+		{"?since=yesterday", api.ErrorRep{
+			Error: ErrInvalidQsParams,
+			Details: []string{fmt.Sprintf(ErrInvalidTimeQsParam, "yesterday", "since")},
+		}},
+		{"?token=abc", api.ErrorRep{Error: fmt.Sprintf(ErrInvalidChangesToken, "abc")}},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "/cities/changes" + c.query, nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+		checkJsonBody(t, req, response.Body.Bytes(), &c.expected, &api.ErrorRep{})
+	}
+
+	cursor := dgclient.ChangesCursor{Time: time.Date(2017, 1, 2, 3, 4, 5, 6, time.UTC), Id: -12}
+	if decoded, ok := decodeChangesToken(encodeChangesToken(cursor)); !ok || !decoded.Time.Equal(cursor.Time) || decoded.Id != cursor.Id {
+		t.Errorf("Expected cursor %+v from token, got %+v\n", cursor, decoded)
+	}
+}
+
+// Test for batch lookups rejected before querying the DB, and for empty batches
+func TestBatchGetInvalid(t *testing.T) {
+	ids := make([]string, 1001)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i + 1)
+	}
+	cases := []struct {
+		body     string
+		code     int
+		expected api.ErrorRep
+	}{
+		{`{"ids": [` + strings.Join(ids, ",") + `]}`, http.StatusBadRequest, api.ErrorRep{Error: fmt.Sprintf(ErrTooManyIds, 1001, 1000)}},
+		{`{"ids": [` + strings.Repeat("1,", 20000) + `1]}`, http.StatusRequestEntityTooLarge, api.ErrorRep{Error: fmt.Sprintf(ErrBatchTooLarge, 1000 * batchBytesPerId + 1024)}},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("POST", "/cities:batchGet", strings.NewReader(c.body))
+		response := executeRequest(req)
+		checkResponseCode(t, c.code, response.Code)
+		checkJsonBody(t, req, response.Body.Bytes(), &c.expected, &api.ErrorRep{})
+	}
+
+	req, _ := http.NewRequest("POST", "/cities:batchGet", strings.NewReader(`{"ids": "42"}`))
+	checkResponseCode(t, http.StatusUnprocessableEntity, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("POST", "/cities:batchGet", strings.NewReader(`{"ids": []}`))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	expected := api.BatchGetRep{Cities: []api.CityTempl{}, Missing: []int64{}}
+	checkJsonBody(t, req, response.Body.Bytes(), &expected, &api.BatchGetRep{})
+}
+
+// Test streaming published events, resuming after a given event and expiring past the buffer
+func TestEventsStream(t *testing.T) {
+	config := testConfig()
+	config.EventsBuffer = 2
+	s := new(Server)
+	if err := s.Init(config); err != nil {
+		t.Fatalf("Fail to init server: %+v\n", err)
+	}
+	defer s.Close()
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	first := s.events.last()
+	s.publishEvents([]api.ChangeEvent{
+		{Type: EventCreated, CartodbId: 1, Changes: map[string]interface{}{"name": "Montreal"}},
+		{Type: EventUpdated, CartodbId: 1, Changes: map[string]interface{}{"population": 1704694}},
+		{Type: EventDeleted, CartodbId: 1},
+	})
+
+	// Resuming after the first event, then after an event no longer kept
+	expected := [][]string{
+		{fmt.Sprint(first + 2), EventUpdated, fmt.Sprint(first + 3), EventDeleted},
+		{"", "reset", fmt.Sprint(first + 2), EventUpdated, fmt.Sprint(first + 3), EventDeleted},
+	}
+	for i, lastId := range []uint64{first + 1, first} {
+		req, _ := http.NewRequest("GET", ts.URL + "/events", nil)
+		req.Header.Set("Last-Event-ID", fmt.Sprint(lastId))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to request events: %v\n", err)
+		}
+		checkResponseCode(t, http.StatusOK, resp.StatusCode)
+		checkContentType(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		var received []string
+		id := ""
+		scanner := bufio.NewScanner(resp.Body)
+		for len(received) < len(expected[i]) && scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				received = append(received, id, strings.TrimPrefix(line, "event: "))
+				id = ""
+			}
+		}
+		resp.Body.Close()
+		if !reflect.DeepEqual(received, expected[i]) {
+			t.Errorf("Expected events %v after %v, got %v\n", expected[i], lastId, received)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/events", nil)
+	req.Header.Set("Last-Event-ID", "last")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+// Test a reset event published only for dataset versions bumped by another process, e.g. a load
+func TestDatasetVersionSeen(t *testing.T) {
+	s := &Server{events: newEventBroker(10), webhooks: &webhooks{}, knownVersion: 3}
+	first := s.events.last()
+
+	// Version bumped by the server itself, then by a load
+	s.datasetVersionSeen(3)
+	s.datasetVersionSeen(5)
+	s.datasetVersionSeen(5)
+
+	events, _, _, _ := s.events.since(first)
+	if len(events) != 1 || events[0].Type != EventReset {
+		t.Errorf("Expected a single %v event, got %v\n", EventReset, events)
+	}
+	if s.knownVersion != 5 {
+		t.Errorf("Expected known version 5, got %v\n", s.knownVersion)
+	}
+}
+
+// Test signed delivery of events to webhooks, retried after a failure
+func TestWebhookDelivery(t *testing.T) {
+	const secret = "webhook-secret"
+	bodies := make(chan []byte, 1)
+	attempts := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get(WebhookTimestampHeader) + "." + string(body)))
+		if r.Header.Get(WebhookSignatureHeader) != "sha256=" + hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("Invalid signature %v\n", r.Header.Get(WebhookSignatureHeader))
+		}
+
+		// Failing once for checking retries
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	f, err := ioutil.TempFile("", "webhooks_")
+	if err != nil {
+		t.Fatalf("Fail to create webhooks file: %v\n", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "webhooks:\n  - name: test\n    url: %v\n    secret: %v\n    events: [deleted]\n",
+		receiver.URL, secret)
+	f.Close()
+
+	wh, err := loadWebhooks(f.Name())
+	if err != nil {
+		t.Fatalf("Fail to load webhooks: %+v\n", err)
+	}
+	defer wh.stop(context.Background())
+	wh.publish([]api.ChangeEvent{
+		{Id: 1, Type: EventCreated, CartodbId: 1},
+		{Id: 2, Type: EventDeleted, CartodbId: 1},
+	})
+
+	select {
+	case body := <-bodies:
+		var rep api.WebhookReq
+		if err := json.Unmarshal(body, &rep); err != nil || len(rep.Events) != 1 || rep.Events[0].Id != 2 {
+			t.Errorf("Expected deleted event only, got %s\n", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Events not posted to webhook\n")
+	}
+}
+
 
 /*
  *  Helpers
  */
 
+func testConfig() Config {
+	return Config{
+		Port: "8443",
+		GRPCImportMaxBytes: 1 << 20,
+		DgConnsPool: 10,
+		DgHostAndPort: "127.0.0.1:9080",
+		Deadline: 30,
+		TLSCert: "../certificates/server.crt",
+		TLSKey: "../certificates/server.key",
+		TLSMinVersion: "1.2",
+		APIKeys: testKeysFile,
+		AnonymousRole: "reader",
+		GraphQLMaxDepth: 5,
+		GraphQLMaxComplexity: 10000,
+		EventsBuffer: 100,
+		BatchGetMaxIds: 1000,
+		ImportRate: 1,
+		ImportBurst: 3,
+		ReadRate: 1200,
+		ReadBurst: 40,
+		LargeDist: 100,
+		LargeDistRate: 12,
+		LargeDistBurst: 3,
+		ExportRate: 12,
+		ExportBurst: 10,
+	}
+}
+
+// Serve the gRPC API without TLS on a random port, only methods not using DGraph work
+func startGRPC(t *testing.T, config Config) (rpc.CancitiesClient, func()) {
+	s := new(Server)
+	if err := s.Init(config); err != nil {
+		t.Fatalf("Fail to init server: %+v\n", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fail to listen: %v\n", err)
+	}
+	gs := newGRPCServer(s)
+	go gs.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Fail to dial: %v\n", err)
+	}
+	return rpc.NewCancitiesClient(conn), func() {
+		conn.Close()
+		gs.Stop()
+		s.Close()
+	}
+}
+
+func checkGRPCCode(t *testing.T, expected codes.Code, err error) {
+	st, _ := status.FromError(err)
+	if st.Code() != expected {
+		t.Errorf("Expected gRPC code %v. Got %v (%v)\n", expected, st.Code(), err)
+	}
+}
+
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
 	rr := httptest.NewRecorder()
 	s := new(Server)
-	s.Init("8443", "127.0.0.1:9080", 10)
+	s.Init(testConfig())
 	s.server.Handler.ServeHTTP(rr, req)
 	return rr
 }
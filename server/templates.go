@@ -1,55 +1,95 @@
 package server
 
-import (
-	"time"
-)
-
-// Import Request Template
-type ImportReq struct {
-	Features   []struct {
-		Type          string     `json:"type"`
-		Geometry struct {
-			Type        string     `json:"type"`
-			Coordinates []float64  `json:"coordinates"`
-		}                        `json:"geometry"`
-		Properties struct {
-			Name        string     `json:"name"`
-			Place_key   string     `json:"place_key"`
-			Capital     string     `json:"capital"`
-			Population  int64      `json:"population"`
-			Pclass      string     `json:"pclass"`
-			Cartodb_id  int64      `json:"cartodb_id"`
-			Created_at  time.Time  `json:"created_at"`
-			Updated_at  time.Time  `json:"updated_at"`
-		}                        `json:"properties"`
-	}                          `json:"features"`
-}
-
 const ErrNotFoundId = "City with id %v not found"
+const ErrNotFoundIdAt = "City with id %v not found as of %v"
+const ErrInvalidQsParams = "Invalid query string parameters"
 const ErrInvalidUIntQsParam = "Invalid uint query string value '%v' for parameter '%v'"
-const ErrUnknownQsParam = "Unknown query string parameters"
+const ErrInvalidFloatQsParam = "Invalid float query string value '%v' for parameter '%v'"
+const ErrInvalidBoolQsParam = "Invalid bool query string value '%v' for parameter '%v'"
+const ErrInvalidTimeQsParam = "Invalid RFC 3339 time query string value '%v' for parameter '%v'"
+const ErrInvalidEnumQsParam = "Invalid query string value '%v' for parameter '%v', expected one of: %v"
+const ErrOutOfRangeQsParam = "Query string value '%v' for parameter '%v' out of range [%v, %v]"
+const ErrUnknownQsParam = "Unknown query string parameter: %v"
+const ErrMissingQsParam = "Missing query string parameter: %v"
 const ErrRouteNotFound = "Route %s %s not found"
 const ErrUnprocessableEntity = "Wrong body format: %v"
 const ErrTooManyValues = "Too many values for query string parameter: %v"
+const ErrInvalidFeatures = "%v invalid features in import"
+const ErrImportFailed = "Import failed, status: %v"
+const ErrUnauthorized = "Missing or invalid API key"
+const ErrForbidden = "Role '%v' required"
+const ErrTooManyRequests = "Too many requests, retry in %v seconds"
+const ErrNoImport = "No import done since server started"
+
+// Errors of gRPC requests
+const ErrNegativeField = "Negative value %v for field '%v'"
+const ErrOutOfRangeField = "Value %v for field '%v' out of range [%v, %v]"
+const ErrEmptyField = "Empty field '%v'"
+const ErrInvalidEnumField = "Invalid value '%v' for field '%v', expected one of: %v"
+const ErrInvalidFeature = "Invalid feature %v: %v"
+const ErrImportTooLarge = "Import stream larger than %v bytes"
+const ErrInvalidTimeField = "Invalid time for field '%v': %v"
+
+// Errors of GraphQL requests, parsing then validation then execution ones
+const ErrGraphQLBodyTooLarge = "Request body larger than %v bytes"
+const ErrGraphQLInvalidBody = "Invalid request body: %v"
+const ErrGraphQLMissingQuery = "Missing query"
+const ErrGraphQLUnexpectedChar = "Unexpected character '%v'"
+const ErrGraphQLInvalidNumber = "Invalid number '%v'"
+const ErrGraphQLUnterminatedString = "Unterminated string"
+const ErrGraphQLInvalidEscape = "Invalid escape sequence '%v'"
+const ErrGraphQLUnexpectedToken = "Unexpected %v"
+const ErrGraphQLExpected = "Expected %v, found %v"
+const ErrGraphQLDuplicateFragment = "Fragment '%v' defined more than once"
+const ErrGraphQLNoOperation = "Document holds no operation"
+const ErrGraphQLOperationName = "operationName is required for documents holding several operations"
+const ErrGraphQLUnknownOperation = "Unknown operation '%v'"
+const ErrGraphQLUnsupportedOperation = "Unsupported operation type '%v', only queries are"
+const ErrGraphQLUnknownType = "Unknown type '%v'"
+const ErrGraphQLUnknownField = "Cannot query field '%v' on type '%v'"
+const ErrGraphQLUnknownArgument = "Unknown argument '%v' of %v"
+const ErrGraphQLDuplicateArgument = "Argument '%v' of %v given more than once"
+const ErrGraphQLMissingArgument = "Missing argument '%v' of type '%v' of %v"
+const ErrGraphQLSelectionRequired = "Field '%v' of type '%v' must have a selection of subfields"
+const ErrGraphQLNoSelection = "Field '%v' of scalar type '%v' must not have a selection"
+const ErrGraphQLFieldConflict = "Fields '%v' conflict as they select different fields or arguments"
+const ErrGraphQLUnknownFragment = "Unknown fragment '%v'"
+const ErrGraphQLFragmentType = "Fragment on type '%v' cannot be spread on type '%v'"
+const ErrGraphQLFragmentCycle = "Fragment '%v' spreads itself"
+const ErrGraphQLUnknownDirective = "Unknown directive '@%v'"
+const ErrGraphQLDuplicateVariable = "Variable '$%v' defined more than once"
+const ErrGraphQLUnknownVariable = "Variable '$%v' is not defined"
+const ErrGraphQLVariableInputType = "Variable '$%v' cannot be of non input type '%v'"
+const ErrGraphQLVariableType = "Variable '$%v' of type '%v' used in position expecting type '%v'"
+const ErrGraphQLMissingVariable = "Missing value of variable '$%v' of required type '%v'"
+const ErrGraphQLInvalidVariable = "Invalid value for variable '$%v': %v"
+const ErrGraphQLExpectedType = "Expected value of type '%v', found %v"
+const ErrGraphQLTooManySelections = "Query holds more than %v selections once fragments are spread"
+const ErrGraphQLMaxDepth = "Query depth exceeds maximum %v"
+const ErrGraphQLMaxComplexity = "Query complexity %v exceeds maximum %v"
+const ErrGraphQLOutOfRangeArg = "Value %v for argument '%v' out of range [%v, %v]"
+const ErrGraphQLEmptyArg = "Empty argument '%v'"
+const ErrGraphQLInvalidTimeArg = "Invalid RFC 3339 time '%v' for argument '%v'"
 
-// Error Reply Template
-type ErrorRep struct {
-	Error           string     `json:"error"`
-}
+// Errors of change event streams
+const ErrInvalidLastEventId = "Invalid Last-Event-ID '%v'"
+const ErrEventsMissed = "Events after %v are no longer available, changes may have been missed"
 
-// Status Reply Template
-type StatusRep struct {
-	Message         string     `json:"message"`
-}
+// Errors of batch lookups
+const ErrBatchTooLarge = "Request body larger than %v bytes"
+const ErrTooManyIds = "%v ids given, at most %v are accepted per batch"
 
-// Find Reply Template
-type CityTempl struct {
-	CartodbId       int64      `json:"cartodb_id"`
-	Name            string     `json:"name"`
-	Population      int64      `json:"population"`
-	Coordinates     []float64  `json:"coordinates"`
-}
+// Errors of incremental syncs
+const ErrSinceOrToken = "Exactly one of since and token query string parameters is required"
+const ErrInvalidChangesToken = "Invalid continuation token '%v'"
 
-type CitiesTempl struct {
-	Cities          []CityTempl `json:"cities"`
-}
+// Reasons for rejecting an imported feature
+const ErrFeatureType = "Feature type must be 'Feature', got '%v'"
+const ErrGeometryType = "Geometry type must be 'Point', got '%v'"
+const ErrCoordinatesLen = "Point must have 2 coordinates, got %v"
+const ErrLongitudeRange = "Longitude %v out of range [-180, 180]"
+const ErrLatitudeRange = "Latitude %v out of range [-90, 90]"
+const ErrMissingCartodbId = "Missing cartodb_id"
+const ErrDuplicatedCartodbId = "Same cartodb_id as feature %v"
+const ErrEmptyName = "Empty name"
+const ErrNegativePopulation = "Negative population %v"
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"github.com/pkg/errors"
+)
+
+// TLS settings of the server
+type TLSOptions struct {
+	Cert        string
+	Key         string
+	// Bundle of CA certificates, client certificates are required and verified against it if set
+	ClientCA    string
+	// Minimum TLS version: 1.0, 1.1, 1.2 or 1.3
+	MinVersion  string
+	// Comma separated names of allowed cipher suites, Go defaults if empty
+	Ciphers     string
+}
+
+// Interval between checks of certificate files modification
+const certWatchInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Build TLS configuration of the server from options
+func newTLSConfig(opts TLSOptions, certs *certReloader) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: certs.getCertificate,
+	}
+
+	if opts.MinVersion != "" {
+		v, ok := tlsVersions[opts.MinVersion]
+		if !ok {
+			return nil, errors.Errorf("unknown TLS version '%v'", opts.MinVersion)
+		}
+		config.MinVersion = v
+	}
+
+	if opts.Ciphers != "" {
+		suites := make(map[string]uint16)
+		for _, c := range tls.CipherSuites() {
+			suites[c.Name] = c.ID
+		}
+		for _, name := range strings.Split(opts.Ciphers, ",") {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, errors.Errorf("unknown or insecure cipher suite '%v'", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+
+	if opts.ClientCA != "" {
+		pem, err := ioutil.ReadFile(opts.ClientCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading client CA bundle")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate found in client CA bundle %v", opts.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+
+/*
+ *  Certificate reloading
+ */
+
+// Hold the server certificate, loaded again from disk on demand or when files change.
+// Connections already established keep the certificate they were opened with
+type certReloader struct {
+	sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	stop     chan struct{}
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile: keyFile,
+		stop: make(chan struct{}),
+	}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Load certificate and key from disk. The previous certificate is kept on failure
+func (cr *certReloader) Reload() error {
+	modTime, err := cr.lastModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "error loading TLS certificate")
+	}
+
+	cr.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.Unlock()
+	return nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.RLock()
+	defer cr.RUnlock()
+	return cr.cert, nil
+}
+
+// Reload certificate whenever certificate or key file is modified, until close
+func (cr *certReloader) watch() {
+	ticker := time.NewTicker(certWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cr.stop:
+			return
+		case <-ticker.C:
+		}
+
+		modTime, err := cr.lastModTime()
+		cr.RLock()
+		changed := err == nil && modTime.After(cr.modTime)
+		cr.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := cr.Reload(); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %+v\n", err)
+		} else {
+			fmt.Printf("INFO: TLS certificate reloaded\n")
+		}
+	}
+}
+
+func (cr *certReloader) close() {
+	close(cr.stop)
+}
+
+func (cr *certReloader) lastModTime() (time.Time, error) {
+	var last time.Time
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return last, errors.Wrap(err, "error checking TLS certificate file")
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"github.com/AsT4re/cancities/dgclient"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Page size of v2 lists when no limit is given, and maximum limit accepted
+const (
+	DefaultPageSize = 100
+	MaxPageSize = 1000
+)
+
+// Wrap the handler of a deprecated alias so that responses point to the v1 route
+func deprecated(fn appHandler) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf(`</v1%s>; rel="successor-version"`, r.URL.Path))
+		return fn(w, r)
+	}
+}
+
+// Wrap a handler so that its successful responses are enveloped as v2 responses. Errors
+// are returned as in v1
+func enveloped(wrap func(body interface{}) interface{}, fn appHandler) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		ret := fn(w, r)
+		if ret.code >= 200 && ret.code < 300 && ret.jsonTempl != nil {
+			return &httpRetMsg{ret.code, wrap(ret.jsonTempl)}
+		}
+		return ret
+	}
+}
+
+func importEnvelope(body interface{}) interface{} {
+	return api.ImportRepV2{Data: body.(api.ImportRep)}
+}
+
+func findV2Handler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		found, ret := findCities(s, r)
+		if ret != nil {
+			return ret
+		}
+
+		meta := api.QueryMetaRep{
+			CartodbId: &found.city.CartodbId,
+			Center: found.city.Coordinates,
+		}
+		if found.around == nil {
+			return &httpRetMsg{
+				http.StatusOK,
+				api.CityRepV2{Data: found.city, Meta: meta},
+			}
+		}
+		meta.Distance = &found.dist
+
+		return &httpRetMsg{
+			http.StatusOK,
+			citiesPage(r, found.around, &meta),
+		}
+	}
+}
+
+func nearV2Handler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		near, ret := searchNear(s, r)
+		if ret != nil {
+			return ret
+		}
+
+		return &httpRetMsg{
+			http.StatusOK,
+			citiesPage(r, near.cities, &api.QueryMetaRep{Center: near.center, Distance: &near.dist}),
+		}
+	}
+}
+
+// Every city, paged by DGraph
+func citiesV2Handler(s *Server) appHandler {
+	return func (w http.ResponseWriter, r *http.Request) *httpRetMsg {
+		page := pagination(r)
+		var cities dgclient.CitiesRep
+		var total int64
+		var err error
+		if at := asOf(r); at.IsZero() {
+			cities, total, err = s.db.GetCitiesPage(page.Limit, page.Offset)
+		} else {
+			cities, total, err = s.db.GetCitiesPageAt(page.Limit, page.Offset, at)
+		}
+		if err != nil {
+			return internalError(err)
+		}
+
+		citiesArr, err := citiesTempl(cities)
+		if err != nil {
+			return internalError(err)
+		}
+		page.Total = int(total)
+
+		return &httpRetMsg{
+			http.StatusOK,
+			api.CitiesRepV2{Data: citiesArr, Pagination: page},
+		}
+	}
+}
+
+// Page of cities selected by limit and offset query string parameters
+func citiesPage(r *http.Request, cities []api.CityTempl, meta *api.QueryMetaRep) api.CitiesRepV2 {
+	page := pagination(r)
+	page.Total = len(cities)
+
+	start := page.Offset
+	if start > uint64(len(cities)) {
+		start = uint64(len(cities))
+	}
+	end := start + page.Limit
+	if end > uint64(len(cities)) {
+		end = uint64(len(cities))
+	}
+
+	return api.CitiesRepV2{Data: cities[start:end], Pagination: page, Meta: meta}
+}
+
+// Limit and offset given by query string parameters, without total
+func pagination(r *http.Request) api.PaginationRep {
+	qs := getQsValues(r)
+	page := api.PaginationRep{Limit: DefaultPageSize}
+	if limit, ok := qs.getUInt("limit"); ok {
+		page.Limit = limit
+	}
+	page.Offset, _ = qs.getUInt("offset")
+	return page
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+	"github.com/AsT4re/cancities/api"
+)
+
+// Delivery of change events to webhooks
+const (
+	// Batches of events waiting for delivery per webhook, further batches are dropped
+	webhookQueueSize = 1000
+	// Maximum number of events posted in one request
+	webhookMaxBatch = 500
+	webhookMaxAttempts = 6
+	webhookBackoff = time.Second
+	maxWebhookBackoff = time.Minute
+	webhookTimeout = 10 * time.Second
+)
+
+// Headers of webhook requests. The signature is the hex encoded HMAC-SHA256 of the timestamp,
+// a dot and the body, keyed by the secret of the webhook
+const (
+	WebhookTimestampHeader = "X-Cancities-Timestamp"
+	WebhookSignatureHeader = "X-Cancities-Signature"
+)
+
+var webhookDeliveries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cancities_webhook_deliveries_total",
+		Help: "Number of batches of change events posted to webhooks, by result.",
+	},
+	[]string{"webhook", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(webhookDeliveries)
+}
+
+// Format of the webhooks file
+type webhooksFile struct {
+	Webhooks []struct {
+		Name   string   `yaml:"name"`
+		URL    string   `yaml:"url"`
+		Secret string   `yaml:"secret"`
+		// Types of the events posted, every type if empty
+		Events []string `yaml:"events"`
+	}           `yaml:"webhooks"`
+}
+
+type webhook struct {
+	name   string
+	url    string
+	secret []byte
+	types  map[string]bool
+	queue  chan []api.ChangeEvent
+}
+
+// Webhooks each having its own queue and worker, so that a slow endpoint does not delay others
+type webhooks struct {
+	hooks  []*webhook
+	client *http.Client
+	// Closed when stopping, pending deliveries being abandoned
+	done   chan struct{}
+	// Cancel requests in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+// Load webhooks from a YAML file and start their workers. No webhook is loaded if file is empty
+func loadWebhooks(file string) (*webhooks, error) {
+	wh := &webhooks{
+		client: &http.Client{Timeout: webhookTimeout},
+		done: make(chan struct{}),
+	}
+	wh.ctx, wh.cancel = context.WithCancel(context.Background())
+	if file == "" {
+		return wh, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading webhooks file")
+	}
+
+	var content webhooksFile
+	if err := yaml.UnmarshalStrict(data, &content); err != nil {
+		return nil, errors.Wrap(err, "error parsing webhooks file")
+	}
+
+	names := make(map[string]bool)
+	for i, h := range content.Webhooks {
+		if h.Name == "" || h.URL == "" || h.Secret == "" {
+			return nil, errors.Errorf("webhook %v: name, url and secret are required", i)
+		}
+		if names[h.Name] {
+			return nil, errors.Errorf("webhook '%v': same name as another one", h.Name)
+		}
+		names[h.Name] = true
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, errors.Errorf("webhook '%v': invalid url '%v'", h.Name, h.URL)
+		}
+
+		hook := &webhook{
+			name: h.Name,
+			url: h.URL,
+			secret: []byte(h.Secret),
+			queue: make(chan []api.ChangeEvent, webhookQueueSize),
+		}
+		if len(h.Events) > 0 {
+			hook.types = make(map[string]bool)
+			for _, t := range h.Events {
+				if t != EventCreated && t != EventUpdated && t != EventDeleted && t != EventReset {
+					return nil, errors.Errorf("webhook '%v': unknown event type '%v'", h.Name, t)
+				}
+				hook.types[t] = true
+			}
+		}
+		wh.hooks = append(wh.hooks, hook)
+	}
+
+	for _, hook := range wh.hooks {
+		wh.wg.Add(1)
+		go wh.work(hook)
+	}
+	return wh, nil
+}
+
+// Queue events for every webhook, in batches of at most webhookMaxBatch events
+func (wh *webhooks) publish(events []api.ChangeEvent) {
+	for _, hook := range wh.hooks {
+		var selected []api.ChangeEvent
+		for _, ev := range events {
+			if hook.types == nil || hook.types[ev.Type] {
+				selected = append(selected, ev)
+			}
+		}
+
+		for len(selected) > 0 {
+			n := len(selected)
+			if n > webhookMaxBatch {
+				n = webhookMaxBatch
+			}
+			select {
+			case hook.queue <- selected[:n]:
+			default:
+				fmt.Fprintf(os.Stderr, "WARNING: queue of webhook '%v' full, dropping events %v to %v\n",
+					hook.name, selected[0].Id, selected[n - 1].Id)
+				webhookDeliveries.WithLabelValues(hook.name, "dropped").Inc()
+			}
+			selected = selected[n:]
+		}
+	}
+}
+
+// Stop workers once their current delivery is done, or when the context is done
+func (wh *webhooks) stop(ctx context.Context) {
+	wh.once.Do(func() {
+		close(wh.done)
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		wh.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		wh.cancel()
+		<-stopped
+	}
+}
+
+func (wh *webhooks) work(hook *webhook) {
+	defer wh.wg.Done()
+	for {
+		select {
+		case events := <-hook.queue:
+			wh.deliver(hook, events)
+		case <-wh.done:
+			if pending := len(hook.queue); pending > 0 {
+				fmt.Fprintf(os.Stderr, "WARNING: %v batches of events not posted to webhook '%v' on stop\n",
+					pending, hook.name)
+			}
+			return
+		}
+	}
+}
+
+// Post events to a webhook, retrying with exponential backoff on network errors, 429 and 5xx
+func (wh *webhooks) deliver(hook *webhook, events []api.ChangeEvent) {
+	body, err := json.Marshal(api.WebhookReq{Events: events})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %+v\n", errors.Wrap(err, "Fail to serialize webhook body"))
+		return
+	}
+
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := wh.post(hook, body)
+		if err == nil {
+			webhookDeliveries.WithLabelValues(hook.name, "delivered").Inc()
+			return
+		}
+
+		if !retry || attempt == webhookMaxAttempts {
+			fmt.Fprintf(os.Stderr, "ERROR: posting events %v to %v to webhook '%v' failed after %v attempts: %v\n",
+				events[0].Id, events[len(events) - 1].Id, hook.name, attempt, err)
+			webhookDeliveries.WithLabelValues(hook.name, "failed").Inc()
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-wh.done:
+			fmt.Fprintf(os.Stderr, "WARNING: retries of events %v to %v for webhook '%v' abandoned on stop\n",
+				events[0].Id, events[len(events) - 1].Id, hook.name)
+			webhookDeliveries.WithLabelValues(hook.name, "failed").Inc()
+			return
+		}
+		if backoff *= 2; backoff > maxWebhookBackoff {
+			backoff = maxWebhookBackoff
+		}
+	}
+}
+
+// Post a signed body once, returning whether a failure may be retried
+func (wh *webhooks) post(hook *webhook, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", hook.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", JsonContentType)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, signWebhook(hook.secret, timestamp, body))
+
+	resp, err := wh.client.Do(req.WithContext(wh.ctx))
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = errors.Errorf("webhook replied %v", resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// Signature of a webhook body, "sha256=" followed by the hex encoded HMAC
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}